@@ -13,9 +13,11 @@ import (
 
 	"github.com/scinfra-pro/switch-gate/internal/api"
 	"github.com/scinfra-pro/switch-gate/internal/config"
+	"github.com/scinfra-pro/switch-gate/internal/dns"
 	"github.com/scinfra-pro/switch-gate/internal/metrics"
 	"github.com/scinfra-pro/switch-gate/internal/proxy"
 	"github.com/scinfra-pro/switch-gate/internal/router"
+	"github.com/scinfra-pro/switch-gate/internal/state"
 	"github.com/scinfra-pro/switch-gate/internal/webhook"
 )
 
@@ -54,12 +56,31 @@ func main() {
 		log.Fatalf("Failed to create router: %v", err)
 	}
 
+	// Persisted state (optional): traffic counters and quota usage survive restarts
+	persist := cfg.State.Dir != ""
+	if persist {
+		store, err := state.Open(cfg.State.Dir)
+		if err != nil {
+			log.Fatalf("Failed to open state directory: %v", err)
+		}
+		if err := rtr.RestoreState(store); err != nil {
+			log.Fatalf("Failed to restore state: %v", err)
+		}
+		log.Printf("INFO: State persisted in %s", store.Dir())
+	}
+
 	// SOCKS5 Proxy server
 	proxyServer, err := proxy.New(cfg.Server.Listen, rtr, met)
 	if err != nil {
 		log.Fatalf("Failed to create proxy server: %v", err)
 	}
 
+	// SOCKS5 username/password authentication (optional)
+	if users := cfg.Server.Auth.Users; len(users) > 0 {
+		proxyServer.SetAuth(users)
+		log.Printf("INFO: SOCKS5 authentication required (%d users)", len(users))
+	}
+
 	// Transparent proxy server (optional, for iptables REDIRECT, Linux only)
 	var transparentServer *proxy.TransparentServer
 	if cfg.Server.Transparent != "" {
@@ -70,6 +91,27 @@ func main() {
 		}
 	}
 
+	// DNS server (optional): lets the proxies recover domains of IP targets
+	var dnsServer *dns.Server
+	if cfg.DNS.Enabled {
+		dnsServer, err = dns.New(cfg.DNS)
+		if err != nil {
+			log.Fatalf("Failed to create DNS server: %v", err)
+		}
+		proxyServer.SetHostLookup(dnsServer)
+		if transparentServer != nil {
+			transparentServer.SetHostLookup(dnsServer)
+		}
+	}
+
+	// Domain sniffing on connections to IP targets (optional)
+	if cfg.Sniff.Enabled {
+		proxyServer.SetSniffing(cfg.Sniff)
+		if transparentServer != nil {
+			transparentServer.SetSniffing(cfg.Sniff)
+		}
+	}
+
 	// API server
 	apiServer := api.New(rtr, met, proxyServer)
 
@@ -94,25 +136,53 @@ func main() {
 		})
 	}
 
+	// DNS server
+	if dnsServer != nil {
+		g.Go(dnsServer.Serve)
+	}
+
 	// API server
 	g.Go(func() error {
 		log.Printf("API server listening on %s", cfg.Server.API)
 		return apiServer.ListenAndServe(cfg.Server.API)
 	})
 
+	// GeoIP database reloader
+	if geo := rtr.GeoIP(); geo != nil {
+		g.Go(func() error {
+			geo.Watch(gCtx, cfg.GeoIP.ReloadInterval)
+			return nil
+		})
+	}
+
+	// Health monitor
+	if cfg.Health.Enabled {
+		g.Go(func() error {
+			rtr.RunHealthMonitor(gCtx)
+			return nil
+		})
+	}
+
+	// Scheduled mode switches
+	if len(cfg.Schedule.Entries) > 0 {
+		g.Go(func() error {
+			rtr.RunSchedule(gCtx)
+			return nil
+		})
+	}
+
+	// State flusher
+	if persist {
+		g.Go(func() error {
+			rtr.RunStateFlush(gCtx)
+			return nil
+		})
+	}
+
 	// Limit checker
 	g.Go(func() error {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				rtr.CheckLimits()
-			case <-gCtx.Done():
-				return nil
-			}
-		}
+		rtr.RunLimitCheck(gCtx)
+		return nil
 	})
 
 	// Wait for shutdown signal
@@ -128,7 +198,14 @@ func main() {
 	if transparentServer != nil {
 		transparentServer.Shutdown()
 	}
+	if dnsServer != nil {
+		dnsServer.Shutdown()
+	}
 	_ = apiServer.Shutdown(shutdownCtx)
 
+	if err := rtr.SaveState(); err != nil {
+		log.Printf("WARN: Failed to save state: %v", err)
+	}
+
 	log.Println("Goodbye!")
 }
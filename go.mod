@@ -5,7 +5,17 @@ go 1.24.0
 toolchain go1.24.12
 
 require (
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/crypto v0.47.0
 	golang.org/x/net v0.49.0
 	golang.org/x/sync v0.19.0
+	golang.org/x/time v0.14.0
 	gopkg.in/yaml.v3 v3.0.1
+	lukechampine.com/blake3 v1.4.1
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	golang.org/x/sys v0.40.0 // indirect
 )
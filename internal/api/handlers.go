@@ -1,13 +1,16 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/scinfra-pro/switch-gate/internal/proxy"
 	"github.com/scinfra-pro/switch-gate/internal/router"
 )
 
@@ -16,6 +19,7 @@ type SetModeResponse struct {
 	Success   bool   `json:"success"`
 	Requested string `json:"requested"`
 	Mode      string `json:"mode"`
+	Policy    string `json:"policy,omitempty"` // Applied to the previous mode's connections
 	Error     string `json:"error,omitempty"`
 	// Keep "status" for backward compatibility
 	Status string `json:"status,omitempty"`
@@ -26,54 +30,256 @@ const (
 	ErrModeNotConfigured = "mode_not_configured"
 	ErrModeInvalid       = "mode_invalid"
 	ErrHomeLimitReached  = "home_limit_reached"
+	ErrLimitReached      = "limit_reached" // Traffic limit of a mode other than home
 	ErrInternal          = "internal_error"
 )
 
+// LimitStats contains the traffic limit of a mode and its usage
+type LimitStats struct {
+	Mode        string  `json:"mode"`
+	LimitMB     int     `json:"limit_mb"`
+	UsedMB      float64 `json:"used_mb"`
+	RemainingMB float64 `json:"remaining_mb"`
+	Action      string  `json:"action"`              // switch, block, throttle
+	SwitchTo    string  `json:"switch_to,omitempty"` // switch
+	Throttle    string  `json:"throttle,omitempty"`  // throttle: rate
+	Exhausted   bool    `json:"exhausted"`
+	Throttled   bool    `json:"throttled,omitempty"`
+	Budget      float64 `json:"budget,omitempty"`       // In pricing.currency
+	Warnings    []int   `json:"warnings,omitempty"`     // Thresholds in percent
+	OvershootMB int     `json:"overshoot_mb,omitempty"` // Traffic past the limit before flows are cut
+	ExhaustedAt string  `json:"exhausted_at,omitempty"` // RFC 3339, projected from the recent usage
+	Cost        float64 `json:"cost"`                   // Spend of the usage in the period
+	Period      string  `json:"period,omitempty"`
+	PeriodStart string  `json:"period_start,omitempty"` // RFC 3339
+	PeriodEnd   string  `json:"period_end,omitempty"`   // RFC 3339
+}
+
+// SpendStats contains the spend of every priced mode
+type SpendStats struct {
+	Currency    string           `json:"currency"`
+	Period      string           `json:"period"` // Accounting period (state.period)
+	Start       string           `json:"start"`  // RFC 3339
+	End         string           `json:"end"`    // RFC 3339
+	Modes       []ModeSpendStats `json:"modes"`
+	PeriodTotal float64          `json:"period_total"`
+	Total       float64          `json:"total"`
+}
+
+// ModeSpendStats contains the spend of a mode
+type ModeSpendStats struct {
+	Mode   string  `json:"mode"`
+	Period float64 `json:"period"` // Current accounting period
+	Total  float64 `json:"total"`  // All accounting periods
+}
+
+// BandwidthStats contains the rates of a bandwidth scope and its current
+// throughput while limited, in bytes per second (rate 0 = unlimited)
+type BandwidthStats struct {
+	Scope              string  `json:"scope"`             // global, client, mode
+	Mode               string  `json:"mode,omitempty"`    // scope mode
+	Clients            int     `json:"clients,omitempty"` // scope client: clients with open connections
+	UploadRate         float64 `json:"upload_rate"`
+	DownloadRate       float64 `json:"download_rate"`
+	UploadThroughput   float64 `json:"upload_throughput"`
+	DownloadThroughput float64 `json:"download_throughput"`
+}
+
+// ClientsResponse represents the GET /clients response
+type ClientsResponse struct {
+	Key         string        `json:"key"`          // Client identity: ip, group, user
+	Period      string        `json:"period"`       // Accounting period (state.period)
+	PeriodStart string        `json:"period_start"` // RFC 3339
+	PeriodEnd   string        `json:"period_end"`   // RFC 3339, when period usage and quotas reset
+	Clients     []ClientStats `json:"clients"`      // Heaviest in the period first
+}
+
+// ClientStats contains the traffic of a client
+type ClientStats struct {
+	Client      string            `json:"client"`
+	Connections int               `json:"connections"`
+	LastSeen    string            `json:"last_seen"` // RFC 3339
+	TotalMB     float64           `json:"total_mb"`
+	PeriodMB    float64           `json:"period_mb"`
+	Modes       []ClientModeStats `json:"modes"`
+}
+
+// ClientModeStats contains the traffic of a client through a mode
+type ClientModeStats struct {
+	Mode      string  `json:"mode"`
+	TotalMB   float64 `json:"total_mb"`
+	PeriodMB  float64 `json:"period_mb"`
+	QuotaMB   int     `json:"quota_mb,omitempty"` // Per accounting period
+	Exhausted bool    `json:"exhausted,omitempty"`
+}
+
 // StatusResponse represents the /status response
 type StatusResponse struct {
-	Mode        string       `json:"mode"`
-	ModeHealthy *bool        `json:"mode_healthy,omitempty"` // only with ?check=true
-	ModeError   *string      `json:"mode_error,omitempty"`   // only if mode_healthy=false
-	Uptime      string       `json:"uptime"`
-	Connections int          `json:"connections"`
-	Traffic     TrafficStats `json:"traffic"`
-	Home        HomeStats    `json:"home"`
-	Available   []string     `json:"available_modes"`
+	Mode          string             `json:"mode"`
+	ModeHealthy   *bool              `json:"mode_healthy,omitempty"`    // only with ?check=true
+	ModeError     *string            `json:"mode_error,omitempty"`      // only if mode_healthy=false
+	FailedHop     *FailedHopStats    `json:"mode_failed_hop,omitempty"` // only for chains
+	Uptime        string             `json:"uptime"`
+	Connections   int                `json:"connections"`
+	ModeConns     map[string]int     `json:"connections_by_mode,omitempty"`
+	Traffic       TrafficStats       `json:"traffic"`
+	TrafficPeriod TrafficPeriodStats `json:"traffic_period"`
+	Home          HomeStats          `json:"home"`
+	Limits        []LimitStats       `json:"limits,omitempty"`
+	Bandwidth     []BandwidthStats   `json:"bandwidth,omitempty"`
+	Spend         *SpendStats        `json:"spend,omitempty"`
+	Available     []string           `json:"available_modes"`
+	Clients       []ClientGroupStats `json:"clients,omitempty"`
+	Pools         []PoolStats        `json:"pools,omitempty"`
+	Races         []RaceStats        `json:"races,omitempty"`
+	Health        []ModeHealthStats  `json:"health,omitempty"`
+	Schedule      []ScheduleStats    `json:"schedule,omitempty"`
+}
+
+// ScheduleStats is an upcoming scheduled mode switch
+type ScheduleStats struct {
+	Mode string `json:"mode"`
+	At   string `json:"at"` // RFC 3339, in the entry's timezone
+	Cron string `json:"cron"`
+}
+
+// RaceStats contains the win statistics of a race mode
+type RaceStats struct {
+	Name    string            `json:"name"`
+	Races   uint64            `json:"races"`
+	Members []RaceMemberStats `json:"members"`
+}
+
+// RaceMemberStats contains the wins of a race member
+type RaceMemberStats struct {
+	Mode     string  `json:"mode"`
+	Wins     uint64  `json:"wins"`
+	WinRate  float64 `json:"win_rate"` // wins / races
+	Failures uint64  `json:"failures"`
+}
+
+// ModeHealthStats contains the health monitor state of a mode
+type ModeHealthStats struct {
+	Mode                 string `json:"mode"`
+	Healthy              bool   `json:"healthy"`
+	ConsecutiveFailures  int    `json:"consecutive_failures"`
+	ConsecutiveSuccesses int    `json:"consecutive_successes"`
+	LastError            string `json:"last_error,omitempty"`
+	LastCheck            string `json:"last_check"` // RFC 3339
+}
+
+// PoolStats contains the members of a pool mode
+type PoolStats struct {
+	Name     string            `json:"name"`
+	Strategy string            `json:"strategy"`
+	Members  []PoolMemberStats `json:"members"`
+}
+
+// PoolMemberStats contains the health and traffic of a pool member
+type PoolMemberStats struct {
+	Mode        string  `json:"mode"`
+	Weight      int     `json:"weight"`
+	Healthy     bool    `json:"healthy"`
+	CooldownSec int     `json:"cooldown_sec,omitempty"` // Remaining cooldown
+	Connections int     `json:"connections"`
+	MB          float64 `json:"mb"`
+	Failures    uint64  `json:"failures"`
+	LastError   string  `json:"last_error,omitempty"`
+}
+
+// FailedHopStats identifies the failed hop of a chain mode
+type FailedHopStats struct {
+	Hop   int    `json:"hop"` // 1-based
+	Mode  string `json:"mode"`
+	Error string `json:"error"`
 }
 
 // Error codes for mode health check
 const (
-	ErrWarpUnreachable    = "warp_unreachable"
-	ErrWarpTimeout        = "warp_timeout"
-	ErrWarpInterfaceDown  = "warp_interface_down"
-	ErrHomeUnreachable    = "home_unreachable"
-	ErrHomeTimeout        = "home_timeout"
-	ErrCheckFailed        = "check_failed"
+	ErrWarpUnreachable   = "warp_unreachable"
+	ErrWarpTimeout       = "warp_timeout"
+	ErrWarpInterfaceDown = "warp_interface_down"
+	ErrHomeUnreachable   = "home_unreachable"
+	ErrHomeTimeout       = "home_timeout"
+	ErrCheckFailed       = "check_failed"
 )
 
-// TrafficStats contains traffic statistics per mode
+// TrafficStats contains traffic statistics per mode.
+// Encoded as {"<mode>_mb": ..., "total_mb": ...} in mode registry order.
 type TrafficStats struct {
-	DirectMB float64 `json:"direct_mb"`
-	WarpMB   float64 `json:"warp_mb"`
-	HomeMB   float64 `json:"home_mb"`
-	TotalMB  float64 `json:"total_mb"`
+	Modes   []string
+	MB      map[string]float64
+	TotalMB float64
+}
+
+// newTrafficStats converts byte counts per mode to MB
+func newTrafficStats(modes []string, bytes map[string]uint64) TrafficStats {
+	traffic := TrafficStats{
+		Modes: modes,
+		MB:    make(map[string]float64, len(modes)),
+	}
+	var totalMB float64
+	for _, mode := range modes {
+		mb := float64(bytes[mode]) / 1024 / 1024
+		traffic.MB[mode] = roundTo2(mb)
+		totalMB += mb
+	}
+	traffic.TotalMB = roundTo2(totalMB)
+	return traffic
+}
+
+// TrafficPeriodStats contains the traffic per mode in the accounting period
+type TrafficPeriodStats struct {
+	Period  string       `json:"period"`
+	Start   string       `json:"start"` // RFC 3339
+	End     string       `json:"end"`   // RFC 3339, when the counters reset
+	Traffic TrafficStats `json:"traffic"`
 }
 
-// HomeStats contains home mode statistics
+// MarshalJSON encodes per-mode traffic as "<mode>_mb" fields
+func (t TrafficStats) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, mode := range t.Modes {
+		fmt.Fprintf(&buf, "%q:%s,", mode+"_mb", strconv.FormatFloat(t.MB[mode], 'f', -1, 64))
+	}
+	fmt.Fprintf(&buf, "%q:%s}", "total_mb", strconv.FormatFloat(t.TotalMB, 'f', -1, 64))
+	return buf.Bytes(), nil
+}
+
+// ClientGroupStats describes the effective mode of a client group
+type ClientGroupStats struct {
+	Name         string   `json:"name"`
+	CIDR         []string `json:"cidr"`
+	Mode         string   `json:"mode"`                   // Effective mode for unmatched traffic
+	DefaultMode  string   `json:"default_mode,omitempty"` // Configured default
+	AllowedModes []string `json:"allowed_modes,omitempty"`
+}
+
+// HomeStats contains home mode statistics. Usage is counted per billing
+// period if one is configured.
 type HomeStats struct {
 	LimitMB     int     `json:"limit_mb"`
 	UsedMB      float64 `json:"used_mb"`
 	RemainingMB float64 `json:"remaining_mb"`
-	CostUSD     float64 `json:"cost_usd"`
+	CostUSD     float64 `json:"cost_usd"`               // In pricing.currency, the name is kept for compatibility
+	Period      string  `json:"period,omitempty"`       // daily, weekly, monthly, rolling
+	PeriodStart string  `json:"period_start,omitempty"` // RFC 3339
+	PeriodEnd   string  `json:"period_end,omitempty"`   // RFC 3339, when usage resets
 }
 
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	stats := s.metrics.GetStats()
 
-	directMB := float64(stats.Bytes["direct"]) / 1024 / 1024
-	warpMB := float64(stats.Bytes["warp"]) / 1024 / 1024
-	homeMB := float64(stats.Bytes["home"]) / 1024 / 1024
-	limitMB := s.router.GetHomeLimit()
+	period := s.router.TrafficPeriod()
+	periodBytes := make(map[string]uint64, len(period.Bytes))
+	for mode, n := range period.Bytes {
+		periodBytes[mode.String()] = n
+	}
+
+	quota, _ := s.router.Limit(router.ModeHome)
+	homeMB := float64(quota.UsedBytes) / 1024 / 1024
+	limitMB := int(quota.LimitBytes / 1024 / 1024)
 
 	available := make([]string, 0)
 	for _, m := range s.router.AvailableModes() {
@@ -84,28 +290,162 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		Mode:        s.router.GetMode().String(),
 		Uptime:      stats.Uptime.Round(time.Second).String(),
 		Connections: s.proxy.ActiveConnections(),
-		Traffic: TrafficStats{
-			DirectMB: roundTo2(directMB),
-			WarpMB:   roundTo2(warpMB),
-			HomeMB:   roundTo2(homeMB),
-			TotalMB:  roundTo2(directMB + warpMB + homeMB),
+		Traffic:     newTrafficStats(stats.Modes, stats.Bytes),
+		TrafficPeriod: TrafficPeriodStats{
+			Period:  string(period.Period),
+			Start:   period.Start.Format(time.RFC3339),
+			End:     period.End.Format(time.RFC3339),
+			Traffic: newTrafficStats(stats.Modes, periodBytes),
 		},
 		Home: HomeStats{
 			LimitMB:     limitMB,
 			UsedMB:      roundTo2(homeMB),
 			RemainingMB: roundTo2(float64(limitMB) - homeMB),
-			CostUSD:     roundTo2(homeMB / 1024 * 3.50),
+			CostUSD:     roundTo2(quota.Cost),
 		},
 		Available: available,
 	}
+	if quota.Period != "" {
+		resp.Home.Period = string(quota.Period)
+		resp.Home.PeriodStart = quota.PeriodStart.Format(time.RFC3339)
+		resp.Home.PeriodEnd = quota.PeriodEnd.Format(time.RFC3339)
+	}
+
+	resp.Bandwidth = s.bandwidthStats()
+
+	spend := s.router.Spend()
+	if len(spend.Modes) > 0 {
+		resp.Spend = &SpendStats{
+			Currency: spend.Currency,
+			Period:   string(spend.Period),
+			Start:    spend.Start.Format(time.RFC3339),
+			End:      spend.End.Format(time.RFC3339),
+		}
+		for _, m := range spend.Modes {
+			resp.Spend.Modes = append(resp.Spend.Modes, ModeSpendStats{
+				Mode:   m.Mode.String(),
+				Period: roundTo2(m.Period),
+				Total:  roundTo2(m.Total),
+			})
+			resp.Spend.PeriodTotal += m.Period
+			resp.Spend.Total += m.Total
+		}
+		resp.Spend.PeriodTotal = roundTo2(resp.Spend.PeriodTotal)
+		resp.Spend.Total = roundTo2(resp.Spend.Total)
+	}
+
+	for _, l := range s.router.Limits() {
+		usedMB := float64(l.UsedBytes) / 1024 / 1024
+		limit := LimitStats{
+			Mode:        l.Mode.String(),
+			LimitMB:     int(l.LimitBytes / 1024 / 1024),
+			UsedMB:      roundTo2(usedMB),
+			RemainingMB: roundTo2(max(float64(l.LimitBytes)/1024/1024-usedMB, 0)),
+			Action:      string(l.Action),
+			SwitchTo:    l.SwitchTo.String(),
+			Throttle:    l.Throttle,
+			Exhausted:   l.Exhausted,
+			Throttled:   l.Throttled,
+			Budget:      l.Budget,
+			Warnings:    l.Warnings,
+			OvershootMB: int(l.Overshoot / 1024 / 1024),
+			Cost:        roundTo2(l.Cost),
+			Period:      string(l.Period),
+		}
+		if !l.ExhaustedAt.IsZero() {
+			limit.ExhaustedAt = l.ExhaustedAt.Format(time.RFC3339)
+		}
+		if l.Period != "" {
+			limit.PeriodStart = l.PeriodStart.Format(time.RFC3339)
+			limit.PeriodEnd = l.PeriodEnd.Format(time.RFC3339)
+		}
+		resp.Limits = append(resp.Limits, limit)
+	}
+
+	for mode, n := range s.router.ConnectionsByMode() {
+		if resp.ModeConns == nil {
+			resp.ModeConns = make(map[string]int)
+		}
+		resp.ModeConns[mode.String()] = n
+	}
+
+	for _, g := range s.router.ClientGroups() {
+		allowed := make([]string, 0, len(g.AllowedModes))
+		for _, m := range g.AllowedModes {
+			allowed = append(allowed, m.String())
+		}
+		resp.Clients = append(resp.Clients, ClientGroupStats{
+			Name:         g.Name,
+			CIDR:         g.Networks,
+			Mode:         g.EffectiveMode.String(),
+			DefaultMode:  g.Mode.String(),
+			AllowedModes: allowed,
+		})
+	}
+
+	for _, p := range s.router.Pools() {
+		pool := PoolStats{Name: p.Name.String(), Strategy: string(p.Strategy)}
+		for _, m := range p.Members {
+			pool.Members = append(pool.Members, PoolMemberStats{
+				Mode:        m.Mode.String(),
+				Weight:      m.Weight,
+				Healthy:     m.Healthy,
+				CooldownSec: int(m.CooldownFor.Round(time.Second).Seconds()),
+				Connections: m.ActiveConns,
+				MB:          roundTo2(float64(m.Bytes) / 1024 / 1024),
+				Failures:    m.Failures,
+				LastError:   m.LastError,
+			})
+		}
+		resp.Pools = append(resp.Pools, pool)
+	}
+
+	for _, rs := range s.router.Races() {
+		race := RaceStats{Name: rs.Name.String(), Races: rs.Races}
+		for _, m := range rs.Members {
+			var rate float64
+			if rs.Races > 0 {
+				rate = roundTo2(float64(m.Wins) / float64(rs.Races))
+			}
+			race.Members = append(race.Members, RaceMemberStats{
+				Mode:     m.Mode.String(),
+				Wins:     m.Wins,
+				WinRate:  rate,
+				Failures: m.Failures,
+			})
+		}
+		resp.Races = append(resp.Races, race)
+	}
+
+	for _, sw := range s.router.NextScheduled() {
+		resp.Schedule = append(resp.Schedule, ScheduleStats{
+			Mode: sw.Mode.String(),
+			At:   sw.At.Format(time.RFC3339),
+			Cron: sw.Cron,
+		})
+	}
+
+	for _, h := range s.router.HealthStatus() {
+		resp.Health = append(resp.Health, ModeHealthStats{
+			Mode:                 h.Mode.String(),
+			Healthy:              h.Healthy,
+			ConsecutiveFailures:  h.ConsecutiveFailures,
+			ConsecutiveSuccesses: h.ConsecutiveSuccesses,
+			LastError:            h.LastError,
+			LastCheck:            h.LastCheck.UTC().Format(time.RFC3339),
+		})
+	}
 
 	// Health check only if requested via ?check=true
 	if r.URL.Query().Get("check") == "true" {
-		healthy, err := s.router.TestCurrentMode()
+		healthy, err := s.router.TestCurrentMode(r.Context())
 		resp.ModeHealthy = &healthy
 		if err != nil {
-			errCode := classifyModeError(err, s.router.GetMode().String())
+			errCode := classifyModeError(err, s.router.ModeType(s.router.GetMode()))
 			resp.ModeError = &errCode
+			if hop := router.FailedHop(err); hop != nil {
+				resp.FailedHop = &FailedHopStats{Hop: hop.Hop, Mode: hop.Mode.String(), Error: hop.Err.Error()}
+			}
 			log.Printf("API: Mode health check failed: %s", err.Error())
 		}
 	}
@@ -116,10 +456,27 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleSetMode(w http.ResponseWriter, r *http.Request) {
 	requested := r.PathValue("mode")
 
-	if err := s.router.SetMode(router.Mode(requested)); err != nil {
+	// Optional ?policy=keep|kill|drain&grace=30s overrides the configured switch policy
+	policy := s.router.SwitchPolicyFor(router.TriggerManual)
+	if p := r.URL.Query().Get("policy"); p != "" {
+		var err error
+		var grace time.Duration
+		if g := r.URL.Query().Get("grace"); g != "" {
+			if grace, err = time.ParseDuration(g); err != nil {
+				s.jsonError(w, http.StatusBadRequest, "invalid grace: "+g)
+				return
+			}
+		}
+		if policy, err = router.ParseSwitchPolicy(p, grace); err != nil {
+			s.jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if err := s.router.SetModeWithPolicy(router.Mode(requested), policy); err != nil {
 		// Mode switch failed — return current mode and error
 		currentMode := s.router.GetMode().String()
-		errorCode := classifySetModeError(err)
+		errorCode := classifySetModeError(err, requested)
 
 		log.Printf("API: Mode switch to %s failed: %s", requested, err.Error())
 
@@ -139,6 +496,7 @@ func (s *Server) handleSetMode(w http.ResponseWriter, r *http.Request) {
 		Success:   true,
 		Requested: requested,
 		Mode:      currentMode,
+		Policy:    string(policy.Action),
 		Status:    "ok", // backward compatibility
 	})
 }
@@ -150,26 +508,212 @@ func (s *Server) handleMetrics(w http.ResponseWriter, _ *http.Request) {
 
 	_, _ = fmt.Fprintf(w, "# HELP switch_gate_bytes_total Total bytes transferred\n")
 	_, _ = fmt.Fprintf(w, "# TYPE switch_gate_bytes_total counter\n")
-	for mode, bytes := range stats.Bytes {
-		_, _ = fmt.Fprintf(w, "switch_gate_bytes_total{mode=\"%s\"} %d\n", mode, bytes)
+	for _, mode := range stats.Modes {
+		_, _ = fmt.Fprintf(w, "switch_gate_bytes_total{mode=\"%s\"} %d\n", mode, stats.Bytes[mode])
+	}
+
+	period := s.router.TrafficPeriod()
+	_, _ = fmt.Fprintf(w, "# HELP switch_gate_period_bytes Bytes transferred in the current accounting period\n")
+	_, _ = fmt.Fprintf(w, "# TYPE switch_gate_period_bytes gauge\n")
+	for _, mode := range stats.Modes {
+		_, _ = fmt.Fprintf(w, "switch_gate_period_bytes{mode=\"%s\"} %d\n", mode, period.Bytes[router.Mode(mode)])
+	}
+
+	if limits := s.router.Limits(); len(limits) > 0 {
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_limit_bytes Traffic limit per mode\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_limit_bytes gauge\n")
+		for _, l := range limits {
+			_, _ = fmt.Fprintf(w, "switch_gate_limit_bytes{mode=\"%s\"} %d\n", l.Mode, l.LimitBytes)
+		}
+
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_limit_used_bytes Bytes counted against the traffic limit per mode\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_limit_used_bytes gauge\n")
+		for _, l := range limits {
+			_, _ = fmt.Fprintf(w, "switch_gate_limit_used_bytes{mode=\"%s\"} %d\n", l.Mode, l.UsedBytes)
+		}
+
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_limit_exhausted Whether the traffic limit of a mode is exhausted\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_limit_exhausted gauge\n")
+		for _, l := range limits {
+			exhausted := 0
+			if l.Exhausted {
+				exhausted = 1
+			}
+			_, _ = fmt.Fprintf(w, "switch_gate_limit_exhausted{mode=\"%s\"} %d\n", l.Mode, exhausted)
+		}
+
+		var budgets []router.LimitStatus
+		for _, l := range limits {
+			if l.Budget > 0 {
+				budgets = append(budgets, l)
+			}
+		}
+		if len(budgets) > 0 {
+			_, _ = fmt.Fprintf(w, "# HELP switch_gate_limit_budget Budget per mode and billing period\n")
+			_, _ = fmt.Fprintf(w, "# TYPE switch_gate_limit_budget gauge\n")
+			for _, l := range budgets {
+				_, _ = fmt.Fprintf(w, "switch_gate_limit_budget{mode=\"%s\"} %.2f\n", l.Mode, l.Budget)
+			}
+
+			_, _ = fmt.Fprintf(w, "# HELP switch_gate_limit_cost Spend counted against the budget per mode\n")
+			_, _ = fmt.Fprintf(w, "# TYPE switch_gate_limit_cost gauge\n")
+			for _, l := range budgets {
+				_, _ = fmt.Fprintf(w, "switch_gate_limit_cost{mode=\"%s\"} %.4f\n", l.Mode, l.Cost)
+			}
+		}
+	}
+
+	if bandwidth := s.bandwidthStats(); len(bandwidth) > 0 {
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_bandwidth_rate_bytes Configured rate limit in bytes per second (0 = unlimited)\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_bandwidth_rate_bytes gauge\n")
+		for _, b := range bandwidth {
+			labels := bandwidthLabels(b)
+			_, _ = fmt.Fprintf(w, "switch_gate_bandwidth_rate_bytes{%s,direction=\"upload\"} %.0f\n", labels, b.UploadRate)
+			_, _ = fmt.Fprintf(w, "switch_gate_bandwidth_rate_bytes{%s,direction=\"download\"} %.0f\n", labels, b.DownloadRate)
+		}
+
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_bandwidth_throughput_bytes Throughput of rate limited traffic in bytes per second\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_bandwidth_throughput_bytes gauge\n")
+		for _, b := range bandwidth {
+			labels := bandwidthLabels(b)
+			_, _ = fmt.Fprintf(w, "switch_gate_bandwidth_throughput_bytes{%s,direction=\"upload\"} %.0f\n", labels, b.UploadThroughput)
+			_, _ = fmt.Fprintf(w, "switch_gate_bandwidth_throughput_bytes{%s,direction=\"download\"} %.0f\n", labels, b.DownloadThroughput)
+		}
+	}
+
+	if spend := s.router.Spend(); len(spend.Modes) > 0 {
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_spend_total Accumulated spend per mode\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_spend_total counter\n")
+		for _, m := range spend.Modes {
+			_, _ = fmt.Fprintf(w, "switch_gate_spend_total{mode=\"%s\",currency=\"%s\"} %.4f\n", m.Mode, spend.Currency, m.Total)
+		}
+
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_period_spend Spend per mode in the current accounting period\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_period_spend gauge\n")
+		for _, m := range spend.Modes {
+			_, _ = fmt.Fprintf(w, "switch_gate_period_spend{mode=\"%s\",currency=\"%s\"} %.4f\n", m.Mode, spend.Currency, m.Period)
+		}
+	}
+
+	if clients := s.router.ClientBytes(); len(clients) > 0 {
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_client_bytes_total Total bytes transferred per client and mode\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_client_bytes_total counter\n")
+		for _, c := range clients {
+			_, _ = fmt.Fprintf(w, "switch_gate_client_bytes_total{client=\"%s\",mode=\"%s\"} %d\n", labelValue(c.Client), c.Mode, c.Bytes)
+		}
 	}
 
 	_, _ = fmt.Fprintf(w, "# HELP switch_gate_connections_active Active connections\n")
 	_, _ = fmt.Fprintf(w, "# TYPE switch_gate_connections_active gauge\n")
 	_, _ = fmt.Fprintf(w, "switch_gate_connections_active %d\n", s.proxy.ActiveConnections())
 
+	modeConns := s.router.ConnectionsByMode()
+	_, _ = fmt.Fprintf(w, "# HELP switch_gate_mode_connections_active Open upstream connections per mode\n")
+	_, _ = fmt.Fprintf(w, "# TYPE switch_gate_mode_connections_active gauge\n")
+	for _, mode := range stats.Modes {
+		_, _ = fmt.Fprintf(w, "switch_gate_mode_connections_active{mode=\"%s\"} %d\n", mode, modeConns[router.Mode(mode)])
+	}
+
 	_, _ = fmt.Fprintf(w, "# HELP switch_gate_connections_total Total connections\n")
 	_, _ = fmt.Fprintf(w, "# TYPE switch_gate_connections_total counter\n")
 	_, _ = fmt.Fprintf(w, "switch_gate_connections_total %d\n", stats.TotalConns)
 
+	_, _ = fmt.Fprintf(w, "# HELP switch_gate_fallbacks_total Dials that fell back to another mode\n")
+	_, _ = fmt.Fprintf(w, "# TYPE switch_gate_fallbacks_total counter\n")
+	for _, f := range stats.Fallbacks {
+		_, _ = fmt.Fprintf(w, "switch_gate_fallbacks_total{from=\"%s\",to=\"%s\",reason=\"%s\"} %d\n", f.From, f.To, f.Reason, f.Count)
+	}
+
+	if len(stats.Sniffed) > 0 {
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_sniffed_connections_total Connections to IP targets sniffed for a domain\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_sniffed_connections_total counter\n")
+		for _, p := range []string{proxy.SniffTLS, proxy.SniffHTTP, proxy.SniffNone} {
+			_, _ = fmt.Fprintf(w, "switch_gate_sniffed_connections_total{protocol=\"%s\"} %d\n", p, stats.Sniffed[p])
+		}
+	}
+
+	if races := s.router.Races(); len(races) > 0 {
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_races_total Connections dialed through a race mode\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_races_total counter\n")
+		for _, rs := range races {
+			_, _ = fmt.Fprintf(w, "switch_gate_races_total{race=\"%s\"} %d\n", rs.Name, rs.Races)
+		}
+
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_race_wins_total Races won per member mode\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_race_wins_total counter\n")
+		for _, rs := range races {
+			for _, m := range rs.Members {
+				_, _ = fmt.Fprintf(w, "switch_gate_race_wins_total{race=\"%s\",mode=\"%s\"} %d\n", rs.Name, m.Mode, m.Wins)
+			}
+		}
+	}
+
+	if health := s.router.HealthStatus(); len(health) > 0 {
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_mode_healthy Whether the health monitor considers a mode healthy\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_mode_healthy gauge\n")
+		for _, h := range health {
+			healthy := 0
+			if h.Healthy {
+				healthy = 1
+			}
+			_, _ = fmt.Fprintf(w, "switch_gate_mode_healthy{mode=\"%s\"} %d\n", h.Mode, healthy)
+		}
+	}
+
+	if pools := s.router.Pools(); len(pools) > 0 {
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_pool_member_up Whether a pool member is in rotation\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_pool_member_up gauge\n")
+		for _, p := range pools {
+			for _, m := range p.Members {
+				up := 0
+				if m.Healthy {
+					up = 1
+				}
+				_, _ = fmt.Fprintf(w, "switch_gate_pool_member_up{pool=\"%s\",member=\"%s\"} %d\n", p.Name, m.Mode, up)
+			}
+		}
+
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_pool_member_bytes_total Bytes transferred per pool member\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_pool_member_bytes_total counter\n")
+		for _, p := range pools {
+			for _, m := range p.Members {
+				_, _ = fmt.Fprintf(w, "switch_gate_pool_member_bytes_total{pool=\"%s\",member=\"%s\"} %d\n", p.Name, m.Mode, m.Bytes)
+			}
+		}
+
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_pool_member_connections_active Active connections per pool member\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_pool_member_connections_active gauge\n")
+		for _, p := range pools {
+			for _, m := range p.Members {
+				_, _ = fmt.Fprintf(w, "switch_gate_pool_member_connections_active{pool=\"%s\",member=\"%s\"} %d\n", p.Name, m.Mode, m.ActiveConns)
+			}
+		}
+
+		_, _ = fmt.Fprintf(w, "# HELP switch_gate_pool_member_failures_total Dial failures per pool member\n")
+		_, _ = fmt.Fprintf(w, "# TYPE switch_gate_pool_member_failures_total counter\n")
+		for _, p := range pools {
+			for _, m := range p.Members {
+				_, _ = fmt.Fprintf(w, "switch_gate_pool_member_failures_total{pool=\"%s\",member=\"%s\"} %d\n", p.Name, m.Mode, m.Failures)
+			}
+		}
+	}
+
 	_, _ = fmt.Fprintf(w, "# HELP switch_gate_uptime_seconds Uptime in seconds\n")
 	_, _ = fmt.Fprintf(w, "# TYPE switch_gate_uptime_seconds gauge\n")
 	_, _ = fmt.Fprintf(w, "switch_gate_uptime_seconds %.0f\n", stats.Uptime.Seconds())
 }
 
 func (s *Server) handleSetLimit(w http.ResponseWriter, r *http.Request) {
+	mode := router.Mode(r.PathValue("mode"))
+
 	var req struct {
-		LimitMB int `json:"limit_mb"`
+		LimitMB      *int     `json:"limit_mb"`       // Optional: 0 = unlimited
+		Budget       *float64 `json:"budget"`         // Optional: spend per period, 0 = none
+		Warnings     []int    `json:"warnings"`       // Optional: thresholds in percent
+		OvershootMB  *int     `json:"overshoot_mb"`   // Optional: traffic past the limit before flows are cut
+		Action       string   `json:"action"`         // Optional: switch, block, throttle
+		AutoSwitchTo string   `json:"auto_switch_to"` // Optional: switch target
+		Throttle     string   `json:"throttle"`       // Optional: throttle rate
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -177,16 +721,115 @@ func (s *Server) handleSetLimit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.router.SetHomeLimit(req.LimitMB)
+	err := s.router.SetLimit(mode, router.LimitUpdate{
+		MaxMB:       req.LimitMB,
+		Budget:      req.Budget,
+		Warnings:    req.Warnings,
+		OvershootMB: req.OvershootMB,
+		Action:      router.LimitAction(req.Action),
+		SwitchTo:    router.Mode(req.AutoSwitchTo),
+		Throttle:    req.Throttle,
+	})
+	if err != nil {
+		s.jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	log.Printf("API: Home proxy limit set to %d MB", req.LimitMB)
+	limit, _ := s.router.Limit(mode)
+	limitMB := limit.LimitBytes / 1024 / 1024
+	log.Printf("API: %s traffic limit set to %d MB (%s)", mode, limitMB, limit.Action)
 
 	s.jsonResponse(w, http.StatusOK, map[string]interface{}{
 		"status":   "ok",
-		"limit_mb": req.LimitMB,
+		"mode":     mode.String(),
+		"limit_mb": limitMB,
+		"action":   string(limit.Action),
+	})
+}
+
+func (s *Server) handleSetBandwidth(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Scope    string  `json:"scope"`    // global, client, mode
+		Mode     string  `json:"mode"`     // scope mode
+		Upload   *string `json:"upload"`   // Optional: rate, "0" = unlimited
+		Download *string `json:"download"` // Optional: rate, "0" = unlimited
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.jsonError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	if err := s.router.SetBandwidth(req.Scope, router.Mode(req.Mode), req.Upload, req.Download); err != nil {
+		s.jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	scope := req.Scope
+	if req.Scope == router.ScopeMode {
+		scope += " " + req.Mode
+	}
+	log.Printf("API: Bandwidth of %s changed", scope)
+
+	s.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"status":    "ok",
+		"bandwidth": s.bandwidthStats(),
 	})
 }
 
+// bandwidthStats returns the bandwidth scopes that are limited
+func (s *Server) bandwidthStats() []BandwidthStats {
+	var stats []BandwidthStats
+	for _, b := range s.router.Bandwidth() {
+		if b.Upload == 0 && b.Download == 0 {
+			continue
+		}
+		stats = append(stats, BandwidthStats{
+			Scope:              b.Scope,
+			Mode:               b.Mode.String(),
+			Clients:            b.Clients,
+			UploadRate:         b.Upload,
+			DownloadRate:       b.Download,
+			UploadThroughput:   roundTo2(b.UploadBytes),
+			DownloadThroughput: roundTo2(b.DownloadBytes),
+		})
+	}
+	return stats
+}
+
+func (s *Server) handleClients(w http.ResponseWriter, _ *http.Request) {
+	period := s.router.TrafficPeriod()
+	resp := ClientsResponse{
+		Key:         s.router.ClientKey(),
+		Period:      string(period.Period),
+		PeriodStart: period.Start.Format(time.RFC3339),
+		PeriodEnd:   period.End.Format(time.RFC3339),
+		Clients:     []ClientStats{},
+	}
+
+	for _, c := range s.router.Clients() {
+		client := ClientStats{
+			Client:      c.Name,
+			Connections: c.Connections,
+			LastSeen:    c.LastSeen.Format(time.RFC3339),
+			TotalMB:     roundTo2(float64(c.TotalBytes) / 1024 / 1024),
+			PeriodMB:    roundTo2(float64(c.PeriodBytes) / 1024 / 1024),
+		}
+		for _, m := range c.Modes {
+			client.Modes = append(client.Modes, ClientModeStats{
+				Mode:      m.Mode.String(),
+				TotalMB:   roundTo2(float64(m.TotalBytes) / 1024 / 1024),
+				PeriodMB:  roundTo2(float64(m.PeriodBytes) / 1024 / 1024),
+				QuotaMB:   int(m.QuotaBytes / 1024 / 1024),
+				Exhausted: m.Exhausted,
+			})
+		}
+		resp.Clients = append(resp.Clients, client)
+	}
+
+	s.jsonResponse(w, http.StatusOK, resp)
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, _ *http.Request) {
 	s.jsonResponse(w, http.StatusOK, map[string]string{"status": "healthy"})
 }
@@ -202,7 +845,7 @@ func (s *Server) jsonError(w http.ResponseWriter, status int, message string) {
 }
 
 // classifySetModeError converts an error to an error code
-func classifySetModeError(err error) string {
+func classifySetModeError(err error, requested string) string {
 	if err == nil {
 		return ""
 	}
@@ -215,14 +858,18 @@ func classifySetModeError(err error) string {
 	case strings.Contains(msg, "not available"):
 		return ErrModeNotConfigured
 	case strings.Contains(msg, "limit exhausted"):
-		return ErrHomeLimitReached
+		if requested == router.ModeHome.String() {
+			return ErrHomeLimitReached
+		}
+		return ErrLimitReached
 	default:
 		return ErrInternal
 	}
 }
 
-// classifyModeError converts a mode health check error to an error code
-func classifyModeError(err error, mode string) string {
+// classifyModeError converts a mode health check error to an error code.
+// Codes are named after the default modes of each type (warp, home).
+func classifyModeError(err error, modeType router.ModeType) string {
 	if err == nil {
 		return ""
 	}
@@ -231,8 +878,8 @@ func classifyModeError(err error, mode string) string {
 	isTimeout := strings.Contains(msg, "timeout")
 	isInterfaceError := strings.Contains(msg, "interface")
 
-	switch mode {
-	case "warp":
+	switch modeType {
+	case router.TypeTunnel:
 		if isInterfaceError {
 			return ErrWarpInterfaceDown
 		}
@@ -240,16 +887,32 @@ func classifyModeError(err error, mode string) string {
 			return ErrWarpTimeout
 		}
 		return ErrWarpUnreachable
-	case "home":
+	case router.TypeDirect:
+		return ErrCheckFailed
+	default:
+		// Upstream proxies
 		if isTimeout {
 			return ErrHomeTimeout
 		}
 		return ErrHomeUnreachable
-	default:
-		return ErrCheckFailed
 	}
 }
 
+// bandwidthLabels returns the metric labels of a bandwidth scope
+func bandwidthLabels(b BandwidthStats) string {
+	if b.Mode != "" {
+		return fmt.Sprintf("scope=\"%s\",mode=\"%s\"", b.Scope, b.Mode)
+	}
+	return fmt.Sprintf("scope=\"%s\"", b.Scope)
+}
+
+// labelValue escapes a metric label value
+func labelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
 func roundTo2(f float64) float64 {
 	return float64(int(f*100)) / 100
 }
@@ -31,7 +31,9 @@ func New(r *router.Router, m *metrics.Metrics, p *proxy.Server) *Server {
 	s.mux.HandleFunc("GET /status", s.handleStatus)
 	s.mux.HandleFunc("POST /mode/{mode}", s.handleSetMode)
 	s.mux.HandleFunc("GET /metrics", s.handleMetrics)
-	s.mux.HandleFunc("POST /limit/home", s.handleSetLimit)
+	s.mux.HandleFunc("POST /limit/{mode}", s.handleSetLimit)
+	s.mux.HandleFunc("POST /bandwidth", s.handleSetBandwidth)
+	s.mux.HandleFunc("GET /clients", s.handleClients)
 	s.mux.HandleFunc("GET /health", s.handleHealth)
 
 	return s
@@ -1,18 +1,32 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the application configuration
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Modes    ModesConfig    `yaml:"modes"`
-	Limits   LimitsConfig   `yaml:"limits"`
-	Webhooks WebhooksConfig `yaml:"webhooks"`
-	Logging  LoggingConfig  `yaml:"logging"`
+	Server     ServerConfig     `yaml:"server"`
+	Modes      ModesConfig      `yaml:"modes"`
+	Rules      []RuleConfig     `yaml:"rules"`
+	GeoIP      GeoIPConfig      `yaml:"geoip"`
+	Clients    []ClientConfig   `yaml:"clients"`
+	Health     HealthConfig     `yaml:"health"`
+	DNS        DNSConfig        `yaml:"dns"`
+	Sniff      SniffConfig      `yaml:"sniff"`
+	Switch     SwitchConfig     `yaml:"mode_switch"`
+	Schedule   ScheduleConfig   `yaml:"schedule"`
+	Limits     LimitsConfig     `yaml:"limits"`
+	Bandwidth  BandwidthConfig  `yaml:"bandwidth"`
+	Pricing    PricingConfig    `yaml:"pricing"`
+	Accounting AccountingConfig `yaml:"accounting"`
+	State      StateConfig      `yaml:"state"`
+	Webhooks   WebhooksConfig   `yaml:"webhooks"`
+	Logging    LoggingConfig    `yaml:"logging"`
 }
 
 // WebhooksConfig defines webhook settings
@@ -28,51 +42,369 @@ type WebhooksConfig struct {
 type EventsConfig struct {
 	ModeChanged  bool `yaml:"mode_changed"`
 	LimitReached bool `yaml:"limit_reached"`
+	LimitReset   bool `yaml:"limit_reset"`
+	LimitWarning bool `yaml:"limit_warning"`
+	ModeFallback bool `yaml:"mode_fallback"`
 }
 
 // ServerConfig defines server endpoints
 type ServerConfig struct {
-	Listen      string `yaml:"listen"`
-	Transparent string `yaml:"transparent"` // Transparent proxy for iptables REDIRECT
-	API         string `yaml:"api"`
+	Listen      string     `yaml:"listen"`
+	Transparent string     `yaml:"transparent"` // Transparent proxy for iptables REDIRECT
+	API         string     `yaml:"api"`
+	Auth        AuthConfig `yaml:"auth"` // SOCKS5 authentication (default: none)
 }
 
-// ModesConfig defines routing modes
-type ModesConfig struct {
-	Direct DirectConfig `yaml:"direct"`
-	Warp   WarpConfig   `yaml:"warp"`
-	Home   HomeConfig   `yaml:"home"`
+// AuthConfig defines SOCKS5 username/password authentication (RFC 1929)
+type AuthConfig struct {
+	Users map[string]string `yaml:"users"` // Username to password (empty = no authentication)
 }
 
-// DirectConfig for direct mode
-type DirectConfig struct {
+// ModesConfig defines the named routing modes in configuration order
+type ModesConfig []ModeConfig
+
+// ModeConfig defines a single named routing mode
+type ModeConfig struct {
+	Name string `yaml:"-"`
+	Type string `yaml:"type"` // direct, tunnel, socks5, http, https, shadowsocks, chain, pool, race
+
+	// direct / tunnel
 	Interface string `yaml:"interface"`
-	LocalIP   string `yaml:"local_ip"`
+	LocalIP   string `yaml:"local_ip"` // direct: source IP; proxies: source IP for the proxy connection
+
+	// Upstream proxies
+	Host     string    `yaml:"host"`
+	Port     int       `yaml:"port"`
+	Username string    `yaml:"username"`
+	Password string    `yaml:"password"`
+	TLS      TLSConfig `yaml:"tls"`    // http/https: TLS to the proxy itself
+	Method   string    `yaml:"method"` // shadowsocks: cipher, e.g. aes-256-gcm
+	Via      string    `yaml:"via"`    // Proxies: reach the proxy through this mode
+
+	// chain: modes traversed in order, e.g. [warp, home]
+	Hops []string `yaml:"hops"`
+
+	// Fallback: modes tried in order when a dial through this mode fails.
+	// Unset: tunnels fall back to direct, other modes have no fallback.
+	Fallback    FallbackList  `yaml:"fallback"`
+	FallbackOn  []string      `yaml:"fallback_on"`  // Error classes: timeout, refused, auth (default: any error)
+	DialTimeout time.Duration `yaml:"dial_timeout"` // Timeout of a dial through this mode (default: none)
+
+	// pool: modes to balance connections across; race: modes dialed in parallel
+	Members  []PoolMemberConfig `yaml:"members"`
+	Strategy string             `yaml:"strategy"` // pool: round_robin (default), least_conn, random, hash
+	Cooldown time.Duration      `yaml:"cooldown"` // pool: time a failed member is out of rotation (default: 30s)
+	Stagger  time.Duration      `yaml:"stagger"`  // race: delay before the next member starts (default: 250ms)
+
+	// Resolver for domain targets. Default: system for direct and tunnel,
+	// remote for proxies and chains, none for pool and race (members resolve).
+	Resolver ResolverConfig `yaml:"resolver"`
 }
 
-// WarpConfig for tunnel mode
-type WarpConfig struct {
-	Interface string `yaml:"interface"`
+// ResolverConfig defines how a mode resolves domain targets.
+// A plain string is accepted as the type.
+type ResolverConfig struct {
+	Type       string        `yaml:"type"`        // system, udp, tcp, dot, doh, remote
+	Server     string        `yaml:"server"`      // udp/tcp/dot: host:port; doh: https:// URL
+	ServerName string        `yaml:"server_name"` // dot/doh: TLS server name (default: server host)
+	Timeout    time.Duration `yaml:"timeout"`     // Per lookup (default: 5s)
+}
+
+// UnmarshalYAML accepts either a resolver type or a mapping
+func (r *ResolverConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		r.Type = node.Value
+		return nil
+	}
+
+	type plain ResolverConfig
+	return node.Decode((*plain)(r))
+}
+
+// PoolMemberConfig defines a member of a pool mode.
+// A plain string is accepted as a member with weight 1.
+type PoolMemberConfig struct {
+	Mode   string `yaml:"mode"`
+	Weight int    `yaml:"weight"` // random and hash strategies (default: 1)
+}
+
+// UnmarshalYAML accepts either a mode name or a {mode, weight} mapping
+func (p *PoolMemberConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		p.Mode = node.Value
+		return nil
+	}
+
+	type plain PoolMemberConfig
+	return node.Decode((*plain)(p))
+}
+
+// TLSConfig defines TLS settings for connecting to an upstream proxy
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`              // Implied by type https
+	ServerName         string `yaml:"server_name"`          // SNI (default: host)
+	CAFile             string `yaml:"ca_file"`              // Trust only this CA bundle
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Testing only
+}
+
+// UnmarshalYAML decodes the modes mapping, keeping the configuration order
+func (m *ModesConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: modes must be a mapping of name to mode", node.Line)
+	}
+
+	modes := make(ModesConfig, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		var mc ModeConfig
+		if err := node.Content[i+1].Decode(&mc); err != nil {
+			return err
+		}
+		mc.Name = node.Content[i].Value
+		modes = append(modes, mc)
+	}
+
+	*m = modes
+	return nil
+}
+
+// Get returns the mode with the given name
+func (m ModesConfig) Get(name string) (ModeConfig, bool) {
+	for _, mc := range m {
+		if mc.Name == name {
+			return mc, true
+		}
+	}
+	return ModeConfig{}, false
+}
+
+// FallbackStep is a mode in a fallback list
+type FallbackStep struct {
+	Mode    string        `yaml:"mode"`
+	Timeout time.Duration `yaml:"timeout"` // Default: dial_timeout of the step's mode
+}
+
+// UnmarshalYAML accepts either a mode name or a {mode, timeout} mapping
+func (f *FallbackStep) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		f.Mode = node.Value
+		return nil
+	}
+
+	type plain FallbackStep
+	return node.Decode((*plain)(f))
+}
+
+// FallbackList is an ordered list of fallback modes.
+// nil means not configured; "none" or [] disables fallback.
+type FallbackList []FallbackStep
+
+// UnmarshalYAML accepts a list of steps, a single mode name or "none"
+func (l *FallbackList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		if node.Value == "none" || node.Value == "" {
+			*l = FallbackList{}
+			return nil
+		}
+		*l = FallbackList{{Mode: node.Value}}
+		return nil
+	}
+
+	steps := []FallbackStep{}
+	if err := node.Decode(&steps); err != nil {
+		return err
+	}
+	*l = steps
+	return nil
+}
+
+// SwitchConfig defines what happens to open connections of the previous
+// mode when the current mode changes
+type SwitchConfig struct {
+	Policy   string                        `yaml:"policy"`   // keep (default), kill, drain
+	Grace    time.Duration                 `yaml:"grace"`    // drain: time before remaining connections are closed (default: 30s)
+	Triggers map[string]SwitchPolicyConfig `yaml:"triggers"` // Per trigger, e.g. limit_reached: kill
 }
 
-// HomeConfig for upstream proxy mode
-type HomeConfig struct {
-	Type     string `yaml:"type"`
-	Host     string `yaml:"host"`
-	Port     int    `yaml:"port"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+// SwitchPolicyConfig overrides the switch policy for a trigger.
+// A plain string is accepted as the policy.
+type SwitchPolicyConfig struct {
+	Policy string        `yaml:"policy"`
+	Grace  time.Duration `yaml:"grace"` // Default: mode_switch.grace
 }
 
-// LimitsConfig defines traffic limits
-type LimitsConfig struct {
-	Home HomeLimitConfig `yaml:"home"`
+// UnmarshalYAML accepts either a policy name or a {policy, grace} mapping
+func (p *SwitchPolicyConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		p.Policy = node.Value
+		return nil
+	}
+
+	type plain SwitchPolicyConfig
+	return node.Decode((*plain)(p))
+}
+
+// ScheduleConfig defines time-based mode switches
+type ScheduleConfig struct {
+	Timezone string                `yaml:"timezone"` // IANA name, e.g. Europe/Berlin (default: local time)
+	Entries  []ScheduleEntryConfig `yaml:"entries"`
+}
+
+// ScheduleEntryConfig switches to a mode whenever its cron expression fires
+type ScheduleEntryConfig struct {
+	Cron     string `yaml:"cron"` // Standard 5-field expression or @daily, @hourly, ...
+	Mode     string `yaml:"mode"`
+	Timezone string `yaml:"timezone"` // Default: schedule timezone
+}
+
+// DNSConfig defines the embedded DNS server
+type DNSConfig struct {
+	Enabled   bool           `yaml:"enabled"`
+	Listen    string         `yaml:"listen"`     // UDP and TCP address, e.g. 127.0.0.1:5353
+	Upstream  ResolverConfig `yaml:"upstream"`   // udp (default), tcp, dot or doh server
+	CacheSize int            `yaml:"cache_size"` // Cached answers (default: 4096)
+	FakeIP    FakeIPConfig   `yaml:"fake_ip"`
+}
+
+// FakeIPConfig defines the fake-IP mode of the DNS server
+type FakeIPConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Range   string        `yaml:"range"`   // IPv4 pool (default: 198.18.0.0/15)
+	TTL     time.Duration `yaml:"ttl"`     // TTL of fake answers (default: 1s)
+	Exclude []string      `yaml:"exclude"` // Domain suffixes answered with real addresses
+}
+
+// SniffConfig defines domain sniffing on connections to IP targets
+type SniffConfig struct {
+	Enabled             bool          `yaml:"enabled"`
+	Timeout             time.Duration `yaml:"timeout"`              // Wait for the first client bytes (default: 300ms)
+	OverrideDestination bool          `yaml:"override_destination"` // Dial the sniffed domain instead of the IP
+}
+
+// RuleConfig defines a destination-based routing rule.
+// Domain and CIDR conditions are OR-ed, ports (if set) must match as well.
+type RuleConfig struct {
+	Domain        []string `yaml:"domain"`         // Exact domain match
+	DomainSuffix  []string `yaml:"domain_suffix"`  // Domain and its subdomains
+	DomainKeyword []string `yaml:"domain_keyword"` // Substring of the domain
+	CIDR          []string `yaml:"cidr"`           // IP destinations
+	GeoIP         []string `yaml:"geoip"`          // ISO country codes (needs geoip.country_db)
+	ASN           []uint   `yaml:"asn"`            // Autonomous system numbers (needs geoip.asn_db)
+	NoResolve     bool     `yaml:"no_resolve"`     // Don't resolve domain targets for geoip/asn
+	Port          []string `yaml:"port"`           // "443" or "8000-9000"
+	Mode          string   `yaml:"mode"`           // Mode to route matching traffic through
+}
+
+// GeoIPConfig defines local MaxMind databases for geoip/asn rules
+type GeoIPConfig struct {
+	CountryDB      string        `yaml:"country_db"`      // e.g. GeoLite2-Country.mmdb
+	ASNDB          string        `yaml:"asn_db"`          // e.g. GeoLite2-ASN.mmdb
+	ReloadInterval time.Duration `yaml:"reload_interval"` // How often to check files for changes
+}
+
+// ClientConfig maps client source networks to a default mode
+type ClientConfig struct {
+	Name         string   `yaml:"name"`
+	CIDR         []string `yaml:"cidr"`          // Client source networks
+	Mode         string   `yaml:"mode"`          // Default mode (empty = current mode)
+	AllowedModes []string `yaml:"allowed_modes"` // Modes the group may use (empty = all)
+}
+
+// HealthConfig defines the background health monitor
+type HealthConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	Interval         time.Duration `yaml:"interval"`          // Probe interval (default: 30s)
+	Timeout          time.Duration `yaml:"timeout"`           // Per-endpoint dial timeout (default: 5s)
+	Endpoints        []string      `yaml:"endpoints"`         // host:port probed through each mode
+	FailureThreshold int           `yaml:"failure_threshold"` // Consecutive failures before failover (default: 3)
+	SuccessThreshold int           `yaml:"success_threshold"` // Consecutive successes before restore (default: 3)
+	Preferred        string        `yaml:"preferred"`         // Mode to restore (default: last manually selected mode)
+}
+
+// LimitsConfig defines traffic limits per mode name
+type LimitsConfig map[string]LimitConfig
+
+// LimitConfig defines the traffic limit of a mode and what happens when
+// it is reached
+type LimitConfig struct {
+	MaxMB        int          `yaml:"max_mb"`         // 0 = unlimited
+	Action       string       `yaml:"action"`         // switch (default), block, throttle
+	AutoSwitchTo string       `yaml:"auto_switch_to"` // switch: mode to switch to (default: direct)
+	Throttle     string       `yaml:"throttle"`       // throttle: rate, e.g. 1mbit or 256KB
+	Budget       float64      `yaml:"budget"`         // Spend per period in pricing.currency (0 = no budget)
+	Warnings     []int        `yaml:"warnings"`       // Percent of the limit that send limit.warning, e.g. [50, 80, 95]
+	OvershootMB  int          `yaml:"overshoot_mb"`   // Traffic past the limit before connections are cut (default: 0)
+	Period       PeriodConfig `yaml:"period"`         // Billing period the usage resets with (default: never)
+}
+
+// PricingConfig defines what the traffic of each mode costs
+type PricingConfig struct {
+	Currency string                 `yaml:"currency"` // Default: USD
+	Modes    map[string]PriceConfig `yaml:"modes"`    // Per mode name (home default: 3.50 per GB)
+}
+
+// PriceConfig defines the price of a mode's traffic
+type PriceConfig struct {
+	PerGB   float64           `yaml:"per_gb"`  // Price per GB
+	Tiers   []PriceTierConfig `yaml:"tiers"`   // Graduated prices (instead of per_gb)
+	Monthly float64           `yaml:"monthly"` // Fixed cost per month
+}
+
+// PriceTierConfig defines the price of the traffic up to a volume
+type PriceTierConfig struct {
+	UpToGB float64 `yaml:"up_to_gb"` // Upper bound of the tier (0 = no bound, last tier)
+	PerGB  float64 `yaml:"per_gb"`
+}
+
+// BandwidthConfig defines rate limits of the relayed traffic. A connection
+// is held to the global, its mode's and its client's rate, whichever is lowest.
+type BandwidthConfig struct {
+	Global RateConfig            `yaml:"global"` // All traffic
+	Modes  map[string]RateConfig `yaml:"modes"`  // Per mode name
+	Client RateConfig            `yaml:"client"` // Per client source IP
+}
+
+// RateConfig defines upload and download rates, e.g. 10mbit or 2MB
+// (empty = unlimited)
+type RateConfig struct {
+	Upload   string `yaml:"upload"`   // Client to target
+	Download string `yaml:"download"` // Target to client
+}
+
+// AccountingConfig defines per-client traffic accounting
+type AccountingConfig struct {
+	Key        string                    `yaml:"key"`         // Client identity: ip (default), group, user
+	MaxClients int                       `yaml:"max_clients"` // Clients with their own metric series (default: 50)
+	Quotas     map[string]int            `yaml:"quotas"`      // MB per client, mode and accounting period (0 = unlimited)
+	Clients    map[string]map[string]int `yaml:"clients"`     // Quotas of single clients by mode, overriding quotas
+
+	IdleTimeout time.Duration `yaml:"idle_timeout"` // Idle clients are dropped after this long (default: 24h)
+}
+
+// PeriodConfig defines a billing period. A plain string is accepted as the type.
+type PeriodConfig struct {
+	Type     string `yaml:"type"`      // daily, weekly, monthly, rolling
+	ResetDay int    `yaml:"reset_day"` // monthly: day of month the period starts (default: 1)
+	Weekday  string `yaml:"weekday"`   // weekly: day the period starts (default: monday)
+	Days     int    `yaml:"days"`      // rolling: period length in days
+	Timezone string `yaml:"timezone"`  // IANA name (default: local time)
+}
+
+// UnmarshalYAML accepts either a period type or a mapping
+func (p *PeriodConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		p.Type = node.Value
+		return nil
+	}
+
+	type plain PeriodConfig
+	return node.Decode((*plain)(p))
 }
 
-// HomeLimitConfig for home mode limits
-type HomeLimitConfig struct {
-	MaxMB        int    `yaml:"max_mb"`
-	AutoSwitchTo string `yaml:"auto_switch_to"`
+// StateConfig defines where runtime state is persisted across restarts
+type StateConfig struct {
+	Dir           string        `yaml:"dir"`            // e.g. /var/lib/switch-gate (empty = not persisted)
+	FlushInterval time.Duration `yaml:"flush_interval"` // How often state is saved (default: 1m)
+	Period        PeriodConfig  `yaml:"period"`         // Accounting period of the per-mode traffic counters (default: monthly)
 }
 
 // LoggingConfig defines logging options
@@ -0,0 +1,183 @@
+package dns
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Cache bounds
+const (
+	minCacheTTL    = 5 * time.Second
+	maxCacheTTL    = time.Hour
+	negativeTTL    = 60 * time.Second // NXDOMAIN/NODATA without SOA
+	minReverseTTL  = 10 * time.Minute // Clients may connect well after the lookup
+	reverseEntries = 4                // Reverse entries per cached answer
+)
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type cacheEntry struct {
+	msg     *dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+type reverseEntry struct {
+	name    string
+	expires time.Time
+}
+
+// cache keeps upstream answers for their TTL and maps answered
+// addresses back to the queried name
+type cache struct {
+	size int
+
+	mu      sync.Mutex
+	answers map[cacheKey]cacheEntry
+	names   map[string]reverseEntry // IP -> domain
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		answers: make(map[cacheKey]cacheEntry),
+		names:   make(map[string]reverseEntry),
+	}
+}
+
+// get returns a copy of a cached answer with TTLs reduced by its age
+func (c *cache) get(key cacheKey) (*dnsmessage.Message, bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.answers[key]
+	c.mu.Unlock()
+	if !ok || now.After(e.expires) {
+		return nil, false
+	}
+
+	age := uint32(now.Sub(e.stored) / time.Second)
+	msg := *e.msg
+	msg.Answers = agedResources(e.msg.Answers, age)
+	msg.Authorities = agedResources(e.msg.Authorities, age)
+	msg.Additionals = agedResources(e.msg.Additionals, age)
+	return &msg, true
+}
+
+func agedResources(rs []dnsmessage.Resource, age uint32) []dnsmessage.Resource {
+	if len(rs) == 0 {
+		return nil
+	}
+	out := make([]dnsmessage.Resource, len(rs))
+	copy(out, rs)
+	for i := range out {
+		if out[i].Header.Type == dnsmessage.TypeOPT {
+			continue // Class and TTL carry EDNS0 fields
+		}
+		if out[i].Header.TTL > age {
+			out[i].Header.TTL -= age
+		} else {
+			out[i].Header.TTL = 0
+		}
+	}
+	return out
+}
+
+// put stores a copy of an answer and records its addresses in the reverse map.
+// The caller keeps msg: responses set their own ID and questions.
+func (c *cache) put(key cacheKey, msg *dnsmessage.Message) {
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return // Don't cache server failures
+	}
+
+	now := time.Now()
+	ttl := answerTTL(msg)
+	stored := *msg
+	stored.Questions = nil
+	stored.Answers = slices.Clone(msg.Answers)
+	stored.Authorities = slices.Clone(msg.Authorities)
+	stored.Additionals = slices.Clone(msg.Additionals)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.answers) >= c.size {
+		prune(c.answers, c.size, now, func(e cacheEntry) time.Time { return e.expires })
+	}
+	c.answers[key] = cacheEntry{msg: &stored, stored: now, expires: now.Add(ttl)}
+
+	for _, r := range msg.Answers {
+		var ip net.IP
+		switch body := r.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+
+		if len(c.names) >= c.size*reverseEntries {
+			prune(c.names, c.size*reverseEntries, now, func(e reverseEntry) time.Time { return e.expires })
+		}
+		expires := now.Add(max(time.Duration(r.Header.TTL)*time.Second, minReverseTTL))
+		c.names[ip.String()] = reverseEntry{name: key.name, expires: expires}
+	}
+}
+
+// reverse returns the name an address was last answered for
+func (c *cache) reverse(ip net.IP) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.names[ip.String()]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.name, true
+}
+
+// answerTTL returns how long an answer may be cached
+func answerTTL(msg *dnsmessage.Message) time.Duration {
+	var ttl uint32
+	found := false
+	for _, r := range msg.Answers {
+		if !found || r.Header.TTL < ttl {
+			ttl, found = r.Header.TTL, true
+		}
+	}
+	if !found {
+		// Negative answer: SOA minimum (RFC 2308)
+		for _, r := range msg.Authorities {
+			if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+				return clampTTL(time.Duration(min(r.Header.TTL, soa.MinTTL)) * time.Second)
+			}
+		}
+		return negativeTTL
+	}
+	return clampTTL(time.Duration(ttl) * time.Second)
+}
+
+func clampTTL(ttl time.Duration) time.Duration {
+	return min(max(ttl, minCacheTTL), maxCacheTTL)
+}
+
+// prune drops expired entries, and all entries if the map is still at limit
+func prune[K comparable, V any](m map[K]V, limit int, now time.Time, expires func(V) time.Time) {
+	for k, v := range m {
+		if now.After(expires(v)) {
+			delete(m, k)
+		}
+	}
+	if len(m) >= limit {
+		clear(m)
+	}
+}
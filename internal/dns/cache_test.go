@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answer builds a successful response with one A record per address
+func answer(name string, ttl uint32, ips ...string) *dnsmessage.Message {
+	msg := &dnsmessage.Message{Header: dnsmessage.Header{Response: true}}
+	for _, ip := range ips {
+		hdr := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name + "."), Class: dnsmessage.ClassINET, TTL: ttl}
+		if v4 := net.ParseIP(ip).To4(); v4 != nil {
+			hdr.Type = dnsmessage.TypeA
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte(v4)}})
+		} else {
+			hdr.Type = dnsmessage.TypeAAAA
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(net.ParseIP(ip))}})
+		}
+	}
+	return msg
+}
+
+// age moves a cached answer into the past
+func (c *cache) age(key cacheKey, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.answers[key]
+	e.stored = e.stored.Add(-d)
+	e.expires = e.expires.Add(-d)
+	c.answers[key] = e
+}
+
+func TestCacheAging(t *testing.T) {
+	c := newCache(16)
+	key := cacheKey{name: "example.com", qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	msg := answer("example.com", 300, "192.0.2.1", "192.0.2.2")
+	msg.Answers[1].Header.TTL = 600
+	msg.Additionals = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeOPT, Class: 1232},
+		Body:   &dnsmessage.OPTResource{},
+	}}
+	c.put(key, msg)
+
+	c.age(key, 100*time.Second)
+	got, ok := c.get(key)
+	if !ok {
+		t.Fatal("cached answer missing")
+	}
+	if ttl := got.Answers[0].Header.TTL; ttl != 200 {
+		t.Errorf("TTL after 100s = %d, want 200", ttl)
+	}
+	if ttl := got.Answers[1].Header.TTL; ttl != 500 {
+		t.Errorf("second TTL after 100s = %d, want 500", ttl)
+	}
+	if opt := got.Additionals[0].Header; opt.Class != 1232 || opt.TTL != 0 {
+		t.Errorf("OPT record changed: %+v", opt)
+	}
+
+	// Copies: changing one answer leaves the cache alone
+	got.Answers[0].Header.TTL = 1
+	got.ID = 42
+	again, _ := c.get(key)
+	if again.Answers[0].Header.TTL != 200 || again.ID != 0 {
+		t.Error("get returned the cached message")
+	}
+	msg.Answers[0].Header.TTL = 1
+	msg.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com.")}}
+	again, _ = c.get(key)
+	if again.Answers[0].Header.TTL != 200 || again.Questions != nil {
+		t.Error("put kept the caller's message")
+	}
+
+	// The answer expires with its smallest TTL
+	c.age(key, 201*time.Second)
+	if _, ok := c.get(key); ok {
+		t.Error("expired answer returned")
+	}
+}
+
+func TestAnswerTTL(t *testing.T) {
+	soa := func(ttl, minTTL uint32) []dnsmessage.Resource {
+		return []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body: &dnsmessage.SOAResource{
+				NS: dnsmessage.MustNewName("ns.com."), MBox: dnsmessage.MustNewName("admin.com."), MinTTL: minTTL,
+			},
+		}}
+	}
+	nxdomain := func(authorities []dnsmessage.Resource) *dnsmessage.Message {
+		return &dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}, Authorities: authorities}
+	}
+
+	tests := []struct {
+		name string
+		msg  *dnsmessage.Message
+		want time.Duration
+	}{
+		{"smallest answer TTL", answer("example.com", 300, "192.0.2.1", "192.0.2.2"), 300 * time.Second},
+		{"short TTL", answer("example.com", 1, "192.0.2.1"), minCacheTTL},
+		{"zero TTL", answer("example.com", 0, "192.0.2.1"), minCacheTTL},
+		{"long TTL", answer("example.com", 86400, "192.0.2.1"), maxCacheTTL},
+		{"negative with SOA", nxdomain(soa(3600, 120)), 120 * time.Second},
+		{"negative SOA TTL below minimum", nxdomain(soa(30, 900)), 30 * time.Second},
+		{"negative without SOA", nxdomain(nil), negativeTTL},
+	}
+	for _, tt := range tests {
+		if got := answerTTL(tt.msg); got != tt.want {
+			t.Errorf("%s: answerTTL = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCacheSkipsFailures(t *testing.T) {
+	c := newCache(16)
+	key := cacheKey{name: "example.com", qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	msg := answer("example.com", 300, "192.0.2.1")
+	msg.RCode = dnsmessage.RCodeServerFailure
+	c.put(key, msg)
+	if _, ok := c.get(key); ok {
+		t.Error("server failure cached")
+	}
+	if _, ok := c.reverse(net.ParseIP("192.0.2.1")); ok {
+		t.Error("server failure recorded in the reverse map")
+	}
+}
+
+func TestCacheReverse(t *testing.T) {
+	c := newCache(16)
+	c.put(cacheKey{name: "example.com", qtype: dnsmessage.TypeA}, answer("example.com", 5, "192.0.2.1"))
+	c.put(cacheKey{name: "example.com", qtype: dnsmessage.TypeAAAA}, answer("example.com", 5, "2001:db8::1"))
+	c.put(cacheKey{name: "cdn.example.net", qtype: dnsmessage.TypeA}, answer("cdn.example.net", 5, "192.0.2.2", "192.0.2.3"))
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "example.com"},
+		{"2001:db8::1", "example.com"},
+		{"192.0.2.2", "cdn.example.net"},
+		{"192.0.2.3", "cdn.example.net"},
+		{"192.0.2.4", ""},
+	}
+	for _, tt := range tests {
+		if got, _ := c.reverse(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("reverse(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+
+	// The last answer for an address wins
+	c.put(cacheKey{name: "other.example.org", qtype: dnsmessage.TypeA}, answer("other.example.org", 5, "192.0.2.1"))
+	if got, _ := c.reverse(net.ParseIP("192.0.2.1")); got != "other.example.org" {
+		t.Errorf("reverse after a new answer = %q", got)
+	}
+
+	// Entries outlive short answer TTLs, up to minReverseTTL
+	c.mu.Lock()
+	e := c.names["192.0.2.2"]
+	if d := time.Until(e.expires); d < minReverseTTL-time.Minute {
+		t.Errorf("reverse entry expires in %v, want about %v", d, minReverseTTL)
+	}
+	e.expires = time.Now().Add(-time.Second)
+	c.names["192.0.2.2"] = e
+	c.mu.Unlock()
+	if _, ok := c.reverse(net.ParseIP("192.0.2.2")); ok {
+		t.Error("expired reverse entry returned")
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	c := newCache(2)
+	for i, name := range []string{"a.test", "b.test", "c.test"} {
+		c.put(cacheKey{name: name, qtype: dnsmessage.TypeA}, answer(name, 300, "192.0.2."+string(rune('1'+i))))
+	}
+	if len(c.answers) > 2 {
+		t.Errorf("%d cached answers, limit 2", len(c.answers))
+	}
+	if _, ok := c.get(cacheKey{name: "c.test", qtype: dnsmessage.TypeA}); !ok {
+		t.Error("latest answer missing")
+	}
+}
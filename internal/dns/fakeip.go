@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// fakePool hands out addresses of a reserved IPv4 range, one per domain.
+// When the range is used up the oldest mapping is reused.
+type fakePool struct {
+	network *net.IPNet
+	base    uint32 // First usable address
+	size    uint32 // Number of usable addresses
+
+	mu     sync.Mutex
+	next   uint32            // Offset of the next address to hand out
+	byName map[string]uint32 // Domain -> offset
+	byIP   map[uint32]string // Offset -> domain
+}
+
+func newFakePool(cidr string) (*fakePool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip4 == nil || bits != 32 {
+		return nil, fmt.Errorf("range %s is not IPv4", cidr)
+	}
+	if ones > 30 {
+		return nil, fmt.Errorf("range %s is too small", cidr)
+	}
+
+	return &fakePool{
+		network: network,
+		base:    binary.BigEndian.Uint32(ip4) + 1, // Skip the network address
+		size:    uint32(1)<<(32-ones) - 2,         // and the broadcast address
+		byName:  make(map[string]uint32),
+		byIP:    make(map[uint32]string),
+	}, nil
+}
+
+// ipFor returns the fake address of a domain, allocating one if needed
+func (p *fakePool) ipFor(name string) [4]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	off, ok := p.byName[name]
+	if !ok {
+		off = p.next
+		p.next = (p.next + 1) % p.size
+		if old, used := p.byIP[off]; used {
+			delete(p.byName, old)
+		}
+		p.byName[name] = off
+		p.byIP[off] = name
+	}
+
+	var ip [4]byte
+	binary.BigEndian.PutUint32(ip[:], p.base+off)
+	return ip
+}
+
+// lookup returns the domain a fake address was handed out for
+func (p *fakePool) lookup(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.network.Contains(ip4) {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	off := binary.BigEndian.Uint32(ip4) - p.base
+	name, ok := p.byIP[off]
+	return name, ok
+}
@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFakePoolAllocation(t *testing.T) {
+	p, err := newFakePool("198.18.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := p.ipFor("a.example.com")
+	b := p.ipFor("b.example.com")
+	if a != [4]byte{198, 18, 0, 1} || b != [4]byte{198, 18, 0, 2} {
+		t.Errorf("addresses %v, %v; want 198.18.0.1, 198.18.0.2", a, b)
+	}
+	if again := p.ipFor("a.example.com"); again != a {
+		t.Errorf("second lookup of a.example.com = %v, want %v", again, a)
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"198.18.0.1", "a.example.com"},
+		{"198.18.0.2", "b.example.com"},
+		{"198.18.0.3", ""}, // Not handed out
+		{"198.18.0.0", ""}, // Network address
+		{"198.18.1.1", ""}, // Outside the range
+		{"192.0.2.1", ""},
+		{"2001:db8::1", ""},
+	}
+	for _, tt := range tests {
+		if got, _ := p.lookup(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("lookup(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestFakePoolWrap(t *testing.T) {
+	// Two usable addresses: .1 and .2
+	p, err := newFakePool("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := p.ipFor("one.test")
+	p.ipFor("two.test")
+
+	// The range is used up: the oldest address is reused
+	third := p.ipFor("three.test")
+	if third != first {
+		t.Fatalf("third name got %v, want the reused %v", third, first)
+	}
+	if got, _ := p.lookup(net.IP(third[:])); got != "three.test" {
+		t.Errorf("lookup of the reused address = %q, want three.test", got)
+	}
+
+	// The evicted name gets the next address in turn
+	if again := p.ipFor("one.test"); again != [4]byte{198, 18, 0, 2} {
+		t.Errorf("evicted name got %v, want 198.18.0.2", again)
+	}
+	if got, _ := p.lookup(net.IPv4(198, 18, 0, 2)); got != "one.test" {
+		t.Errorf("lookup(198.18.0.2) = %q, want one.test", got)
+	}
+	if len(p.byName) != 2 || len(p.byIP) != 2 {
+		t.Errorf("%d names, %d addresses mapped; want 2, 2", len(p.byName), len(p.byIP))
+	}
+}
+
+func TestFakePoolErrors(t *testing.T) {
+	for _, cidr := range []string{"fc00::/64", "198.18.0.0/31", "198.18.0.1", "not a range"} {
+		if _, err := newFakePool(cidr); err == nil {
+			t.Errorf("newFakePool(%q) succeeded", cidr)
+		}
+	}
+}
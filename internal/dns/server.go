@@ -0,0 +1,359 @@
+// Package dns implements an embedded DNS server that caches answers,
+// remembers which domain every answered address belongs to, and can hand
+// out fake IPs so the transparent proxy recovers the hostname of a flow.
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+	"github.com/scinfra-pro/switch-gate/internal/resolver"
+)
+
+// Defaults
+const (
+	DefaultCacheSize    = 4096
+	DefaultFakeIPTTL    = time.Second
+	tcpIdleTimeout      = 10 * time.Second
+	maxUDPSize          = 512 // Without EDNS0
+	maxMessageSize      = 65535
+	defaultUpstreamPort = "53"
+)
+
+// DefaultFakeIPRange is the benchmarking range (RFC 2544), not routed publicly
+const DefaultFakeIPRange = "198.18.0.0/15"
+
+// Server answers DNS queries over UDP and TCP
+type Server struct {
+	udp      net.PacketConn
+	tcp      net.Listener
+	upstream resolver.Exchanger
+	timeout  time.Duration
+
+	cache   *cache
+	fake    *fakePool // nil unless fake-IP mode is enabled
+	fakeTTL time.Duration
+	exclude []string
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New creates a DNS server listening on cfg.Listen
+func New(cfg config.DNSConfig) (*Server, error) {
+	if cfg.Listen == "" {
+		return nil, fmt.Errorf("dns listen address is not configured")
+	}
+
+	up := cfg.Upstream
+	if up.Type == "" {
+		up.Type = resolver.TypeUDP
+	}
+	var d net.Dialer
+	upstream, err := resolver.NewExchanger(up, d.DialContext)
+	if err != nil {
+		return nil, fmt.Errorf("dns upstream: %w", err)
+	}
+	timeout := up.Timeout
+	if timeout <= 0 {
+		timeout = resolver.DefaultTimeout
+	}
+
+	size := cfg.CacheSize
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+
+	s := &Server{
+		upstream: upstream,
+		timeout:  timeout,
+		cache:    newCache(size),
+	}
+
+	if cfg.FakeIP.Enabled {
+		r := cfg.FakeIP.Range
+		if r == "" {
+			r = DefaultFakeIPRange
+		}
+		if s.fake, err = newFakePool(r); err != nil {
+			return nil, fmt.Errorf("fake_ip: %w", err)
+		}
+		s.fakeTTL = cfg.FakeIP.TTL
+		if s.fakeTTL <= 0 {
+			s.fakeTTL = DefaultFakeIPTTL
+		}
+		for _, suffix := range cfg.FakeIP.Exclude {
+			s.exclude = append(s.exclude, normalize(suffix))
+		}
+	}
+
+	if s.udp, err = net.ListenPacket("udp", cfg.Listen); err != nil {
+		return nil, err
+	}
+	if s.tcp, err = net.Listen("tcp", cfg.Listen); err != nil {
+		_ = s.udp.Close()
+		return nil, err
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// Serve answers queries until Shutdown
+func (s *Server) Serve() error {
+	if s.fake != nil {
+		log.Printf("INFO: DNS server listening on %s (fake-IP %s)", s.udp.LocalAddr(), s.fake.network)
+	} else {
+		log.Printf("INFO: DNS server listening on %s", s.udp.LocalAddr())
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.serveTCP()
+	}()
+	s.serveUDP()
+
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveUDP() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			log.Printf("ERROR: DNS read failed: %v", err)
+			continue
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if resp := s.handle(query, true); resp != nil {
+				_, _ = s.udp.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			log.Printf("ERROR: DNS accept failed: %v", err)
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleTCP(conn)
+		}()
+	}
+}
+
+// handleTCP answers length-prefixed queries until the client goes idle
+func (s *Server) handleTCP(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	stop := context.AfterFunc(s.ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	for {
+		_ = conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		resp := s.handle(query, false)
+		if resp == nil {
+			return
+		}
+		msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(resp)), uint16(len(resp)))
+		if _, err := conn.Write(append(msg, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a query; nil means no answer (malformed query)
+func (s *Server) handle(query []byte, udp bool) []byte {
+	var req dnsmessage.Message
+	if err := req.Unpack(query); err != nil || req.Response {
+		return nil
+	}
+	if len(req.Questions) != 1 {
+		return reply(&req, dnsmessage.RCodeFormatError, nil)
+	}
+	q := req.Questions[0]
+	name := normalize(q.Name.String())
+
+	// Fake-IP mode: A queries get an address of the pool, AAAA queries
+	// no address so clients use IPv4
+	if s.fake != nil && q.Class == dnsmessage.ClassINET && s.fakeable(name) {
+		switch q.Type {
+		case dnsmessage.TypeA:
+			ip := s.fake.ipFor(name)
+			return reply(&req, dnsmessage.RCodeSuccess, []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: uint32(s.fakeTTL / time.Second)},
+				Body:   &dnsmessage.AResource{A: ip},
+			}})
+		case dnsmessage.TypeAAAA:
+			return reply(&req, dnsmessage.RCodeSuccess, nil)
+		}
+	}
+
+	key := cacheKey{name: name, qtype: q.Type, class: q.Class}
+	resp, ok := s.cache.get(key)
+	if !ok {
+		var err error
+		if resp, err = s.forward(query, key); err != nil {
+			log.Printf("DEBUG: DNS %s %s: %v", name, q.Type, err)
+			return reply(&req, dnsmessage.RCodeServerFailure, nil)
+		}
+	}
+
+	resp.ID = req.ID
+	resp.Questions = req.Questions
+	packed, err := resp.Pack()
+	if err != nil {
+		return reply(&req, dnsmessage.RCodeServerFailure, nil)
+	}
+	if udp && len(packed) > udpLimit(&req) {
+		return truncated(&req)
+	}
+	return packed
+}
+
+// forward sends a query upstream and caches the answer
+func (s *Server) forward(query []byte, key cacheKey) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	raw, err := s.upstream.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("parse upstream response: %w", err)
+	}
+	if resp.Truncated {
+		return nil, errors.New("truncated upstream response")
+	}
+
+	s.cache.put(key, &resp)
+	return &resp, nil
+}
+
+// fakeable reports whether a name gets fake addresses
+func (s *Server) fakeable(name string) bool {
+	if name == "" || !strings.Contains(name, ".") {
+		return false // Root and single-label names stay real
+	}
+	for _, suffix := range s.exclude {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup returns the domain a client resolved to ip through this server
+func (s *Server) Lookup(ip net.IP) (string, bool) {
+	if s.fake != nil {
+		if name, ok := s.fake.lookup(ip); ok {
+			return name, true
+		}
+	}
+	return s.cache.reverse(ip)
+}
+
+// Shutdown stops the server
+func (s *Server) Shutdown() {
+	s.cancel()
+	_ = s.udp.Close()
+	_ = s.tcp.Close()
+}
+
+// Addr returns the server address
+func (s *Server) Addr() net.Addr {
+	return s.udp.LocalAddr()
+}
+
+// reply builds a response to req with the given answers
+func reply(req *dnsmessage.Message, rcode dnsmessage.RCode, answers []dnsmessage.Resource) []byte {
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 req.ID,
+			Response:           true,
+			OpCode:             req.OpCode,
+			RecursionDesired:   req.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: req.Questions,
+		Answers:   answers,
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+// truncated builds an empty response with the TC bit so the client retries over TCP
+func truncated(req *dnsmessage.Message) []byte {
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 req.ID,
+			Response:           true,
+			Truncated:          true,
+			RecursionDesired:   req.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: req.Questions,
+	}
+	packed, _ := resp.Pack()
+	return packed
+}
+
+// udpLimit returns the largest UDP response the client accepts (EDNS0)
+func udpLimit(req *dnsmessage.Message) int {
+	for _, r := range req.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			return max(int(r.Header.Class), maxUDPSize)
+		}
+	}
+	return maxUDPSize
+}
+
+// normalize lowercases a domain name and strips the trailing dot
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUpstream answers A queries with n addresses and counts the queries
+type fakeUpstream struct {
+	n       int
+	queries atomic.Int32
+}
+
+func (u *fakeUpstream) Exchange(_ context.Context, query []byte) ([]byte, error) {
+	u.queries.Add(1)
+	var req dnsmessage.Message
+	if err := req.Unpack(query); err != nil {
+		return nil, err
+	}
+	var ips []string
+	for i := range u.n {
+		ips = append(ips, fmt.Sprintf("192.0.2.%d", i+1))
+	}
+	resp := answer(normalize(req.Questions[0].Name.String()), 300, ips...)
+	resp.ID = req.ID
+	resp.Questions = req.Questions
+	return resp.Pack()
+}
+
+// newTestServer creates a server without listeners
+func newTestServer(upstream *fakeUpstream) *Server {
+	return &Server{upstream: upstream, timeout: time.Second, cache: newCache(16), ctx: context.Background()}
+}
+
+// query packs a query for name, with an EDNS0 record if udpSize > 0
+func query(t *testing.T, id uint16, name string, qtype dnsmessage.Type, udpSize int) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	if udpSize > 0 {
+		msg.Additionals = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeOPT, Class: dnsmessage.Class(udpSize)},
+			Body:   &dnsmessage.OPTResource{},
+		}}
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func unpack(t *testing.T, resp []byte) *dnsmessage.Message {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+func TestHandleCaches(t *testing.T) {
+	up := &fakeUpstream{n: 1}
+	s := newTestServer(up)
+
+	for i, name := range []string{"example.com.", "EXAMPLE.com."} {
+		resp := unpack(t, s.handle(query(t, uint16(100+i), name, dnsmessage.TypeA, 0), true))
+		if resp.ID != uint16(100+i) || len(resp.Answers) != 1 {
+			t.Fatalf("response %d: ID %d, %d answers", i, resp.ID, len(resp.Answers))
+		}
+		if q := resp.Questions[0].Name.String(); q != name {
+			t.Errorf("response %d: question %s, want %s", i, q, name)
+		}
+	}
+	if n := up.queries.Load(); n != 1 {
+		t.Errorf("%d upstream queries, want 1", n)
+	}
+	if name, _ := s.Lookup([]byte{192, 0, 2, 1}); name != "example.com" {
+		t.Errorf("Lookup = %q, want example.com", name)
+	}
+}
+
+func TestHandleConcurrentHits(t *testing.T) {
+	up := &fakeUpstream{n: 2}
+	s := newTestServer(up)
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		name := []string{"a.example.com.", "b.example.com."}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := s.handle(query(t, uint16(i), name, dnsmessage.TypeA, 0), true)
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Error(err)
+				return
+			}
+			if msg.ID != uint16(i) || msg.Questions[0].Name.String() != name || len(msg.Answers) != 2 {
+				t.Errorf("query %d for %s: ID %d, question %s, %d answers",
+					i, name, msg.ID, msg.Questions[0].Name, len(msg.Answers))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHandleTruncation(t *testing.T) {
+	up := &fakeUpstream{n: 40} // About 650 bytes
+	s := newTestServer(up)
+
+	resp := unpack(t, s.handle(query(t, 1, "big.example.com.", dnsmessage.TypeA, 0), true))
+	if !resp.Truncated || len(resp.Answers) != 0 || resp.ID != 1 {
+		t.Errorf("UDP without EDNS0: truncated %v, %d answers", resp.Truncated, len(resp.Answers))
+	}
+
+	resp = unpack(t, s.handle(query(t, 2, "big.example.com.", dnsmessage.TypeA, 1232), true))
+	if resp.Truncated || len(resp.Answers) != 40 {
+		t.Errorf("UDP with EDNS0 1232: truncated %v, %d answers", resp.Truncated, len(resp.Answers))
+	}
+
+	resp = unpack(t, s.handle(query(t, 3, "big.example.com.", dnsmessage.TypeA, 0), false))
+	if resp.Truncated || len(resp.Answers) != 40 {
+		t.Errorf("TCP: truncated %v, %d answers", resp.Truncated, len(resp.Answers))
+	}
+}
+
+func TestHandleFakeIP(t *testing.T) {
+	up := &fakeUpstream{n: 1}
+	s := newTestServer(up)
+	s.fake, _ = newFakePool(DefaultFakeIPRange)
+	s.fakeTTL = DefaultFakeIPTTL
+	s.exclude = []string{"lan"}
+
+	resp := unpack(t, s.handle(query(t, 1, "example.com.", dnsmessage.TypeA, 0), true))
+	a, ok := resp.Answers[0].Body.(*dnsmessage.AResource)
+	if !ok || a.A != [4]byte{198, 18, 0, 1} || resp.Answers[0].Header.TTL != 1 {
+		t.Fatalf("fake answer %+v", resp.Answers)
+	}
+	if name, _ := s.Lookup(a.A[:]); name != "example.com" {
+		t.Errorf("Lookup(fake) = %q, want example.com", name)
+	}
+
+	resp = unpack(t, s.handle(query(t, 2, "example.com.", dnsmessage.TypeAAAA, 0), true))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 {
+		t.Errorf("AAAA: %v, %d answers; want an empty answer", resp.RCode, len(resp.Answers))
+	}
+
+	for _, name := range []string{"nas.lan.", "localhost."} {
+		resp = unpack(t, s.handle(query(t, 3, name, dnsmessage.TypeA, 0), true))
+		if a := resp.Answers[0].Body.(*dnsmessage.AResource); a.A != [4]byte{192, 0, 2, 1} {
+			t.Errorf("%s: got %v, want the upstream answer", name, a.A)
+		}
+	}
+	if n := up.queries.Load(); n != 2 {
+		t.Errorf("%d upstream queries, want 2", n)
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	s := newTestServer(&fakeUpstream{n: 1})
+	if resp := s.handle([]byte{1, 2, 3}, true); resp != nil {
+		t.Error("answered a malformed query")
+	}
+
+	msg := dnsmessage.Message{Questions: []dnsmessage.Question{
+		{Name: dnsmessage.MustNewName("a.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		{Name: dnsmessage.MustNewName("b.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+	}}
+	packed, _ := msg.Pack()
+	if resp := unpack(t, s.handle(packed, true)); resp.RCode != dnsmessage.RCodeFormatError {
+		t.Errorf("two questions: %v, want FORMERR", resp.RCode)
+	}
+}
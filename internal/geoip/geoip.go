@@ -0,0 +1,170 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DefaultReloadInterval is how often database files are checked for changes
+const DefaultReloadInterval = time.Minute
+
+// record holds the fields we read from Country and ASN databases
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// source is a single .mmdb file and the reader loaded from it
+type source struct {
+	path    string
+	reader  atomic.Pointer[maxminddb.Reader]
+	modTime time.Time
+}
+
+// DB looks up country and ASN for IP addresses from local MaxMind databases
+type DB struct {
+	country *source
+	asn     *source
+}
+
+// Open loads the Country and/or ASN databases.
+// Either path may be empty; both may point to the same combined file.
+func Open(countryPath, asnPath string) (*DB, error) {
+	db := &DB{}
+
+	if countryPath != "" {
+		src, err := openSource(countryPath)
+		if err != nil {
+			return nil, err
+		}
+		db.country = src
+	}
+
+	if asnPath != "" {
+		src, err := openSource(asnPath)
+		if err != nil {
+			return nil, err
+		}
+		db.asn = src
+	}
+
+	return db, nil
+}
+
+func openSource(path string) (*source, error) {
+	src := &source{path: path}
+	if _, err := src.load(); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// load (re)reads the database if the file changed since the last load
+func (s *source) load() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, fmt.Errorf("stat %s: %w", s.path, err)
+	}
+	if s.reader.Load() != nil && info.ModTime().Equal(s.modTime) {
+		return false, nil
+	}
+
+	// Read into memory instead of mmap, so a replaced reader can simply be
+	// dropped while lookups on it may still be in flight
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, fmt.Errorf("read %s: %w", s.path, err)
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return false, fmt.Errorf("open %s: %w", s.path, err)
+	}
+
+	s.reader.Store(reader)
+	s.modTime = info.ModTime()
+	return true, nil
+}
+
+func (s *source) lookup(ip net.IP, rec *record) bool {
+	if s == nil {
+		return false
+	}
+	reader := s.reader.Load()
+	if reader == nil {
+		return false
+	}
+	return reader.Lookup(ip, rec) == nil
+}
+
+// HasCountry reports whether a Country database is loaded
+func (db *DB) HasCountry() bool {
+	return db != nil && db.country != nil
+}
+
+// HasASN reports whether an ASN database is loaded
+func (db *DB) HasASN() bool {
+	return db != nil && db.asn != nil
+}
+
+// Country returns the ISO country code for the IP (empty if unknown)
+func (db *DB) Country(ip net.IP) string {
+	var rec record
+	if !db.country.lookup(ip, &rec) {
+		return ""
+	}
+	if rec.Country.ISOCode != "" {
+		return strings.ToUpper(rec.Country.ISOCode)
+	}
+	return strings.ToUpper(rec.RegisteredCountry.ISOCode)
+}
+
+// ASN returns the autonomous system number for the IP (0 if unknown)
+func (db *DB) ASN(ip net.IP) uint {
+	var rec record
+	if !db.asn.lookup(ip, &rec) {
+		return 0
+	}
+	return rec.ASN
+}
+
+// Watch reloads the databases when their files change, until ctx is done
+func (db *DB) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, src := range []*source{db.country, db.asn} {
+				if src == nil {
+					continue
+				}
+				reloaded, err := src.load()
+				if err != nil {
+					log.Printf("WARN: GeoIP reload failed: %v", err)
+				} else if reloaded {
+					log.Printf("INFO: GeoIP database reloaded: %s", src.path)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package geoip
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// encode appends a value in the MaxMind DB data format. Supports the
+// types the databases of these tests use.
+func encode(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		b = append(b, 2<<5|byte(len(v)))
+		return append(b, v...)
+	case uint16:
+		return append(append(b, 5<<5|2), byte(v>>8), byte(v))
+	case uint32:
+		return binary.BigEndian.AppendUint32(append(b, 6<<5|4), v)
+	case map[string]any:
+		b = append(b, 7<<5|byte(len(v)))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = encode(encode(b, k), v[k])
+		}
+		return b
+	default:
+		panic("unsupported type")
+	}
+}
+
+// writeDB writes an IPv4 MaxMind DB with a record per network
+func writeDB(t *testing.T, path string, records map[string]map[string]any) {
+	t.Helper()
+
+	// Search tree with 24 bit records; -1 is empty, >= 0 a node,
+	// <= -2 data at offset -r-2
+	nodes := [][2]int{{-1, -1}}
+	var data []byte
+	for cidr, rec := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		ip := binary.BigEndian.Uint32(network.IP.To4())
+
+		node := 0
+		for i := 0; i < ones-1; i++ {
+			bit := ip >> (31 - i) & 1
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		nodes[node][ip>>(32-ones)&1] = -len(data) - 2
+		data = encode(data, rec)
+	}
+
+	var db []byte
+	count := len(nodes)
+	for _, n := range nodes {
+		for _, r := range n {
+			switch {
+			case r == -1:
+				r = count
+			case r <= -2:
+				r = count + 16 + (-r - 2)
+			}
+			db = append(db, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = encode(db, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint32(time.Now().Unix()),
+		"database_type":               "Test",
+		"ip_version":                  uint16(4),
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+	})
+	if err := os.WriteFile(path, db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func country(code string) map[string]any {
+	return map[string]any{"country": map[string]any{"iso_code": code}}
+}
+
+// testDBs writes a Country, an ASN and a combined database
+func testDBs(t *testing.T) (countryPath, asnPath, combinedPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	countryPath = filepath.Join(dir, "country.mmdb")
+	writeDB(t, countryPath, map[string]map[string]any{
+		"192.0.2.0/24":    country("DE"),
+		"198.51.100.0/24": {"registered_country": map[string]any{"iso_code": "NL"}},
+		"203.0.113.0/25":  country("us"),
+	})
+	asnPath = filepath.Join(dir, "asn.mmdb")
+	writeDB(t, asnPath, map[string]map[string]any{
+		"192.0.2.0/24":      {"autonomous_system_number": uint32(64500)},
+		"198.51.100.128/25": {"autonomous_system_number": uint32(64501)},
+	})
+	combinedPath = filepath.Join(dir, "combined.mmdb")
+	writeDB(t, combinedPath, map[string]map[string]any{
+		"192.0.2.0/24": {"country": map[string]any{"iso_code": "FR"}, "autonomous_system_number": uint32(64502)},
+	})
+	return countryPath, asnPath, combinedPath
+}
+
+func TestLookups(t *testing.T) {
+	countryPath, asnPath, _ := testDBs(t)
+	db, err := Open(countryPath, asnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		country string
+		asn     uint
+	}{
+		{"192.0.2.1", "DE", 64500},
+		{"192.0.2.255", "DE", 64500},
+		{"198.51.100.1", "NL", 0}, // Registered country only
+		{"198.51.100.200", "NL", 64501},
+		{"203.0.113.1", "US", 0}, // Normalized to upper case
+		{"203.0.113.200", "", 0}, // Outside the /25
+		{"10.0.0.1", "", 0},
+		{"2001:db8::1", "", 0}, // IPv4 databases
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if got := db.Country(ip); got != tt.country {
+			t.Errorf("Country(%s) = %q, want %q", tt.ip, got, tt.country)
+		}
+		if got := db.ASN(ip); got != tt.asn {
+			t.Errorf("ASN(%s) = %d, want %d", tt.ip, got, tt.asn)
+		}
+	}
+}
+
+func TestSources(t *testing.T) {
+	countryPath, asnPath, combinedPath := testDBs(t)
+	ip := net.ParseIP("192.0.2.1")
+
+	tests := []struct {
+		name        string
+		country     string
+		asn         string
+		hasCountry  bool
+		hasASN      bool
+		wantCountry string
+		wantASN     uint
+	}{
+		{"country only", countryPath, "", true, false, "DE", 0},
+		{"asn only", "", asnPath, false, true, "", 64500},
+		{"combined file", combinedPath, combinedPath, true, true, "FR", 64502},
+		{"none", "", "", false, false, "", 0},
+	}
+	for _, tt := range tests {
+		db, err := Open(tt.country, tt.asn)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if db.HasCountry() != tt.hasCountry || db.HasASN() != tt.hasASN {
+			t.Errorf("%s: HasCountry %v, HasASN %v", tt.name, db.HasCountry(), db.HasASN())
+		}
+		if got := db.Country(ip); got != tt.wantCountry {
+			t.Errorf("%s: Country = %q, want %q", tt.name, got, tt.wantCountry)
+		}
+		if got := db.ASN(ip); got != tt.wantASN {
+			t.Errorf("%s: ASN = %d, want %d", tt.name, got, tt.wantASN)
+		}
+	}
+
+	var none *DB
+	if none.HasCountry() || none.HasASN() {
+		t.Error("nil DB has sources")
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.mmdb")
+	if err := os.WriteFile(garbage, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "missing.mmdb"), garbage} {
+		if _, err := Open(path, ""); err == nil {
+			t.Errorf("Open(%s) succeeded", filepath.Base(path))
+		}
+		if _, err := Open("", path); err == nil {
+			t.Errorf("Open asn %s succeeded", filepath.Base(path))
+		}
+	}
+}
+
+func TestWatchReloads(t *testing.T) {
+	countryPath, _, _ := testDBs(t)
+	db, err := Open(countryPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		db.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	writeDB(t, countryPath, map[string]map[string]any{"192.0.2.0/24": country("AT")})
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(countryPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); db.Country(ip) != "AT"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Country = %q after the file changed, want AT", db.Country(ip))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
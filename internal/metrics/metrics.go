@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -9,60 +10,141 @@ import (
 type Metrics struct {
 	startTime time.Time
 
-	// Bytes per mode
-	bytesDirect atomic.Uint64
-	bytesWarp   atomic.Uint64
-	bytesHome   atomic.Uint64
+	// Bytes per mode, registered from the mode registry
+	bytesMu sync.RWMutex
+	modes   []string
+	bytes   map[string]*atomic.Uint64
+
+	// Fallbacks per (from, to, reason)
+	fallbackMu sync.Mutex
+	fallbacks  []FallbackCount
+
+	// Sniffing results per protocol (tls, http, none)
+	sniffMu sync.Mutex
+	sniffed map[string]uint64
 
 	// Connections
 	activeConns atomic.Int32
 	totalConns  atomic.Uint64
 }
 
-// New creates a new Metrics instance
-func New() *Metrics {
-	return &Metrics{
+// FallbackCount is the number of fallbacks from one mode to another
+type FallbackCount struct {
+	From   string
+	To     string
+	Reason string // Error class that triggered the fallback
+	Count  uint64
+}
+
+// New creates a new Metrics instance with counters for the given modes
+func New(modes ...string) *Metrics {
+	m := &Metrics{
 		startTime: time.Now(),
+		bytes:     make(map[string]*atomic.Uint64),
+		sniffed:   make(map[string]uint64),
 	}
+	for _, mode := range modes {
+		m.Register(mode)
+	}
+	return m
+}
+
+// Register adds a byte counter for a mode (no-op if already registered)
+func (m *Metrics) Register(mode string) {
+	m.bytesMu.Lock()
+	defer m.bytesMu.Unlock()
+
+	if _, ok := m.bytes[mode]; ok {
+		return
+	}
+	m.bytes[mode] = &atomic.Uint64{}
+	m.modes = append(m.modes, mode)
+}
+
+// Modes returns the registered modes in registration order
+func (m *Metrics) Modes() []string {
+	m.bytesMu.RLock()
+	defer m.bytesMu.RUnlock()
+	return append([]string(nil), m.modes...)
+}
+
+func (m *Metrics) counter(mode string) *atomic.Uint64 {
+	m.bytesMu.RLock()
+	defer m.bytesMu.RUnlock()
+	return m.bytes[mode]
 }
 
-// AddBytes adds bytes to the specified mode counter
+// AddBytes adds bytes to the specified mode counter.
+// Bytes for unregistered modes are ignored.
 func (m *Metrics) AddBytes(mode string, n int64) {
 	if n <= 0 {
 		return
 	}
 
-	switch mode {
-	case "direct":
-		m.bytesDirect.Add(uint64(n))
-	case "warp":
-		m.bytesWarp.Add(uint64(n))
-	case "home":
-		m.bytesHome.Add(uint64(n))
+	if c := m.counter(mode); c != nil {
+		c.Add(uint64(n))
 	}
 }
 
 // GetBytes returns bytes for the specified mode
 func (m *Metrics) GetBytes(mode string) uint64 {
-	switch mode {
-	case "direct":
-		return m.bytesDirect.Load()
-	case "warp":
-		return m.bytesWarp.Load()
-	case "home":
-		return m.bytesHome.Load()
-	default:
-		return 0
+	if c := m.counter(mode); c != nil {
+		return c.Load()
 	}
+	return 0
 }
 
 // GetAllBytes returns bytes for all modes
 func (m *Metrics) GetAllBytes() map[string]uint64 {
-	return map[string]uint64{
-		"direct": m.bytesDirect.Load(),
-		"warp":   m.bytesWarp.Load(),
-		"home":   m.bytesHome.Load(),
+	m.bytesMu.RLock()
+	defer m.bytesMu.RUnlock()
+
+	result := make(map[string]uint64, len(m.bytes))
+	for mode, c := range m.bytes {
+		result[mode] = c.Load()
+	}
+	return result
+}
+
+// AddFallback counts a fallback from one mode to another
+func (m *Metrics) AddFallback(from, to, reason string) {
+	m.fallbackMu.Lock()
+	defer m.fallbackMu.Unlock()
+
+	for i := range m.fallbacks {
+		f := &m.fallbacks[i]
+		if f.From == from && f.To == to && f.Reason == reason {
+			f.Count++
+			return
+		}
+	}
+	m.fallbacks = append(m.fallbacks, FallbackCount{From: from, To: to, Reason: reason, Count: 1})
+}
+
+// Fallbacks returns fallback counters in order of first occurrence
+func (m *Metrics) Fallbacks() []FallbackCount {
+	m.fallbackMu.Lock()
+	defer m.fallbackMu.Unlock()
+	return append([]FallbackCount(nil), m.fallbacks...)
+}
+
+// AddSniffed counts a sniffed connection by detected protocol
+func (m *Metrics) AddSniffed(protocol string) {
+	m.sniffMu.Lock()
+	defer m.sniffMu.Unlock()
+	m.sniffed[protocol]++
+}
+
+// Sniffed returns the sniffed connections per protocol
+func (m *Metrics) Sniffed() map[string]uint64 {
+	m.sniffMu.Lock()
+	defer m.sniffMu.Unlock()
+
+	result := make(map[string]uint64, len(m.sniffed))
+	for p, n := range m.sniffed {
+		result[p] = n
 	}
+	return result
 }
 
 // Uptime returns the time since start
@@ -93,7 +175,10 @@ func (m *Metrics) TotalConnections() uint64 {
 
 // Stats contains all metrics
 type Stats struct {
+	Modes       []string // Registered modes in order
 	Bytes       map[string]uint64
+	Fallbacks   []FallbackCount
+	Sniffed     map[string]uint64
 	ActiveConns int
 	TotalConns  uint64
 	Uptime      time.Duration
@@ -102,7 +187,10 @@ type Stats struct {
 // GetStats returns all metrics as a Stats struct
 func (m *Metrics) GetStats() Stats {
 	return Stats{
+		Modes:       m.Modes(),
 		Bytes:       m.GetAllBytes(),
+		Fallbacks:   m.Fallbacks(),
+		Sniffed:     m.Sniffed(),
 		ActiveConns: m.ActiveConnections(),
 		TotalConns:  m.TotalConnections(),
 		Uptime:      m.Uptime(),
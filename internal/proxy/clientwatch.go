@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// watchClient returns a context for dialing the upstream of client. It is
+// cancelled when parent is done or the client closes its connection.
+// stop must be called once the dial is over: it stops watching and returns
+// the connection to relay from, which replays any bytes the client sent
+// while the dial was pending.
+func watchClient(parent context.Context, client net.Conn) (ctx context.Context, stop func() net.Conn) {
+	ctx, cancel := context.WithCancel(parent)
+
+	type readResult struct {
+		data []byte
+		err  error
+	}
+	done := make(chan readResult, 1)
+
+	go func() {
+		buf := make([]byte, 4096)
+		n, err := client.Read(buf)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			// Client closed or reset the connection
+			cancel()
+		}
+		done <- readResult{data: buf[:n], err: err}
+	}()
+
+	stop = func() net.Conn {
+		defer cancel()
+
+		// Interrupt the pending read
+		_ = client.SetReadDeadline(time.Unix(1, 0))
+		r := <-done
+		_ = client.SetReadDeadline(time.Time{})
+
+		if len(r.data) > 0 {
+			return &prefixConn{Conn: client, prefix: r.data}
+		}
+		return client
+	}
+
+	return ctx, stop
+}
+
+// prefixConn returns bytes read ahead before reading from the connection
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite half-closes the underlying connection if supported
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// closeWriter is implemented by connections that support half-close
+type closeWriter interface {
+	CloseWrite() error
+}
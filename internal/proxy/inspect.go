@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+	"github.com/scinfra-pro/switch-gate/internal/metrics"
+)
+
+// HostLookup recovers the domain a client resolved to an IP
+// (implemented by the embedded DNS server)
+type HostLookup interface {
+	Lookup(ip net.IP) (string, bool)
+}
+
+// targetInspector recovers the domain of IP targets
+type targetInspector struct {
+	hosts   HostLookup // Optional
+	sniff   config.SniffConfig
+	metrics *metrics.Metrics
+}
+
+// SetHostLookup sets where domains of IP targets are looked up
+func (t *targetInspector) SetHostLookup(hosts HostLookup) {
+	t.hosts = hosts
+}
+
+// SetSniffing configures sniffing of domains from the first client bytes
+func (t *targetInspector) SetSniffing(cfg config.SniffConfig) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultSniffTimeout
+	}
+	t.sniff = cfg
+}
+
+// inspect returns the domain of an IP target, the address to dial and the
+// connection to relay from. A domain from the DNS server is dialed (fake IPs
+// would not connect); a sniffed one only with override_destination.
+// ready is called before sniffing, if set.
+func (t *targetInspector) inspect(conn net.Conn, address string, ready func()) (host, dialAddr string, c net.Conn) {
+	ipStr, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(ipStr) == nil {
+		return "", address, conn
+	}
+
+	if t.hosts != nil {
+		if name, ok := t.hosts.Lookup(net.ParseIP(ipStr)); ok {
+			return name, net.JoinHostPort(name, port), conn
+		}
+	}
+
+	if !t.sniff.Enabled {
+		return "", address, conn
+	}
+	if ready != nil {
+		ready()
+	}
+
+	host, protocol, conn := sniff(conn, t.sniff.Timeout)
+	t.metrics.AddSniffed(protocol)
+	if host != "" && t.sniff.OverrideDestination {
+		return host, net.JoinHostPort(host, port), conn
+	}
+	return host, address, conn
+}
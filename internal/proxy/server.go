@@ -16,6 +16,9 @@ type Server struct {
 	listener net.Listener
 	router   *router.Router
 	metrics  *metrics.Metrics
+	targetInspector
+
+	users map[string]string // SOCKS5 users (nil: no authentication)
 
 	conns   map[net.Conn]struct{}
 	connsMu sync.Mutex
@@ -34,12 +37,13 @@ func New(addr string, r *router.Router, m *metrics.Metrics) (*Server, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Server{
-		listener: listener,
-		router:   r,
-		metrics:  m,
-		conns:    make(map[net.Conn]struct{}),
-		ctx:      ctx,
-		cancel:   cancel,
+		listener:        listener,
+		router:          r,
+		metrics:         m,
+		conns:           make(map[net.Conn]struct{}),
+		targetInspector: targetInspector{metrics: m},
+		ctx:             ctx,
+		cancel:          cancel,
 	}, nil
 }
 
@@ -67,26 +71,45 @@ func (s *Server) handleConnection(clientConn net.Conn) {
 	defer func() { _ = clientConn.Close() }()
 
 	// SOCKS5 handshake
-	targetAddr, err := s.socks5Handshake(clientConn)
+	targetAddr, user, err := s.socks5Handshake(clientConn)
 	if err != nil {
 		log.Printf("DEBUG: SOCKS5 handshake failed: %v", err)
 		return
 	}
 
-	// Dial target through router
-	targetConn, err := s.router.Dial("tcp", targetAddr)
+	// Domain of IP targets: clients only send data after the reply, so
+	// sniffing replies before the dial and a failed dial ends in EOF.
+	// Targets named by the client or the DNS server are not sniffed.
+	replied := false
+	host, dialAddr, conn := s.inspect(clientConn, targetAddr, func() {
+		s.socks5Reply(clientConn, 0x00)
+		replied = true
+	})
+	if host != "" {
+		log.Printf("DEBUG: SOCKS5: %s -> %s (%s)", clientConn.RemoteAddr(), targetAddr, host)
+	}
+	meta := &router.Metadata{Source: clientConn.RemoteAddr(), Host: host, User: user}
+
+	// Dial target through router; cancelled if the client leaves or on shutdown
+	dialCtx, stopWatch := watchClient(s.ctx, conn)
+	targetConn, err := s.router.DialContext(dialCtx, meta, "tcp", dialAddr)
+	client := stopWatch()
 	if err != nil {
-		log.Printf("DEBUG: Failed to dial %s: %v", targetAddr, err)
-		s.socks5Reply(clientConn, 0x05) // Connection refused
+		log.Printf("DEBUG: Failed to dial %s: %v", dialAddr, err)
+		if !replied {
+			s.socks5Reply(clientConn, 0x05) // Connection refused
+		}
 		return
 	}
 	defer func() { _ = targetConn.Close() }()
 
 	// Success reply
-	s.socks5Reply(clientConn, 0x00)
+	if !replied {
+		s.socks5Reply(clientConn, 0x00)
+	}
 
 	// Bidirectional relay
-	s.relay(clientConn, targetConn)
+	s.relay(client, targetConn)
 }
 
 func (s *Server) relay(client, target net.Conn) {
@@ -94,7 +117,7 @@ func (s *Server) relay(client, target net.Conn) {
 
 	go func() {
 		_, _ = io.Copy(target, client)
-		if tc, ok := target.(*net.TCPConn); ok {
+		if tc, ok := target.(closeWriter); ok {
 			_ = tc.CloseWrite()
 		}
 		done <- struct{}{}
@@ -102,7 +125,7 @@ func (s *Server) relay(client, target net.Conn) {
 
 	go func() {
 		_, _ = io.Copy(client, target)
-		if tc, ok := client.(*net.TCPConn); ok {
+		if tc, ok := client.(closeWriter); ok {
 			_ = tc.CloseWrite()
 		}
 		done <- struct{}{}
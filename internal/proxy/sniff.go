@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Sniffed protocols
+const (
+	SniffTLS  = "tls"
+	SniffHTTP = "http"
+	SniffNone = "none" // No domain found before the timeout
+)
+
+// DefaultSniffTimeout is how long to wait for the first client bytes
+const DefaultSniffTimeout = 300 * time.Millisecond
+
+// maxSniffSize bounds the bytes read ahead (one full TLS record)
+const maxSniffSize = 5 + 16384
+
+var (
+	errNeedMore   = errors.New("need more data")
+	errNotSniffed = errors.New("no domain")
+)
+
+// sniff peeks at the first bytes the client sends for a TLS SNI or an HTTP
+// Host header, waiting at most timeout. The returned connection replays the
+// bytes read, so nothing is consumed.
+func sniff(conn net.Conn, timeout time.Duration) (host, protocol string, c net.Conn) {
+	buf := make([]byte, 0, maxSniffSize)
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	for len(buf) < cap(buf) {
+		n, readErr := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		var err error
+		host, protocol, err = sniffData(buf)
+		if !errors.Is(err, errNeedMore) || readErr != nil {
+			break
+		}
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if host == "" {
+		protocol = SniffNone
+	}
+	if len(buf) > 0 {
+		conn = &prefixConn{Conn: conn, prefix: buf}
+	}
+	return host, protocol, conn
+}
+
+// sniffData looks for a domain in the first client bytes
+func sniffData(data []byte) (host, protocol string, err error) {
+	host, tlsErr := sniffTLS(data)
+	if tlsErr == nil {
+		return host, SniffTLS, nil
+	}
+	host, httpErr := sniffHTTP(data)
+	if httpErr == nil {
+		return host, SniffHTTP, nil
+	}
+	if errors.Is(tlsErr, errNeedMore) || errors.Is(httpErr, errNeedMore) {
+		return "", "", errNeedMore
+	}
+	return "", "", errNotSniffed
+}
+
+// sniffTLS returns the server name of a TLS ClientHello
+func sniffTLS(data []byte) (string, error) {
+	const recordTypeHandshake, typeClientHello = 0x16, 0x01
+
+	// The handshake message may span several records
+	var hs []byte
+	for {
+		if len(data) > 0 && data[0] != recordTypeHandshake || len(data) > 1 && data[1] != 3 {
+			return "", errNotSniffed
+		}
+		if len(data) < 5 {
+			return "", errNeedMore
+		}
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			return "", errNeedMore
+		}
+		hs = append(hs, data[5:5+n]...)
+		data = data[5+n:]
+
+		if len(hs) < 4 {
+			continue
+		}
+		if hs[0] != typeClientHello {
+			return "", errNotSniffed
+		}
+		length := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+		if len(hs) >= 4+length {
+			return serverName(hs[4 : 4+length])
+		}
+	}
+}
+
+// serverName extracts the server_name extension of a ClientHello body
+func serverName(hello []byte) (string, error) {
+	const extServerName, nameTypeHost = 0, 0
+
+	s := cryptobyte.String(hello)
+	var sessionID, suites, compression, exts cryptobyte.String
+	if !s.Skip(2+32) || // version, random
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&suites) ||
+		!s.ReadUint8LengthPrefixed(&compression) ||
+		!s.ReadUint16LengthPrefixed(&exts) {
+		return "", errNotSniffed
+	}
+
+	for !exts.Empty() {
+		var typ uint16
+		var ext cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return "", errNotSniffed
+		}
+		if typ != extServerName {
+			continue
+		}
+
+		var names cryptobyte.String
+		if !ext.ReadUint16LengthPrefixed(&names) {
+			return "", errNotSniffed
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return "", errNotSniffed
+			}
+			if nameType == nameTypeHost {
+				return validDomain(string(name))
+			}
+		}
+	}
+	return "", errNotSniffed
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "), []byte("CONNECT "),
+}
+
+// sniffHTTP returns the Host header of an HTTP/1 request
+func sniffHTTP(data []byte) (string, error) {
+	isHTTP, partial := false, false
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(data, m) {
+			isHTTP = true
+			break
+		}
+		if len(data) < len(m) && bytes.HasPrefix(m, data) {
+			partial = true
+		}
+	}
+	if !isHTTP {
+		if partial {
+			return "", errNeedMore
+		}
+		return "", errNotSniffed
+	}
+
+	headers, _, complete := bytes.Cut(data, []byte("\r\n\r\n"))
+	lines := bytes.Split(headers, []byte("\r\n"))
+	if !complete {
+		lines = lines[:len(lines)-1] // The last line may be cut off
+	}
+	for _, line := range lines[min(1, len(lines)):] {
+		key, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(bytes.TrimSpace(key)), "host") {
+			continue
+		}
+		host := string(bytes.TrimSpace(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return validDomain(host)
+	}
+
+	if complete {
+		return "", errNotSniffed
+	}
+	return "", errNeedMore
+}
+
+// validDomain normalizes a sniffed name; IP literals and junk are rejected
+func validDomain(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" || len(name) > 253 || net.ParseIP(name) != nil {
+		return "", errNotSniffed
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return "", errNotSniffed
+		}
+	}
+	return name, nil
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// clientHello builds a ClientHello handshake message with an SNI of name
+// (none if empty)
+func clientHello(name string) []byte {
+	var body cryptobyte.Builder
+	body.AddUint16(tls.VersionTLS12)
+	body.AddBytes(make([]byte, 32)) // random
+	body.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	body.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint16(tls.TLS_AES_128_GCM_SHA256) })
+	body.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+	body.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		// supported_versions first, so SNI is not the only extension
+		b.AddUint16(43)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint16(tls.VersionTLS13) })
+		})
+		if name == "" {
+			return
+		}
+		b.AddUint16(0) // server_name
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(0) // host_name
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(name)) })
+			})
+		})
+	})
+
+	var hs cryptobyte.Builder
+	hs.AddUint8(1) // client_hello
+	hs.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(body.BytesOrPanic()) })
+	return hs.BytesOrPanic()
+}
+
+// records frames a handshake message in TLS records, cut at the given sizes
+func records(hs []byte, sizes ...int) []byte {
+	var out []byte
+	for len(hs) > 0 {
+		n := len(hs)
+		if len(sizes) > 0 {
+			n, sizes = min(sizes[0], n), sizes[1:]
+		}
+		out = append(out, 0x16, 3, 1, byte(n>>8), byte(n))
+		out = append(out, hs[:n]...)
+		hs = hs[n:]
+	}
+	return out
+}
+
+// ones returns n record sizes of one byte
+func ones(n int) []int {
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = 1
+	}
+	return sizes
+}
+
+// goClientHello returns the first flight of a crypto/tls client
+func goClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		_ = client.Close()
+	}()
+
+	buf := make([]byte, maxSniffSize)
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.ReadAtLeast(server, buf, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for need := 5 + int(buf[3])<<8 | int(buf[4]); n < need; {
+		m, err := server.Read(buf[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	return buf[:n]
+}
+
+func TestSniffTLS(t *testing.T) {
+	hello := clientHello("example.com")
+	full := records(hello)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{"single record", full, "example.com", nil},
+		{"split across records", records(hello, 40), "example.com", nil},
+		{"header split across records", records(hello, 2, 1, 30), "example.com", nil},
+		{"one byte records", records(hello, ones(len(hello))...), "example.com", nil},
+		{"normalized", records(clientHello("WWW.Example.COM.")), "www.example.com", nil},
+		{"crypto/tls client", goClientHello(t, "example.org"), "example.org", nil},
+		{"empty", nil, "", errNeedMore},
+		{"record header only", full[:5], "", errNeedMore},
+		{"truncated record", full[:len(full)-1], "", errNeedMore},
+		{"second record missing", records(hello, 40)[:45], "", errNeedMore},
+		{"ip literal", records(clientHello("192.0.2.1")), "", errNotSniffed},
+		{"ipv6 literal", records(clientHello("2001:db8::1")), "", errNotSniffed},
+		{"no server name", records(clientHello("")), "", errNotSniffed},
+		{"invalid name", records(clientHello("exa mple.com")), "", errNotSniffed},
+		{"application data", append([]byte{0x17}, full[1:]...), "", errNotSniffed},
+		{"not a client hello", records(append([]byte{2}, hello[1:]...)), "", errNotSniffed},
+		{"ssh", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "", errNotSniffed},
+	}
+
+	for _, tt := range tests {
+		got, err := sniffTLS(tt.data)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("%s: sniffTLS = %q, %v; want %q, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSniffHTTP(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr error
+	}{
+		{"host", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", nil},
+		{"host with port", "POST /x HTTP/1.1\r\nUser-Agent: t\r\nhost: Example.com:8080\r\n\r\n", "example.com", nil},
+		{"host line complete", "GET / HTTP/1.1\r\nHost: example.com\r\n", "example.com", nil},
+		{"truncated host line", "GET / HTTP/1.1\r\nHost: exam", "", errNeedMore},
+		{"headers not complete", "GET / HTTP/1.1\r\nAccept: */*\r\n", "", errNeedMore},
+		{"partial method", "GE", "", errNeedMore},
+		{"no host", "GET / HTTP/1.0\r\nAccept: */*\r\n\r\n", "", errNotSniffed},
+		{"ip host", "GET / HTTP/1.1\r\nHost: 192.0.2.1:80\r\n\r\n", "", errNotSniffed},
+		{"ipv6 host", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "", errNotSniffed},
+		{"host in request line only", "GET http://example.com/ HTTP/1.1\r\n\r\n", "", errNotSniffed},
+		{"not http", "SSH-2.0-OpenSSH_9.6\r\n", "", errNotSniffed},
+		{"lowercase method", "get / HTTP/1.1\r\nHost: example.com\r\n\r\n", "", errNotSniffed},
+	}
+
+	for _, tt := range tests {
+		got, err := sniffHTTP([]byte(tt.data))
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("%s: sniffHTTP = %q, %v; want %q, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestValidDomain(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM.", "example.com"},
+		{"_dmarc.example.com", "_dmarc.example.com"},
+		{"xn--80ak6aa92e.com", "xn--80ak6aa92e.com"},
+		{"localhost", "localhost"},
+		{"", ""},
+		{".", ""},
+		{"192.0.2.1", ""},
+		{"2001:db8::1", ""},
+		{"::ffff:192.0.2.1", ""},
+		{"exa mple.com", ""},
+		{"example.com/path", ""},
+		{"exämple.com", ""},
+		{string(bytes.Repeat([]byte("a"), 254)), ""},
+	}
+
+	for _, tt := range tests {
+		got, err := validDomain(tt.name)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("validDomain(%q) = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSniffReplaysData(t *testing.T) {
+	data := records(clientHello("example.com"), 40)
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+
+	go func() {
+		// The ClientHello arrives in two writes
+		_, _ = client.Write(data[:20])
+		time.Sleep(10 * time.Millisecond)
+		_, _ = client.Write(data[20:])
+		_, _ = client.Write([]byte("rest"))
+	}()
+
+	host, protocol, conn := sniff(server, time.Second)
+	if host != "example.com" || protocol != SniffTLS {
+		t.Fatalf("sniff = %q, %q; want example.com, tls", host, protocol)
+	}
+	got := make([]byte, len(data)+4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(data, "rest"...)) {
+		t.Fatal("replayed bytes differ")
+	}
+}
+
+func TestSniffTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+
+	start := time.Now()
+	host, protocol, _ := sniff(server, 50*time.Millisecond)
+	if host != "" || protocol != SniffNone {
+		t.Fatalf("sniff = %q, %q; want none", host, protocol)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("sniff waited %v", d)
+	}
+}
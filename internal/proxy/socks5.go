@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -14,43 +16,72 @@ const (
 	atypIPv4      = 0x01
 	atypDomain    = 0x03
 	atypIPv6      = 0x04
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+	userPassVersion    = 0x01 // RFC 1929
 )
 
-// socks5Handshake performs SOCKS5 handshake and returns target address
-func (s *Server) socks5Handshake(conn net.Conn) (string, error) {
+// SetAuth requires SOCKS5 clients to log in with one of the users
+// (username to password, RFC 1929). No users: no authentication.
+func (s *Server) SetAuth(users map[string]string) {
+	s.users = users
+}
+
+// socks5Handshake performs SOCKS5 handshake and returns the target address
+// and the authenticated user (empty without authentication)
+func (s *Server) socks5Handshake(conn net.Conn) (string, string, error) {
 	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
 	defer func() { _ = conn.SetDeadline(time.Time{}) }()
 
 	// Read: VER | NMETHODS | METHODS
 	buf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		return "", fmt.Errorf("read version: %w", err)
+		return "", "", fmt.Errorf("read version: %w", err)
 	}
 
 	if buf[0] != socks5Version {
-		return "", fmt.Errorf("unsupported SOCKS version: %d", buf[0])
+		return "", "", fmt.Errorf("unsupported SOCKS version: %d", buf[0])
 	}
 
 	nMethods := int(buf[1])
 	methods := make([]byte, nMethods)
 	if _, err := io.ReadFull(conn, methods); err != nil {
-		return "", fmt.Errorf("read methods: %w", err)
+		return "", "", fmt.Errorf("read methods: %w", err)
 	}
 
-	// Reply: VER | METHOD (no auth required)
-	if _, err := conn.Write([]byte{socks5Version, 0x00}); err != nil {
-		return "", fmt.Errorf("write method: %w", err)
+	// Reply: VER | METHOD. Without users every client is accepted without
+	// authentication, whatever methods it offers.
+	method := byte(methodNoAuth)
+	if len(s.users) > 0 {
+		method = methodUserPass
+		if !bytes.Contains(methods, []byte{method}) {
+			_, _ = conn.Write([]byte{socks5Version, methodNoAcceptable})
+			return "", "", fmt.Errorf("no acceptable auth method (offered %x)", methods)
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", "", fmt.Errorf("write method: %w", err)
+	}
+
+	var user string
+	if method == methodUserPass {
+		var err error
+		if user, err = s.socks5Auth(conn); err != nil {
+			return "", "", fmt.Errorf("auth: %w", err)
+		}
 	}
 
 	// Read: VER | CMD | RSV | ATYP | DST.ADDR | DST.PORT
 	buf = make([]byte, 4)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		return "", fmt.Errorf("read request: %w", err)
+		return "", "", fmt.Errorf("read request: %w", err)
 	}
 
 	if buf[1] != cmdConnect {
 		s.socks5Reply(conn, 0x07) // Command not supported
-		return "", fmt.Errorf("unsupported command: %d", buf[1])
+		return "", "", fmt.Errorf("unsupported command: %d", buf[1])
 	}
 
 	var host string
@@ -58,41 +89,76 @@ func (s *Server) socks5Handshake(conn net.Conn) (string, error) {
 	case atypIPv4:
 		ip := make([]byte, 4)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return "", fmt.Errorf("read IPv4: %w", err)
+			return "", "", fmt.Errorf("read IPv4: %w", err)
 		}
 		host = net.IP(ip).String()
 
 	case atypDomain:
 		lenBuf := make([]byte, 1)
 		if _, err := io.ReadFull(conn, lenBuf); err != nil {
-			return "", fmt.Errorf("read domain length: %w", err)
+			return "", "", fmt.Errorf("read domain length: %w", err)
 		}
 		domain := make([]byte, lenBuf[0])
 		if _, err := io.ReadFull(conn, domain); err != nil {
-			return "", fmt.Errorf("read domain: %w", err)
+			return "", "", fmt.Errorf("read domain: %w", err)
 		}
 		host = string(domain)
 
 	case atypIPv6:
 		ip := make([]byte, 16)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return "", fmt.Errorf("read IPv6: %w", err)
+			return "", "", fmt.Errorf("read IPv6: %w", err)
 		}
 		host = net.IP(ip).String()
 
 	default:
 		s.socks5Reply(conn, 0x08) // Address type not supported
-		return "", fmt.Errorf("unsupported address type: %d", buf[3])
+		return "", "", fmt.Errorf("unsupported address type: %d", buf[3])
 	}
 
 	// Read port
 	portBuf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, portBuf); err != nil {
-		return "", fmt.Errorf("read port: %w", err)
+		return "", "", fmt.Errorf("read port: %w", err)
 	}
 	port := binary.BigEndian.Uint16(portBuf)
 
-	return fmt.Sprintf("%s:%d", host, port), nil
+	return fmt.Sprintf("%s:%d", host, port), user, nil
+}
+
+// socks5Auth performs the username/password subnegotiation (RFC 1929)
+// and returns the user
+func (s *Server) socks5Auth(conn net.Conn) (string, error) {
+	// Read: VER | ULEN | UNAME | PLEN | PASSWD
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", fmt.Errorf("read version: %w", err)
+	}
+	if buf[0] != userPassVersion {
+		return "", fmt.Errorf("unsupported version: %d", buf[0])
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", fmt.Errorf("read username: %w", err)
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return "", fmt.Errorf("read password length: %w", err)
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", fmt.Errorf("read password: %w", err)
+	}
+
+	// Reply: VER | STATUS (0 = success)
+	want, ok := s.users[string(user)]
+	if !ok || subtle.ConstantTimeCompare(password, []byte(want)) != 1 {
+		_, _ = conn.Write([]byte{userPassVersion, 0x01})
+		return "", fmt.Errorf("invalid credentials for user %q", user)
+	}
+	if _, err := conn.Write([]byte{userPassVersion, 0x00}); err != nil {
+		return "", fmt.Errorf("write status: %w", err)
+	}
+	return string(user), nil
 }
 
 // socks5Reply sends SOCKS5 reply
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// scriptConn replays what a client sends and records the replies
+type scriptConn struct {
+	net.Conn
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func (c *scriptConn) Read(b []byte) (int, error)       { return c.in.Read(b) }
+func (c *scriptConn) Write(b []byte) (int, error)      { return c.out.Write(b) }
+func (c *scriptConn) SetDeadline(time.Time) error      { return nil }
+func (c *scriptConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *scriptConn) SetWriteDeadline(time.Time) error { return nil }
+
+// login is an RFC 1929 username/password request
+func login(user, password string) []byte {
+	b := []byte{userPassVersion, byte(len(user))}
+	b = append(b, user...)
+	b = append(b, byte(len(password)))
+	return append(b, password...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestSocks5Handshake(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+	connect := []byte{socks5Version, cmdConnect, 0, atypDomain, 9, 'a', '.', 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x01, 0xBB}
+
+	tests := []struct {
+		name    string
+		users   map[string]string
+		in      []byte
+		target  string
+		user    string
+		reply   []byte // Bytes the server writes
+		wantErr bool
+	}{
+		{
+			name:   "no auth",
+			in:     join([]byte{socks5Version, 1, methodNoAuth}, connect),
+			target: "a.example:443",
+			reply:  []byte{socks5Version, methodNoAuth},
+		},
+		{
+			// Without users the client is accepted whatever it offers
+			name:   "no auth, client offers user/pass only",
+			in:     join([]byte{socks5Version, 1, methodUserPass}, connect),
+			target: "a.example:443",
+			reply:  []byte{socks5Version, methodNoAuth},
+		},
+		{
+			name:   "no auth, no methods offered",
+			in:     join([]byte{socks5Version, 0}, connect),
+			target: "a.example:443",
+			reply:  []byte{socks5Version, methodNoAuth},
+		},
+		{
+			name:   "user/pass",
+			users:  users,
+			in:     join([]byte{socks5Version, 2, methodNoAuth, methodUserPass}, login("alice", "secret"), connect),
+			target: "a.example:443",
+			user:   "alice",
+			reply:  []byte{socks5Version, methodUserPass, userPassVersion, 0x00},
+		},
+		{
+			name:    "user/pass, wrong password",
+			users:   users,
+			in:      join([]byte{socks5Version, 1, methodUserPass}, login("alice", "guess"), connect),
+			reply:   []byte{socks5Version, methodUserPass, userPassVersion, 0x01},
+			wantErr: true,
+		},
+		{
+			name:    "user/pass, unknown user",
+			users:   users,
+			in:      join([]byte{socks5Version, 1, methodUserPass}, login("bob", "secret"), connect),
+			reply:   []byte{socks5Version, methodUserPass, userPassVersion, 0x01},
+			wantErr: true,
+		},
+		{
+			name:    "user/pass not offered",
+			users:   users,
+			in:      join([]byte{socks5Version, 1, methodNoAuth}, connect),
+			reply:   []byte{socks5Version, methodNoAcceptable},
+			wantErr: true,
+		},
+		{
+			name:   "IPv4 target",
+			in:     []byte{socks5Version, 1, methodNoAuth, socks5Version, cmdConnect, 0, atypIPv4, 192, 0, 2, 1, 0, 80},
+			target: "192.0.2.1:80",
+			reply:  []byte{socks5Version, methodNoAuth},
+		},
+		{
+			name:    "unsupported version",
+			in:      []byte{0x04, 1, methodNoAuth},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported command",
+			in:      []byte{socks5Version, 1, methodNoAuth, socks5Version, 0x02, 0, atypIPv4, 192, 0, 2, 1, 0, 80},
+			reply:   []byte{socks5Version, methodNoAuth, socks5Version, 0x07, 0, atypIPv4, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported address type",
+			in:      []byte{socks5Version, 1, methodNoAuth, socks5Version, cmdConnect, 0, 0x05},
+			reply:   []byte{socks5Version, methodNoAuth, socks5Version, 0x08, 0, atypIPv4, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "truncated request",
+			in:      []byte{socks5Version, 1, methodNoAuth, socks5Version, cmdConnect, 0, atypIPv4, 192, 0},
+			reply:   []byte{socks5Version, methodNoAuth},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		s := &Server{}
+		s.SetAuth(tt.users)
+		conn := &scriptConn{in: bytes.NewReader(tt.in)}
+
+		target, user, err := s.socks5Handshake(conn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if target != tt.target || user != tt.user {
+			t.Errorf("%s: target %q, user %q, want %q, %q", tt.name, target, user, tt.target, tt.user)
+		}
+		if !bytes.Equal(conn.out.Bytes(), tt.reply) {
+			t.Errorf("%s: replies %x, want %x", tt.name, conn.out.Bytes(), tt.reply)
+		}
+	}
+}
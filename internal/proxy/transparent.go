@@ -28,6 +28,7 @@ type TransparentServer struct {
 	listener net.Listener
 	router   *router.Router
 	metrics  *metrics.Metrics
+	targetInspector
 
 	conns   map[net.Conn]struct{}
 	connsMu sync.Mutex
@@ -46,12 +47,13 @@ func NewTransparent(addr string, r *router.Router, m *metrics.Metrics) (*Transpa
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &TransparentServer{
-		listener: listener,
-		router:   r,
-		metrics:  m,
-		conns:    make(map[net.Conn]struct{}),
-		ctx:      ctx,
-		cancel:   cancel,
+		listener:        listener,
+		router:          r,
+		metrics:         m,
+		conns:           make(map[net.Conn]struct{}),
+		targetInspector: targetInspector{metrics: m},
+		ctx:             ctx,
+		cancel:          cancel,
 	}, nil
 }
 
@@ -87,18 +89,27 @@ func (s *TransparentServer) handleConnection(clientConn net.Conn) {
 		return
 	}
 
-	log.Printf("DEBUG: Transparent proxy: %s -> %s", clientConn.RemoteAddr(), targetAddr)
+	// Recover the hostname from the DNS server or the first client bytes
+	host, dialAddr, conn := s.inspect(clientConn, targetAddr, nil)
+	if host != "" {
+		log.Printf("DEBUG: Transparent proxy: %s -> %s (%s)", clientConn.RemoteAddr(), targetAddr, host)
+	} else {
+		log.Printf("DEBUG: Transparent proxy: %s -> %s", clientConn.RemoteAddr(), targetAddr)
+	}
+	meta := &router.Metadata{Source: clientConn.RemoteAddr(), Host: host}
 
-	// Dial target through router (uses current mode: direct/warp/home)
-	targetConn, err := s.router.Dial("tcp", targetAddr)
+	// Dial target through router; cancelled if the client leaves or on shutdown
+	dialCtx, stopWatch := watchClient(s.ctx, conn)
+	targetConn, err := s.router.DialContext(dialCtx, meta, "tcp", dialAddr)
+	client := stopWatch()
 	if err != nil {
-		log.Printf("ERROR: Failed to dial %s: %v", targetAddr, err)
+		log.Printf("ERROR: Failed to dial %s: %v", dialAddr, err)
 		return
 	}
 	defer func() { _ = targetConn.Close() }()
 
 	// Bidirectional relay
-	s.relay(clientConn, targetConn)
+	s.relay(client, targetConn)
 }
 
 func (s *TransparentServer) relay(client, target net.Conn) {
@@ -106,7 +117,7 @@ func (s *TransparentServer) relay(client, target net.Conn) {
 
 	go func() {
 		_, _ = io.Copy(target, client)
-		if tc, ok := target.(*net.TCPConn); ok {
+		if tc, ok := target.(closeWriter); ok {
 			_ = tc.CloseWrite()
 		}
 		done <- struct{}{}
@@ -114,7 +125,7 @@ func (s *TransparentServer) relay(client, target net.Conn) {
 
 	go func() {
 		_, _ = io.Copy(client, target)
-		if tc, ok := client.(*net.TCPConn); ok {
+		if tc, ok := client.(closeWriter); ok {
 			_ = tc.CloseWrite()
 		}
 		done <- struct{}{}
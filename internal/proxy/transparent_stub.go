@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/scinfra-pro/switch-gate/internal/config"
 	"github.com/scinfra-pro/switch-gate/internal/metrics"
 	"github.com/scinfra-pro/switch-gate/internal/router"
 )
@@ -18,6 +19,12 @@ func NewTransparent(_ string, _ *router.Router, _ *metrics.Metrics) (*Transparen
 	return nil, fmt.Errorf("transparent proxy is only supported on Linux")
 }
 
+// SetHostLookup is a no-op on non-Linux platforms
+func (s *TransparentServer) SetHostLookup(_ HostLookup) {}
+
+// SetSniffing is a no-op on non-Linux platforms
+func (s *TransparentServer) SetSniffing(_ config.SniffConfig) {}
+
 // Serve returns an error on non-Linux platforms
 func (s *TransparentServer) Serve() error {
 	return fmt.Errorf("transparent proxy is only supported on Linux")
@@ -0,0 +1,341 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// maxMessageSize is the largest DNS message accepted
+const maxMessageSize = 65535
+
+// errTruncated reports a UDP answer that does not fit (retry over TCP)
+var errTruncated = errors.New("truncated DNS response")
+
+// transport exchanges one DNS message with a server
+type transport interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+func newTransport(cfg config.ResolverConfig, dial DialFunc) (transport, error) {
+	switch cfg.Type {
+	case TypeUDP:
+		addr := withDefaultPort(cfg.Server, "53")
+		return &udpTransport{addr: addr, dial: dial, fallback: &streamTransport{addr: addr, dial: dial}}, nil
+	case TypeTCP:
+		return &streamTransport{addr: withDefaultPort(cfg.Server, "53"), dial: dial}, nil
+	case TypeDoT:
+		addr := withDefaultPort(cfg.Server, "853")
+		serverName := cfg.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(addr)
+		}
+		return &streamTransport{
+			addr: addr,
+			dial: dial,
+			tls:  &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12},
+		}, nil
+	case TypeDoH:
+		u, err := url.Parse(cfg.Server)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("doh resolver: server must be an https:// URL")
+		}
+		return newHTTPSTransport(u.String(), cfg.ServerName, dial), nil
+	default:
+		return nil, fmt.Errorf("unknown resolver type %q", cfg.Type)
+	}
+}
+
+// withDefaultPort appends port to a server address without one
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// udpTransport sends queries over UDP, falling back to TCP for truncated answers
+type udpTransport struct {
+	addr     string
+	dial     DialFunc
+	fallback transport
+}
+
+func (t *udpTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	resp, err := t.exchangeUDP(ctx, query)
+	if errors.Is(err, errTruncated) {
+		return t.fallback.exchange(ctx, query)
+	}
+	return resp, err
+}
+
+func (t *udpTransport) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := t.dial(ctx, "udp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	setDeadline(ctx, conn)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams with another ID
+		if n < 12 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		if buf[2]&0x02 != 0 { // TC bit
+			return nil, errTruncated
+		}
+		return buf[:n], nil
+	}
+}
+
+// streamTransport sends length-prefixed queries over TCP, optionally with TLS
+type streamTransport struct {
+	addr string
+	dial DialFunc
+	tls  *tls.Config // nil for plain TCP
+}
+
+func (t *streamTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := t.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	setDeadline(ctx, conn)
+
+	if t.tls != nil {
+		tlsConn := tls.Client(conn, t.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("TLS handshake with %s: %w", t.addr, err)
+		}
+		conn = tlsConn
+	}
+
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	msg = append(msg, query...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// httpsTransport posts queries to a DoH server
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSTransport(serverURL, serverName string, dial DialFunc) *httpsTransport {
+	tr := &http.Transport{
+		DialContext:       dial,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+	if serverName != "" {
+		tr.TLSClientConfig = &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	}
+	return &httpsTransport{url: serverURL, client: &http.Client{Transport: tr}}
+}
+
+func (t *httpsTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+}
+
+// setDeadline applies the context deadline to a connection
+func setDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+}
+
+// client resolves names with A and AAAA queries over a transport
+type client struct {
+	transport transport
+	timeout   time.Duration
+}
+
+// lookup returns the IPv4 then IPv6 addresses of host and the smallest TTL
+func (c *client) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid host %q: %w", host, err)
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]chan result, len(qtypes))
+	for i, qtype := range qtypes {
+		results[i] = make(chan result, 1)
+		go func() {
+			ips, ttl, err := c.query(ctx, name, qtype)
+			results[i] <- result{ips, ttl, err}
+		}()
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var errs []error
+	for _, ch := range results {
+		r := <-ch
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		if len(r.ips) > 0 && (ttl == 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+		ips = append(ips, r.ips...)
+	}
+
+	if len(ips) == 0 {
+		if len(errs) > 0 {
+			return nil, 0, fmt.Errorf("lookup %s: %w", host, errors.Join(errs...))
+		}
+		return nil, 0, fmt.Errorf("lookup %s: no such host", host)
+	}
+	return ips, ttl, nil
+}
+
+// query sends one question and returns the matching addresses in the answer
+func (c *client) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	id := uint16(rand.Uint32())
+	if _, ok := c.transport.(*httpsTransport); ok {
+		id = 0 // RFC 8484: cache friendly
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 2, 512), dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+	query = query[2:]
+
+	resp, err := c.transport.exchange(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseAnswer(resp, id, qtype)
+}
+
+// parseAnswer extracts the addresses of qtype from a response
+func parseAnswer(resp []byte, id uint16, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse DNS response: %w", err)
+	}
+	if h.ID != id {
+		return nil, 0, fmt.Errorf("DNS response ID mismatch")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, nil // NXDOMAIN: no addresses
+	default:
+		return nil, 0, fmt.Errorf("DNS server returned %s", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for {
+		ah, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if ah.Type != qtype || ah.Class != dnsmessage.ClassINET {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		switch qtype {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		}
+		if len(ips) == 1 || ah.TTL < ttl {
+			ttl = ah.TTL
+		}
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
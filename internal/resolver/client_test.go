@@ -0,0 +1,322 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Names of the test zone
+const (
+	testHost      = "example.com"
+	testTruncated = "big.example.com" // Truncated over UDP
+	testMissing   = "missing.example.com"
+)
+
+var (
+	testA    = net.IPv4(192, 0, 2, 1).To4()
+	testAAAA = net.ParseIP("2001:db8::1")
+)
+
+// dnsStandIn is a local DNS server over UDP and TCP on the same port
+type dnsStandIn struct {
+	addr  string
+	ttl   uint32
+	delay time.Duration
+
+	udpQueries atomic.Int32
+	tcpQueries atomic.Int32
+}
+
+func newDNSStandIn(t *testing.T, ttl uint32) *dnsStandIn {
+	t.Helper()
+	s := &dnsStandIn{ttl: ttl}
+
+	// UDP on the port the TCP listener got; retry if it is taken
+	for i := 0; ; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := net.ListenPacket("udp", ln.Addr().String())
+		if err != nil {
+			_ = ln.Close()
+			if i < 10 {
+				continue
+			}
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = ln.Close()
+			_ = pc.Close()
+		})
+		s.addr = ln.Addr().String()
+		go s.serveUDP(pc)
+		go s.serveTCP(ln)
+		return s
+	}
+}
+
+func (s *dnsStandIn) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			s.udpQueries.Add(1)
+			if resp := s.answer(query, true); resp != nil {
+				_, _ = pc.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+func (s *dnsStandIn) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			s.tcpQueries.Add(1)
+			resp := s.answer(query, false)
+			msg := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+			_, _ = conn.Write(append(msg, resp...))
+		}()
+	}
+}
+
+// answer builds the response to a query
+func (s *dnsStandIn) answer(query []byte, udp bool) []byte {
+	time.Sleep(s.delay)
+
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	name := q.Name.String()
+	resp := dnsmessage.Header{ID: h.ID, Response: true, RecursionDesired: h.RecursionDesired}
+	switch {
+	case name == testMissing+".":
+		resp.RCode = dnsmessage.RCodeNameError
+	case name == testTruncated+"." && udp:
+		resp.Truncated = true
+	}
+
+	b := dnsmessage.NewBuilder(nil, resp)
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	_ = b.StartAnswers()
+	if !resp.Truncated && resp.RCode == dnsmessage.RCodeSuccess {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+		switch q.Type {
+		case dnsmessage.TypeA:
+			var a dnsmessage.AResource
+			copy(a.A[:], testA)
+			_ = b.AResource(rh, a)
+		case dnsmessage.TypeAAAA:
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], testAAAA)
+			_ = b.AAAAResource(rh, aaaa)
+		}
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+var testDialer = (&net.Dialer{}).DialContext
+
+// wantAddrs checks the addresses of the test zone: IPv4 first
+func wantAddrs(t *testing.T, ips []net.IP) {
+	t.Helper()
+	if len(ips) != 2 || !ips[0].Equal(testA) || !ips[1].Equal(testAAAA) {
+		t.Fatalf("ips = %v, want [%v %v]", ips, testA, testAAAA)
+	}
+}
+
+func TestClientUDP(t *testing.T) {
+	s := newDNSStandIn(t, 300)
+	udp := &udpTransport{addr: s.addr, dial: testDialer, fallback: &streamTransport{addr: s.addr, dial: testDialer}}
+	c := &client{transport: udp, timeout: DefaultTimeout}
+
+	ips, ttl, err := c.lookup(context.Background(), testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAddrs(t, ips)
+	if ttl != 300*time.Second {
+		t.Errorf("ttl = %v, want 5m", ttl)
+	}
+	if got := s.tcpQueries.Load(); got != 0 {
+		t.Errorf("%d TCP queries, want none", got)
+	}
+
+	if _, _, err := c.lookup(context.Background(), testMissing); err == nil {
+		t.Error("lookup of a missing host succeeded")
+	}
+}
+
+func TestClientUDPTruncated(t *testing.T) {
+	s := newDNSStandIn(t, 300)
+	udp := &udpTransport{addr: s.addr, dial: testDialer, fallback: &streamTransport{addr: s.addr, dial: testDialer}}
+	c := &client{transport: udp, timeout: DefaultTimeout}
+
+	ips, _, err := c.lookup(context.Background(), testTruncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAddrs(t, ips)
+	if udp, tcp := s.udpQueries.Load(), s.tcpQueries.Load(); udp != 2 || tcp != 2 {
+		t.Errorf("%d UDP and %d TCP queries, want 2 each", udp, tcp)
+	}
+}
+
+func TestClientDoH(t *testing.T) {
+	s := &dnsStandIn{ttl: 300}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		if len(query) < 2 || query[0] != 0 || query[1] != 0 {
+			http.Error(w, "query ID must be 0", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(s.answer(query, false))
+	}))
+	defer srv.Close()
+
+	doh := newHTTPSTransport(srv.URL, "", testDialer)
+	doh.client.Transport.(*http.Transport).TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	c := &client{transport: doh, timeout: DefaultTimeout}
+
+	ips, _, err := c.lookup(context.Background(), testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAddrs(t, ips)
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	tests := []struct {
+		ttl  uint32
+		want time.Duration
+	}{
+		{300, 300 * time.Second},
+		{1, minCacheTTL},
+		{86400, maxCacheTTL},
+	}
+	for _, tt := range tests {
+		s := newDNSStandIn(t, tt.ttl)
+		r := newCachingResolver(&client{transport: &streamTransport{addr: s.addr, dial: testDialer}, timeout: DefaultTimeout})
+
+		before := time.Now()
+		ips, err := r.LookupIP(context.Background(), testHost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantAddrs(t, ips)
+		e := r.cache[testHost]
+		if ttl := e.expires.Sub(before); ttl < tt.want || ttl > tt.want+time.Second {
+			t.Errorf("TTL %d: cached for %v, want %v", tt.ttl, ttl, tt.want)
+		}
+
+		// Cached until it expires
+		if _, err := r.LookupIP(context.Background(), testHost); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.tcpQueries.Load(); got != 2 {
+			t.Errorf("TTL %d: %d queries while cached, want 2", tt.ttl, got)
+		}
+
+		r.mu.Lock()
+		e.expires = time.Now().Add(-time.Second)
+		r.cache[testHost] = e
+		r.mu.Unlock()
+		if _, err := r.LookupIP(context.Background(), testHost); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.tcpQueries.Load(); got != 4 {
+			t.Errorf("TTL %d: %d queries after expiry, want 4", tt.ttl, got)
+		}
+	}
+}
+
+func TestCachingResolverCoalesces(t *testing.T) {
+	s := newDNSStandIn(t, 300)
+	s.delay = 100 * time.Millisecond
+	r := newCachingResolver(&client{transport: &streamTransport{addr: s.addr, dial: testDialer}, timeout: DefaultTimeout})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := r.LookupIP(context.Background(), testHost)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			wantAddrs(t, ips)
+		}()
+	}
+	wg.Wait()
+
+	if got := s.tcpQueries.Load(); got != 2 {
+		t.Errorf("%d queries for 10 concurrent lookups, want 2 (A and AAAA)", got)
+	}
+}
+
+func TestCachingResolverCancelledCaller(t *testing.T) {
+	s := newDNSStandIn(t, 300)
+	s.delay = 200 * time.Millisecond
+	r := newCachingResolver(&client{transport: &streamTransport{addr: s.addr, dial: testDialer}, timeout: DefaultTimeout})
+
+	// The first caller gives up, the second still gets the shared answer
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.LookupIP(ctx, testHost)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ips, err := r.LookupIP(context.Background(), testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAddrs(t, ips)
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("cancelled caller: err = %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Package resolver resolves domain names for routing modes: with the system
+// resolver, or with a DNS server over UDP, TCP, TLS (DoT) or HTTPS (DoH)
+// reached through the mode's own dialer.
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// Resolver types
+const (
+	TypeSystem = "system" // Host resolver
+	TypeUDP    = "udp"    // DNS server over UDP (TCP on truncation)
+	TypeTCP    = "tcp"    // DNS server over TCP
+	TypeDoT    = "dot"    // DNS over TLS (RFC 7858)
+	TypeDoH    = "doh"    // DNS over HTTPS (RFC 8484)
+	TypeRemote = "remote" // No local resolution, the upstream resolves
+)
+
+// DefaultTimeout bounds a single lookup
+const DefaultTimeout = 5 * time.Second
+
+// DialFunc dials a connection, typically through a mode's dialer
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Resolver looks up the addresses of a host
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// New creates the resolver described by cfg. Queries to the DNS server
+// are sent through dial. Returns nil for the remote type.
+func New(cfg config.ResolverConfig, dial DialFunc) (Resolver, error) {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	switch cfg.Type {
+	case TypeRemote:
+		return nil, nil
+	case TypeSystem:
+		return &systemResolver{timeout: timeout}, nil
+	case TypeUDP, TypeTCP, TypeDoT, TypeDoH:
+		if cfg.Server == "" {
+			return nil, fmt.Errorf("%s resolver: server is not configured", cfg.Type)
+		}
+		t, err := newTransport(cfg, dial)
+		if err != nil {
+			return nil, err
+		}
+		return newCachingResolver(&client{transport: t, timeout: timeout}), nil
+	default:
+		return nil, fmt.Errorf("unknown resolver type %q", cfg.Type)
+	}
+}
+
+// Exchanger forwards raw DNS messages to a server
+type Exchanger interface {
+	Exchange(ctx context.Context, msg []byte) ([]byte, error)
+}
+
+// NewExchanger creates an exchanger for the udp, tcp, dot or doh server of cfg.
+// Messages are sent through dial.
+func NewExchanger(cfg config.ResolverConfig, dial DialFunc) (Exchanger, error) {
+	if cfg.Server == "" {
+		return nil, fmt.Errorf("%s resolver: server is not configured", cfg.Type)
+	}
+	t, err := newTransport(cfg, dial)
+	if err != nil {
+		return nil, err
+	}
+	return exchanger{t}, nil
+}
+
+type exchanger struct {
+	transport transport
+}
+
+func (e exchanger) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	return e.transport.exchange(ctx, msg)
+}
+
+// systemResolver uses the host resolver
+type systemResolver struct {
+	timeout time.Duration
+}
+
+func (r *systemResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+// Cache bounds
+const (
+	maxCacheEntries = 4096
+	minCacheTTL     = 10 * time.Second
+	maxCacheTTL     = time.Hour
+)
+
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// cachingResolver keeps answers of a DNS client for their TTL. Concurrent
+// lookups of the same host share one query.
+type cachingResolver struct {
+	client   *client
+	inflight singleflight.Group
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+func newCachingResolver(c *client) *cachingResolver {
+	return &cachingResolver{client: c, cache: make(map[string]cacheEntry)}
+}
+
+func (r *cachingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	e, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ips, nil
+	}
+
+	// The shared query outlives a cancelled caller, bounded by the client timeout
+	ch := r.inflight.DoChan(host, func() (any, error) {
+		return r.lookup(context.WithoutCancel(ctx), host)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]net.IP), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookup queries the client and caches the answer
+func (r *cachingResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	ips, ttl, err := r.client.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ttl = min(max(ttl, minCacheTTL), maxCacheTTL)
+	now := time.Now()
+
+	r.mu.Lock()
+	if len(r.cache) >= maxCacheEntries {
+		for h, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, h)
+			}
+		}
+		if len(r.cache) >= maxCacheEntries {
+			clear(r.cache)
+		}
+	}
+	r.cache[host] = cacheEntry{ips: ips, expires: now.Add(ttl)}
+	r.mu.Unlock()
+
+	return ips, nil
+}
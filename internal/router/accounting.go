@@ -0,0 +1,438 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// Client identities of the accounting
+const (
+	ClientKeyIP    = "ip"    // Source IP
+	ClientKeyGroup = "group" // Client group, else source IP
+	ClientKeyUser  = "user"  // Authenticated SOCKS5 user, else source IP
+)
+
+// Accounting defaults
+const (
+	DefaultMaxClients  = 50             // Clients with their own metric series
+	ClientOther        = "other"        // Metric label of the clients beyond them
+	DefaultIdleTimeout = 24 * time.Hour // Idle clients are dropped after this long
+)
+
+// clientUsage is the traffic of a client through one mode
+type clientUsage struct {
+	total  atomic.Uint64 // Lifetime
+	period atomic.Uint64 // In the accounting period
+	quota  uint64        // Bytes per accounting period, 0 = unlimited
+	gate   *quotaGate    // Cuts the client's flows at the quota (nil: unlimited)
+}
+
+func (u *clientUsage) add(n int) {
+	if u == nil || n <= 0 {
+		return
+	}
+	u.total.Add(uint64(n))
+	u.period.Add(uint64(n))
+}
+
+// exhausted reports whether the quota of the period is used up
+func (u *clientUsage) exhausted() bool {
+	return u.quota > 0 && u.period.Load() >= u.quota
+}
+
+// sync sets the gate from the usage of the period
+func (u *clientUsage) sync() {
+	if u.gate == nil {
+		return
+	}
+	remaining := int64(min(u.quota, math.MaxInt64/2)) - int64(min(u.period.Load(), math.MaxInt64/2))
+	u.gate.remaining.Store(remaining)
+	u.gate.closing.Store(remaining <= 0)
+}
+
+// clientAccount is the traffic of a client
+type clientAccount struct {
+	label    string // Metric label: the name, or ClientOther
+	modes    map[Mode]*clientUsage
+	conns    int // Open connections
+	lastSeen time.Time
+}
+
+// inQuota reports whether the client used a quota in the period, which
+// its account must keep until the period ends
+func (c *clientAccount) inQuota() bool {
+	for _, u := range c.modes {
+		if u.quota > 0 && u.period.Load() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// accounting counts the traffic of every client per mode and enforces
+// per-client quotas. Quotas reset with the accounting period. Accounts of
+// idle clients are dropped; their traffic is kept in other.
+type accounting struct {
+	key         string
+	maxClients  int
+	idleTimeout time.Duration
+	quotas      map[Mode]uint64            // Default per client
+	overrides   map[string]map[Mode]uint64 // By client
+
+	mu      sync.Mutex
+	clients map[string]*clientAccount
+	labeled int             // Clients with their own label
+	other   map[Mode]uint64 // Lifetime traffic of dropped clients
+}
+
+func newAccounting(cfg config.AccountingConfig, registry *Registry) (*accounting, error) {
+	a := &accounting{
+		key:         cfg.Key,
+		maxClients:  cfg.MaxClients,
+		idleTimeout: cfg.IdleTimeout,
+		overrides:   make(map[string]map[Mode]uint64),
+		clients:     make(map[string]*clientAccount),
+		other:       make(map[Mode]uint64),
+	}
+	switch a.key {
+	case "":
+		a.key = ClientKeyIP
+	case ClientKeyIP, ClientKeyGroup, ClientKeyUser:
+	default:
+		return nil, fmt.Errorf("unknown key %q (ip, group, user)", cfg.Key)
+	}
+	switch {
+	case a.maxClients < 0:
+		return nil, fmt.Errorf("invalid max_clients: %d", cfg.MaxClients)
+	case a.maxClients == 0:
+		a.maxClients = DefaultMaxClients
+	}
+	switch {
+	case a.idleTimeout < 0:
+		return nil, fmt.Errorf("invalid idle_timeout: %v", cfg.IdleTimeout)
+	case a.idleTimeout == 0:
+		a.idleTimeout = DefaultIdleTimeout
+	}
+
+	var err error
+	if a.quotas, err = parseQuotas(cfg.Quotas, registry); err != nil {
+		return nil, err
+	}
+	for name, quotas := range cfg.Clients {
+		if a.overrides[name], err = parseQuotas(quotas, registry); err != nil {
+			return nil, fmt.Errorf("client %s: %w", name, err)
+		}
+	}
+	return a, nil
+}
+
+// parseQuotas converts quotas in MB per mode name to bytes per mode
+func parseQuotas(cfg map[string]int, registry *Registry) (map[Mode]uint64, error) {
+	quotas := make(map[Mode]uint64, len(cfg))
+	for name, mb := range cfg {
+		if !registry.Has(Mode(name)) {
+			return nil, fmt.Errorf("quota for unknown mode: %s", name)
+		}
+		if mb < 0 {
+			return nil, fmt.Errorf("%s: invalid quota: %d", name, mb)
+		}
+		quotas[Mode(name)] = uint64(mb) * 1024 * 1024
+	}
+	return quotas, nil
+}
+
+// identify returns the name a client is accounted under
+func (a *accounting) identify(meta *Metadata, group *ClientGroup) string {
+	switch {
+	case a.key == ClientKeyUser && meta != nil && meta.User != "":
+		return meta.User
+	case a.key == ClientKeyGroup && group != nil:
+		return group.Name
+	}
+	if ip := meta.sourceIP(); ip != nil {
+		return ip.String()
+	}
+	return "unknown"
+}
+
+// accountLocked returns the account of a client, creating it if needed.
+// Configured clients and the first maxClients others get their own label.
+// Accounts are only created for connections that were established.
+func (a *accounting) accountLocked(name string) *clientAccount {
+	c, ok := a.clients[name]
+	if ok {
+		return c
+	}
+	c = &clientAccount{label: ClientOther, modes: make(map[Mode]*clientUsage)}
+	if _, configured := a.overrides[name]; configured || a.labeled < a.maxClients {
+		c.label = name
+		a.labeled++
+	}
+	a.clients[name] = c
+	return c
+}
+
+// usageLocked returns the usage of a client through a mode, creating it
+// with the client's quota if needed
+func (a *accounting) usageLocked(name string, mode Mode) *clientUsage {
+	c := a.accountLocked(name)
+	u, ok := c.modes[mode]
+	if ok {
+		return u
+	}
+	u = &clientUsage{quota: a.quotas[mode]}
+	if q, ok := a.overrides[name][mode]; ok {
+		u.quota = q
+	}
+	if u.quota > 0 {
+		u.gate = &quotaGate{name: fmt.Sprintf("client %s %s quota", name, mode), mode: mode}
+		u.gate.cut.Store(true)
+		u.gate.active.Store(true)
+		u.sync()
+	}
+	c.modes[mode] = u
+	return u
+}
+
+// exhausted reports whether the client's quota of a mode is used up. A
+// client without an account has used nothing.
+func (a *accounting) exhausted(name string, mode Mode) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.clients[name]
+	return ok && c.modes[mode] != nil && c.modes[mode].exhausted()
+}
+
+// acquire returns the usage of a connection of a client through a mode and
+// a function that releases it when the connection closes
+func (a *accounting) acquire(name string, mode Mode) (*clientUsage, func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u := a.usageLocked(name, mode)
+	c := a.clients[name]
+	c.conns++
+	c.lastSeen = time.Now()
+
+	release := func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		c.conns--
+		c.lastSeen = time.Now()
+	}
+	return u, release
+}
+
+// roll resets the usage of the accounting period and drops the accounts
+// of idle clients
+func (a *accounting) roll() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, c := range a.clients {
+		for _, u := range c.modes {
+			u.period.Store(0)
+			u.sync()
+		}
+		if a.idleLocked(name, c) {
+			a.evictLocked(name, c)
+		}
+	}
+}
+
+// evictIdle drops the accounts of clients idle for the idle timeout
+func (a *accounting) evictIdle(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, c := range a.clients {
+		if now.Sub(c.lastSeen) >= a.idleTimeout && a.idleLocked(name, c) {
+			a.evictLocked(name, c)
+		}
+	}
+}
+
+// idleLocked reports whether the account of a client may be dropped: it is
+// not configured, has no open connections and used no quota in the period
+func (a *accounting) idleLocked(name string, c *clientAccount) bool {
+	_, configured := a.overrides[name]
+	return !configured && c.conns == 0 && !c.inQuota()
+}
+
+// evictLocked drops the account of a client, adding its traffic to other
+func (a *accounting) evictLocked(name string, c *clientAccount) {
+	for mode, u := range c.modes {
+		a.other[mode] += u.total.Load()
+	}
+	if c.label != ClientOther {
+		a.labeled--
+	}
+	delete(a.clients, name)
+}
+
+// state returns the traffic of every client for persisting
+func (a *accounting) state(periodStart time.Time) clientState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := clientState{
+		PeriodStart: periodStart,
+		Clients:     make(map[string]map[string]modeTrafficState, len(a.clients)),
+		Other:       make(map[string]uint64, len(a.other)),
+	}
+	for mode, bytes := range a.other {
+		s.Other[mode.String()] = bytes
+	}
+	for name, c := range a.clients {
+		modes := make(map[string]modeTrafficState, len(c.modes))
+		for mode, u := range c.modes {
+			modes[mode.String()] = modeTrafficState{TotalBytes: u.total.Load(), PeriodBytes: u.period.Load()}
+		}
+		s.Clients[name] = modes
+	}
+	return s
+}
+
+// restore loads the persisted traffic of every client; period counts only
+// if the period is still current. Clients get their labels in name order.
+func (a *accounting) restore(s clientState, registry *Registry, current bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	names := make([]string, 0, len(s.Clients))
+	for name := range s.Clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	for _, name := range names {
+		for mode, m := range s.Clients[name] {
+			if !registry.Has(Mode(mode)) {
+				continue
+			}
+			u := a.usageLocked(name, Mode(mode))
+			u.total.Store(m.TotalBytes)
+			if current {
+				u.period.Store(m.PeriodBytes)
+			}
+			u.sync()
+		}
+		// The idle timeout counts from the start
+		if c, ok := a.clients[name]; ok {
+			c.lastSeen = now
+		}
+	}
+	for mode, bytes := range s.Other {
+		if registry.Has(Mode(mode)) {
+			a.other[Mode(mode)] = bytes
+		}
+	}
+}
+
+// ClientModeUsage is the traffic of a client through a mode
+type ClientModeUsage struct {
+	Mode        Mode
+	TotalBytes  uint64 // Lifetime
+	PeriodBytes uint64 // In the accounting period
+	QuotaBytes  uint64 // Per accounting period, 0 = unlimited
+	Exhausted   bool
+}
+
+// ClientStatus is the traffic of a client
+type ClientStatus struct {
+	Name        string
+	Connections int
+	LastSeen    time.Time
+	TotalBytes  uint64
+	PeriodBytes uint64
+	Modes       []ClientModeUsage // Configuration order
+}
+
+// ClientKey returns how clients are identified (ip, group, user)
+func (r *Router) ClientKey() string {
+	return r.accounting.key
+}
+
+// Clients returns the traffic of every client seen, the heaviest in the
+// accounting period first
+func (r *Router) Clients() []ClientStatus {
+	a := r.accounting
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := make([]ClientStatus, 0, len(a.clients))
+	for name, c := range a.clients {
+		status := ClientStatus{Name: name, Connections: c.conns, LastSeen: c.lastSeen}
+		for _, info := range r.registry.Modes() {
+			u, ok := c.modes[info.Name]
+			if !ok {
+				continue
+			}
+			m := ClientModeUsage{
+				Mode:        info.Name,
+				TotalBytes:  u.total.Load(),
+				PeriodBytes: u.period.Load(),
+				QuotaBytes:  u.quota,
+				Exhausted:   u.exhausted(),
+			}
+			status.TotalBytes += m.TotalBytes
+			status.PeriodBytes += m.PeriodBytes
+			status.Modes = append(status.Modes, m)
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].PeriodBytes != result[j].PeriodBytes {
+			return result[i].PeriodBytes > result[j].PeriodBytes
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// ClientBytes is the lifetime traffic of a client label through a mode
+type ClientBytes struct {
+	Client string // Client name or ClientOther
+	Mode   Mode
+	Bytes  uint64
+}
+
+// ClientBytes returns the lifetime traffic per client label and mode, for
+// metrics: clients beyond max_clients and dropped clients are summed up as
+// ClientOther
+func (r *Router) ClientBytes() []ClientBytes {
+	a := r.accounting
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	type key struct {
+		client string
+		mode   Mode
+	}
+	sums := make(map[key]uint64)
+	for mode, bytes := range a.other {
+		sums[key{ClientOther, mode}] = bytes
+	}
+	for _, c := range a.clients {
+		for mode, u := range c.modes {
+			sums[key{c.label, mode}] += u.total.Load()
+		}
+	}
+
+	result := make([]ClientBytes, 0, len(sums))
+	for k, bytes := range sums {
+		result = append(result, ClientBytes{Client: k.client, Mode: k.mode, Bytes: bytes})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Client != result[j].Client {
+			return result[i].Client < result[j].Client
+		}
+		return result[i].Mode < result[j].Mode
+	})
+	return result
+}
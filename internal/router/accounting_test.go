@@ -0,0 +1,202 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+func newTestAccounting(t *testing.T, cfg config.AccountingConfig) *accounting {
+	t.Helper()
+	registry, err := NewRegistry(config.ModesConfig{{Name: "home", Type: "direct"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAccounting(cfg, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// otherBytes returns the traffic of dropped clients through home
+func otherBytes(a *accounting) uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.other[ModeHome]
+}
+
+func TestAccountingExhaustedCreatesNoAccount(t *testing.T) {
+	a := newTestAccounting(t, config.AccountingConfig{Quotas: map[string]int{"home": 1}})
+
+	if a.exhausted("192.0.2.1", ModeHome) {
+		t.Fatal("unknown client is exhausted")
+	}
+	if len(a.clients) != 0 {
+		t.Fatalf("%d accounts after a quota check, want none", len(a.clients))
+	}
+
+	u, release := a.acquire("192.0.2.1", ModeHome)
+	u.add(1024 * 1024)
+	release()
+	if !a.exhausted("192.0.2.1", ModeHome) {
+		t.Fatal("client with its quota used up is not exhausted")
+	}
+}
+
+func TestAccountingEviction(t *testing.T) {
+	a := newTestAccounting(t, config.AccountingConfig{
+		MaxClients:  2,
+		IdleTimeout: time.Hour,
+		Quotas:      map[string]int{"home": 10},
+		Clients:     map[string]map[string]int{"alice": {"home": 0}},
+	})
+
+	use := func(name string, n int) func() {
+		u, release := a.acquire(name, ModeHome)
+		u.add(n)
+		return release
+	}
+	use("alice", 100)()           // Configured
+	use("192.0.2.1", 200)()       // Within its quota
+	releaseOpen := use("bob", 50) // Open connection
+	a.mu.Lock()
+	a.clients["192.0.2.1"].modes[ModeHome].quota = 0 // Quota-free: idle once closed
+	a.mu.Unlock()
+	use("192.0.2.2", 400)() // Quota used in the period
+
+	// Not idle long enough
+	a.evictIdle(time.Now())
+	if len(a.clients) != 4 {
+		t.Fatalf("%d accounts, want 4", len(a.clients))
+	}
+
+	a.evictIdle(time.Now().Add(2 * time.Hour))
+	if _, ok := a.clients["192.0.2.1"]; ok {
+		t.Error("idle client was kept")
+	}
+	for _, name := range []string{"alice", "bob", "192.0.2.2"} {
+		if _, ok := a.clients[name]; !ok {
+			t.Errorf("%s was dropped", name)
+		}
+	}
+	if got := otherBytes(a); got != 200 {
+		t.Errorf("other = %d, want 200", got)
+	}
+
+	// The period ends: quotas no longer hold idle clients
+	releaseOpen()
+	a.roll()
+	if len(a.clients) != 1 || a.clients["alice"] == nil {
+		t.Errorf("accounts after roll: %d, want alice only", len(a.clients))
+	}
+	if got := otherBytes(a); got != 650 {
+		t.Errorf("other = %d, want 650", got)
+	}
+
+	// Labels of dropped clients are free again
+	use("192.0.2.9", 1)()
+	if got := a.clients["192.0.2.9"].label; got != "192.0.2.9" {
+		t.Errorf("label = %q, want its own", got)
+	}
+}
+
+func TestAccountingStateKeepsOther(t *testing.T) {
+	a := newTestAccounting(t, config.AccountingConfig{})
+	u, release := a.acquire("192.0.2.1", ModeHome)
+	u.add(300)
+	release()
+	a.roll()
+
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	s := a.state(start)
+	if len(s.Clients) != 0 || s.Other["home"] != 300 {
+		t.Fatalf("state = %+v, want other home 300", s)
+	}
+
+	b := newTestAccounting(t, config.AccountingConfig{})
+	registry, _ := NewRegistry(config.ModesConfig{{Name: "home", Type: "direct"}})
+	b.restore(s, registry, true)
+	if got := otherBytes(b); got != 300 {
+		t.Errorf("restored other = %d, want 300", got)
+	}
+}
+
+func TestDialSkipsExhaustedModes(t *testing.T) {
+	r := newTestRouter(t, `
+modes:
+  a: {type: direct}
+  b: {type: direct}
+  f: {type: direct, fallback: [a, b]}
+  p: {type: pool, members: [a, b]}
+  r: {type: race, members: [a, b]}
+rules:
+  - {domain: [a.test], mode: a}
+  - {domain: [f.test], mode: f}
+  - {domain: [p.test], mode: p}
+  - {domain: [r.test], mode: r}
+accounting:
+  quotas: {a: 1}
+`)
+	r.dialers["f"] = &stubDialer{err: errors.New("connection refused")}
+	addr := echoServer(t)
+
+	u, release := r.accounting.acquire("192.0.2.1", "a")
+	u.add(1024 * 1024)
+	release()
+
+	for _, host := range []string{"f.test", "p.test", "p.test", "r.test"} {
+		if mc := dialTest(t, r, host, addr); mc.mode != "b" {
+			t.Errorf("%s: carried by %s, want b", host, mc.mode)
+		}
+	}
+	if _, err := r.DialContext(context.Background(), testClient("a.test"), "tcp", addr); err == nil {
+		t.Error("a.test: dialed a with its quota used up")
+	}
+
+	// Another client still uses every member
+	other := &Metadata{Source: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 40000}, Host: "p.test"}
+	seen := map[string]bool{}
+	for range 2 {
+		conn, err := r.DialContext(context.Background(), other, "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[conn.(*MeteredConn).mode] = true
+		_ = conn.Close()
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Errorf("pool members of another client: %v, want a and b", seen)
+	}
+}
+
+func TestDialAllMembersExhausted(t *testing.T) {
+	r := newTestRouter(t, `
+modes:
+  a: {type: direct}
+  b: {type: direct}
+  p: {type: pool, members: [a, b]}
+  r: {type: race, members: [a, b]}
+rules:
+  - {domain: [p.test], mode: p}
+  - {domain: [r.test], mode: r}
+accounting:
+  quotas: {a: 1, b: 1}
+`)
+	addr := echoServer(t)
+	for _, mode := range []Mode{"a", "b"} {
+		u, release := r.accounting.acquire("192.0.2.1", mode)
+		u.add(1024 * 1024)
+		release()
+	}
+
+	for _, host := range []string{"p.test", "r.test"} {
+		if _, err := r.DialContext(context.Background(), testClient(host), "tcp", addr); err == nil {
+			t.Errorf("%s: dialed with the quotas of all members used up", host)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// Bandwidth scopes
+const (
+	ScopeGlobal = "global" // All traffic
+	ScopeMode   = "mode"   // Traffic of one mode
+	ScopeClient = "client" // Traffic of each client source IP
+)
+
+// meterWindow is the number of seconds throughput is averaged over
+const meterWindow = 10
+
+// meter measures the throughput of the last meterWindow seconds
+type meter struct {
+	mu    sync.Mutex
+	slots [meterWindow]uint64 // Bytes per second, indexed by unix second
+	last  int64               // Unix second of the newest slot
+}
+
+// advance clears the slots of the seconds since the last update
+func (m *meter) advance(now int64) {
+	if now-m.last >= meterWindow {
+		m.slots = [meterWindow]uint64{}
+	} else {
+		for s := m.last + 1; s <= now; s++ {
+			m.slots[s%meterWindow] = 0
+		}
+	}
+	m.last = max(m.last, now)
+}
+
+func (m *meter) add(n int) {
+	m.addAt(time.Now().Unix(), n)
+}
+
+func (m *meter) addAt(now int64, n int) {
+	m.mu.Lock()
+	m.advance(now)
+	m.slots[now%meterWindow] += uint64(n)
+	m.mu.Unlock()
+}
+
+// rate returns bytes per second over the last complete seconds
+func (m *meter) rate() float64 {
+	return m.rateAt(time.Now().Unix())
+}
+
+func (m *meter) rateAt(now int64) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+
+	var sum uint64
+	for s := now - meterWindow + 1; s < now; s++ {
+		sum += m.slots[s%meterWindow]
+	}
+	return float64(sum) / (meterWindow - 1)
+}
+
+// bucket is a token bucket shared by connections. Unlimited buckets
+// (rate.Inf) pass traffic without waiting.
+type bucket struct {
+	limiter *rate.Limiter
+	meter   meter
+}
+
+// newBucket creates a bucket of bps bytes per second (0 = unlimited)
+func newBucket(bps float64) *bucket {
+	b := &bucket{limiter: rate.NewLimiter(rate.Inf, 0)}
+	b.setRate(bps)
+	return b
+}
+
+// setRate changes the rate (0 = unlimited); open connections follow at once
+func (b *bucket) setRate(bps float64) {
+	if bps <= 0 {
+		b.limiter.SetLimit(rate.Inf)
+		return
+	}
+	// At most a second worth of bytes at once
+	b.limiter.SetBurst(max(int(min(bps, 1<<30)), 1))
+	b.limiter.SetLimit(rate.Limit(bps))
+}
+
+// rate returns the rate in bytes per second (0 = unlimited)
+func (b *bucket) rate() float64 {
+	if l := b.limiter.Limit(); l != rate.Inf {
+		return float64(l)
+	}
+	return 0
+}
+
+// chunk returns how many of n bytes may be transferred at once
+func (b *bucket) chunk(n int) int {
+	if b.limiter.Limit() == rate.Inf {
+		return n
+	}
+	return min(n, b.limiter.Burst())
+}
+
+// wait blocks until n bytes (at most a chunk) may be transferred or ctx
+// is done. Only fails when ctx is done.
+func (b *bucket) wait(ctx context.Context, n int) error {
+	if b.limiter.Limit() == rate.Inf {
+		return nil
+	}
+	// Other errors: the burst shrank meanwhile, let the chunk pass
+	if err := b.limiter.WaitN(ctx, min(n, b.limiter.Burst())); err != nil && ctx.Err() != nil {
+		return err
+	}
+	b.meter.add(n)
+	return nil
+}
+
+// buckets are the buckets one direction of a connection passes
+type buckets []*bucket
+
+func (bs buckets) chunk(n int) int {
+	for _, b := range bs {
+		n = b.chunk(n)
+	}
+	return n
+}
+
+func (bs buckets) wait(ctx context.Context, n int) error {
+	for _, b := range bs {
+		if err := b.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// direction is the upload and download bucket of a scope
+type direction struct {
+	up, down *bucket
+}
+
+func newDirection(cfg config.RateConfig) (direction, error) {
+	up, err := parseBandwidth(cfg.Upload)
+	if err != nil {
+		return direction{}, fmt.Errorf("upload: %w", err)
+	}
+	down, err := parseBandwidth(cfg.Download)
+	if err != nil {
+		return direction{}, fmt.Errorf("download: %w", err)
+	}
+	return direction{up: newBucket(up), down: newBucket(down)}, nil
+}
+
+// clientBuckets are the buckets of a client IP and the connections using them
+type clientBuckets struct {
+	direction
+	refs int
+}
+
+// bandwidth holds the token buckets of every scope. Buckets of all modes
+// exist (unlimited if not configured) so rates can change at runtime.
+type bandwidth struct {
+	global direction
+	modes  map[Mode]direction
+
+	mu         sync.Mutex
+	clientUp   float64 // Per client rate, 0 = unlimited
+	clientDown float64
+	clients    map[string]*clientBuckets // By client IP
+}
+
+// parseBandwidth parses a rate; empty or "0" is unlimited
+func parseBandwidth(s string) (float64, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	return ParseRate(s)
+}
+
+func newBandwidth(cfg config.BandwidthConfig, registry *Registry) (*bandwidth, error) {
+	for name := range cfg.Modes {
+		if !registry.Has(Mode(name)) {
+			return nil, fmt.Errorf("unknown mode: %s", name)
+		}
+	}
+
+	global, err := newDirection(cfg.Global)
+	if err != nil {
+		return nil, fmt.Errorf("global %w", err)
+	}
+	b := &bandwidth{global: global, modes: make(map[Mode]direction), clients: make(map[string]*clientBuckets)}
+	for _, info := range registry.Modes() {
+		d, err := newDirection(cfg.Modes[info.Name.String()])
+		if err != nil {
+			return nil, fmt.Errorf("mode %s %w", info.Name, err)
+		}
+		b.modes[info.Name] = d
+	}
+	if b.clientUp, err = parseBandwidth(cfg.Client.Upload); err != nil {
+		return nil, fmt.Errorf("client upload: %w", err)
+	}
+	if b.clientDown, err = parseBandwidth(cfg.Client.Download); err != nil {
+		return nil, fmt.Errorf("client download: %w", err)
+	}
+	return b, nil
+}
+
+// acquire returns the upload and download buckets of a connection and a
+// function that releases the client's buckets when it closes
+func (b *bandwidth) acquire(mode Mode, ip net.IP) (up, down buckets, release func()) {
+	up, down = buckets{b.global.up}, buckets{b.global.down}
+	if d, ok := b.modes[mode]; ok {
+		up, down = append(up, d.up), append(down, d.down)
+	}
+	if ip == nil {
+		return up, down, func() {}
+	}
+
+	key := ip.String()
+	b.mu.Lock()
+	c, ok := b.clients[key]
+	if !ok {
+		c = &clientBuckets{direction: direction{up: newBucket(b.clientUp), down: newBucket(b.clientDown)}}
+		b.clients[key] = c
+	}
+	c.refs++
+	b.mu.Unlock()
+
+	release = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if c.refs--; c.refs == 0 {
+			delete(b.clients, key)
+		}
+	}
+	return append(up, c.up), append(down, c.down), release
+}
+
+// BandwidthRate is a configured rate and the current throughput of a scope.
+// Rates are bytes per second, 0 = unlimited.
+type BandwidthRate struct {
+	Scope         string
+	Mode          Mode // ScopeMode
+	Upload        float64
+	Download      float64
+	UploadBytes   float64 // Throughput while limited, averaged over the last seconds
+	DownloadBytes float64
+	Clients       int // ScopeClient: clients with open connections
+}
+
+func (d direction) status(scope string, mode Mode) BandwidthRate {
+	return BandwidthRate{
+		Scope:         scope,
+		Mode:          mode,
+		Upload:        d.up.rate(),
+		Download:      d.down.rate(),
+		UploadBytes:   d.up.meter.rate(),
+		DownloadBytes: d.down.meter.rate(),
+	}
+}
+
+// Bandwidth returns the rates of the global scope, the per-client scope
+// and every mode with a rate, in that order
+func (r *Router) Bandwidth() []BandwidthRate {
+	b := r.bandwidth
+	rates := []BandwidthRate{b.global.status(ScopeGlobal, "")}
+
+	b.mu.Lock()
+	client := BandwidthRate{Scope: ScopeClient, Upload: b.clientUp, Download: b.clientDown, Clients: len(b.clients)}
+	for _, c := range b.clients {
+		client.UploadBytes += c.up.meter.rate()
+		client.DownloadBytes += c.down.meter.rate()
+	}
+	b.mu.Unlock()
+	rates = append(rates, client)
+
+	for _, info := range r.registry.Modes() {
+		d := b.modes[info.Name]
+		if d.up.rate() > 0 || d.down.rate() > 0 {
+			rates = append(rates, d.status(ScopeMode, info.Name))
+		}
+	}
+	return rates
+}
+
+// SetBandwidth changes the rates of a scope at runtime; open connections
+// follow at once. A nil rate is unchanged, empty or "0" is unlimited.
+func (r *Router) SetBandwidth(scope string, mode Mode, upload, download *string) error {
+	var up, down float64
+	var err error
+	if upload != nil {
+		if up, err = parseBandwidth(*upload); err != nil {
+			return fmt.Errorf("upload: %w", err)
+		}
+	}
+	if download != nil {
+		if down, err = parseBandwidth(*download); err != nil {
+			return fmt.Errorf("download: %w", err)
+		}
+	}
+
+	b := r.bandwidth
+	var d direction
+	switch scope {
+	case ScopeGlobal:
+		d = b.global
+	case ScopeMode:
+		var ok bool
+		if d, ok = b.modes[mode]; !ok {
+			return fmt.Errorf("invalid mode: %s", mode)
+		}
+	case ScopeClient:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if upload != nil {
+			b.clientUp = up
+		}
+		if download != nil {
+			b.clientDown = down
+		}
+		for _, c := range b.clients {
+			c.up.setRate(b.clientUp)
+			c.down.setRate(b.clientDown)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown scope %q (global, mode, client)", scope)
+	}
+
+	if upload != nil {
+		d.up.setRate(up)
+	}
+	if download != nil {
+		d.down.setRate(down)
+	}
+	return nil
+}
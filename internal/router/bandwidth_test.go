@@ -0,0 +1,224 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/metrics"
+)
+
+func TestBucket(t *testing.T) {
+	b := newBucket(0)
+	if b.rate() != 0 || b.chunk(1<<20) != 1<<20 {
+		t.Errorf("unlimited bucket: rate %g, chunk %d", b.rate(), b.chunk(1<<20))
+	}
+	if err := b.wait(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+
+	b.setRate(10_000)
+	if b.rate() != 10_000 || b.chunk(1<<20) != 10_000 || b.chunk(100) != 100 {
+		t.Errorf("10000 B/s: rate %g, chunk %d", b.rate(), b.chunk(1<<20))
+	}
+
+	// The first second passes at once, the next half second waits
+	start := time.Now()
+	for _, n := range []int{10_000, 5_000} {
+		if err := b.wait(context.Background(), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("15000 bytes at 10000 B/s took %v, want about 500ms", d)
+	}
+
+	b.setRate(0)
+	if b.rate() != 0 || b.chunk(1<<20) != 1<<20 {
+		t.Errorf("unlimited again: rate %g, chunk %d", b.rate(), b.chunk(1<<20))
+	}
+}
+
+func TestBucketWaitCancelled(t *testing.T) {
+	b := newBucket(100)
+	if err := b.wait(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.wait(ctx, 100) }() // A second at this rate
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("wait = %v, want context.Canceled", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("wait not cancelled")
+	}
+}
+
+func TestMeterRate(t *testing.T) {
+	var m meter
+	m.addAt(100, 900)
+	m.addAt(100, 900)
+
+	tests := []struct {
+		now  int64
+		want float64
+	}{
+		{100, 0},          // The current second is not complete
+		{101, 1800.0 / 9}, // Averaged over the complete seconds of the window
+		{109, 1800.0 / 9},
+		{110, 0}, // Out of the window
+	}
+	for _, tt := range tests {
+		if got := m.rateAt(tt.now); got != tt.want {
+			t.Errorf("rate at %d = %g, want %g", tt.now, got, tt.want)
+		}
+	}
+
+	// Slots of skipped seconds are cleared
+	m.addAt(200, 90)
+	m.addAt(203, 450)
+	if got := m.rateAt(204); got != 60 {
+		t.Errorf("rate = %g, want 60", got)
+	}
+	m.addAt(230, 0)
+	if got := m.rateAt(231); got != 0 {
+		t.Errorf("rate after a gap = %g, want 0", got)
+	}
+}
+
+func TestSetBandwidth(t *testing.T) {
+	r := newTestRouter(t, `
+modes:
+  a: {type: direct}
+bandwidth:
+  global: {upload: 1MB}
+  modes:
+    a: {download: 10KB}
+  client: {upload: 1KB, download: 2KB}
+`)
+	rates := func() map[string]BandwidthRate {
+		result := make(map[string]BandwidthRate)
+		for _, rate := range r.Bandwidth() {
+			result[rate.Scope+":"+rate.Mode.String()] = rate
+		}
+		return result
+	}
+	str := func(s string) *string { return &s }
+
+	got := rates()
+	if g := got["global:"]; g.Upload != 1<<20 || g.Download != 0 {
+		t.Errorf("global = %+v", g)
+	}
+	if a := got["mode:a"]; a.Upload != 0 || a.Download != 10<<10 {
+		t.Errorf("mode a = %+v", a)
+	}
+	if _, ok := got["mode:direct"]; ok {
+		t.Error("unlimited mode listed")
+	}
+
+	// Open connections follow client rate changes
+	up, down, release := r.bandwidth.acquire("a", net.IPv4(192, 0, 2, 1))
+	defer release()
+	if len(up) != 3 || up[2].rate() != 1<<10 || down[2].rate() != 2<<10 {
+		t.Fatalf("client buckets %v, %v", up, down)
+	}
+	if err := r.SetBandwidth(ScopeClient, "", nil, str("5KB")); err != nil {
+		t.Fatal(err)
+	}
+	if up[2].rate() != 1<<10 || down[2].rate() != 5<<10 {
+		t.Errorf("client buckets after change: %g, %g", up[2].rate(), down[2].rate())
+	}
+	if c := rates()["client:"]; c.Upload != 1<<10 || c.Download != 5<<10 || c.Clients != 1 {
+		t.Errorf("client = %+v", c)
+	}
+
+	// Mode and global rates; nil keeps a rate, "0" removes it
+	if err := r.SetBandwidth(ScopeMode, "a", str("8mbit"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetBandwidth(ScopeGlobal, "", str("0"), str("2MB")); err != nil {
+		t.Fatal(err)
+	}
+	got = rates()
+	if a := got["mode:a"]; a.Upload != 1e6 || a.Download != 10<<10 {
+		t.Errorf("mode a after change = %+v", a)
+	}
+	if g := got["global:"]; g.Upload != 0 || g.Download != 2<<20 {
+		t.Errorf("global after change = %+v", g)
+	}
+	if up[1].rate() != 1e6 || up[0].rate() != 0 {
+		t.Errorf("open connection rates: mode %g, global %g", up[1].rate(), up[0].rate())
+	}
+
+	errs := []struct {
+		scope string
+		mode  Mode
+		rate  string
+	}{
+		{ScopeMode, "unknown", "1MB"},
+		{"server", "", "1MB"},
+		{ScopeGlobal, "", "fast"},
+		{ScopeGlobal, "", "-1MB"},
+	}
+	for _, e := range errs {
+		if err := r.SetBandwidth(e.scope, e.mode, str(e.rate), nil); err == nil {
+			t.Errorf("SetBandwidth(%s, %q, %s) succeeded", e.scope, e.mode, e.rate)
+		}
+	}
+}
+
+func TestMeteredConnCloseWhileLimited(t *testing.T) {
+	for _, dir := range []string{"write", "read"} {
+		client, server := net.Pipe()
+		if dir == "write" {
+			go func() { _, _ = io.Copy(io.Discard, server) }()
+		} else {
+			go func() { _, _ = server.Write(make([]byte, 200)) }()
+		}
+		mc := NewMeteredConn(client, "a", metrics.New("a"))
+		mc.upload = buckets{newBucket(100)}
+		mc.download = buckets{newBucket(100)}
+
+		// The first 100 bytes pass at once, the next 100 wait a second
+		transfer := func() error {
+			buf := make([]byte, 100)
+			if dir == "write" {
+				_, err := mc.Write(buf)
+				return err
+			}
+			_, err := mc.Read(buf)
+			return err
+		}
+		if err := transfer(); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- transfer() }()
+		time.Sleep(50 * time.Millisecond)
+		start := time.Now()
+		_ = mc.Close()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Errorf("%s after close: %v, want net.ErrClosed", dir, err)
+			}
+			if d := time.Since(start); d > 500*time.Millisecond {
+				t.Errorf("%s returned %v after close", dir, d)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s still waiting after close", dir)
+		}
+		_ = server.Close()
+	}
+}
@@ -0,0 +1,89 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HopError reports which hop of a chain failed
+type HopError struct {
+	Hop  int  // 1-based position in the chain
+	Mode Mode // Mode of the failed hop
+	Err  error
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("hop %d (%s): %v", e.Hop, e.Mode, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+// FailedHop returns the innermost failed hop of a chain error, or nil
+func FailedHop(err error) *HopError {
+	var hopErr *HopError
+	if errors.As(err, &hopErr) {
+		return hopErr
+	}
+	return nil
+}
+
+// hopDialer tags errors of one chain hop.
+// Errors already tagged by an earlier hop are passed through unchanged,
+// so the innermost failing hop is reported.
+type hopDialer struct {
+	hop    int
+	mode   Mode
+	dialer Dialer
+}
+
+func (d *hopDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		if FailedHop(err) != nil {
+			return nil, err
+		}
+		return nil, &HopError{Hop: d.hop, Mode: d.mode, Err: err}
+	}
+	return conn, nil
+}
+
+func (d *hopDialer) Name() string {
+	return d.mode.String()
+}
+
+// ChainDialer connects through a sequence of modes, each hop
+// reaching the next one through the previous hops
+type ChainDialer struct {
+	name string
+	hops []Mode
+	last Dialer
+}
+
+// DialContext connects to the address through all hops
+func (d *ChainDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.last.DialContext(ctx, network, address)
+}
+
+// Name returns the dialer name
+func (d *ChainDialer) Name() string {
+	return d.name
+}
+
+// Hops returns the modes of the chain, first hop first
+func (d *ChainDialer) Hops() []Mode {
+	return d.hops
+}
+
+// String returns the chain as "a -> b -> c"
+func (d *ChainDialer) String() string {
+	names := make([]string, 0, len(d.hops))
+	for _, m := range d.hops {
+		names = append(names, m.String())
+	}
+	return strings.Join(names, " -> ")
+}
@@ -0,0 +1,167 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// Metadata describes the client side of a proxied connection
+type Metadata struct {
+	Source net.Addr // Client address (clientConn.RemoteAddr())
+	Host   string   // Domain of an IP target when known (DNS server, sniffing)
+	User   string   // Authenticated SOCKS5 user, if any
+}
+
+// domain returns the known domain of the target, if any
+func (m *Metadata) domain() string {
+	if m == nil {
+		return ""
+	}
+	return m.Host
+}
+
+// sourceIP returns the client IP, or nil if unknown
+func (m *Metadata) sourceIP() net.IP {
+	if m == nil || m.Source == nil {
+		return nil
+	}
+	switch addr := m.Source.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(m.Source.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// ClientGroup is a set of client networks sharing a default mode
+type ClientGroup struct {
+	Name     string
+	Mode     Mode   // Default mode, empty to follow the current mode
+	Allowed  []Mode // Allowed modes, empty to allow all
+	networks []*net.IPNet
+}
+
+// allows reports whether the group may use the mode
+func (g *ClientGroup) allows(mode Mode) bool {
+	if g == nil || len(g.Allowed) == 0 {
+		return true
+	}
+	for _, m := range g.Allowed {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Networks returns the group's source networks as strings
+func (g *ClientGroup) Networks() []string {
+	nets := make([]string, 0, len(g.networks))
+	for _, n := range g.networks {
+		nets = append(nets, n.String())
+	}
+	return nets
+}
+
+// ClientTable maps client source addresses to groups, the first match wins
+type ClientTable struct {
+	groups []*ClientGroup
+}
+
+// NewClientTable builds the client table from configuration
+func NewClientTable(cfgs []config.ClientConfig) (*ClientTable, error) {
+	t := &ClientTable{groups: make([]*ClientGroup, 0, len(cfgs))}
+
+	for i, c := range cfgs {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("group%d", i+1)
+		}
+
+		group := &ClientGroup{Name: name, Mode: Mode(c.Mode)}
+		if group.Mode != "" && !group.Mode.IsValid() {
+			return nil, fmt.Errorf("client group %s: invalid mode: %s", name, c.Mode)
+		}
+
+		for _, m := range c.AllowedModes {
+			mode := Mode(m)
+			if !mode.IsValid() {
+				return nil, fmt.Errorf("client group %s: invalid allowed mode: %s", name, m)
+			}
+			group.Allowed = append(group.Allowed, mode)
+		}
+		if group.Mode != "" && !group.allows(group.Mode) {
+			return nil, fmt.Errorf("client group %s: mode %s is not in allowed_modes", name, group.Mode)
+		}
+
+		for _, s := range c.CIDR {
+			network, err := parseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("client group %s: %w", name, err)
+			}
+			group.networks = append(group.networks, network)
+		}
+		if len(group.networks) == 0 {
+			return nil, fmt.Errorf("client group %s: no cidr configured", name)
+		}
+
+		t.groups = append(t.groups, group)
+	}
+
+	return t, nil
+}
+
+// Lookup returns the group of the client, or nil if it belongs to none
+func (t *ClientTable) Lookup(meta *Metadata) *ClientGroup {
+	if t == nil || len(t.groups) == 0 {
+		return nil
+	}
+
+	ip := meta.sourceIP()
+	if ip == nil {
+		return nil
+	}
+
+	for _, g := range t.groups {
+		for _, n := range g.networks {
+			if n.Contains(ip) {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+// Groups returns all configured client groups
+func (t *ClientTable) Groups() []*ClientGroup {
+	if t == nil {
+		return nil
+	}
+	return t.groups
+}
+
+// parseCIDR parses a network, allowing plain addresses as single-host networks
+func parseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid cidr: %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
@@ -1,9 +1,13 @@
 package router
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
-// Dialer is the interface for different connection modes
+// Dialer is the interface for different connection modes.
+// Cancelling ctx aborts a pending dial; it has no effect on an established connection.
 type Dialer interface {
-	Dial(network, address string) (net.Conn, error)
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 	Name() string
 }
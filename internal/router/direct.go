@@ -1,20 +1,23 @@
 package router
 
 import (
+	"context"
 	"net"
 	"time"
 )
 
 // DirectDialer connects directly using server's real IP (bypassing tunnel)
 type DirectDialer struct {
+	name    string
 	localIP net.IP
 	dialer  net.Dialer
 }
 
 // NewDirectDialer creates a dialer bound to specific local IP
 // If localIP is empty, uses default routing
-func NewDirectDialer(localIP string) *DirectDialer {
+func NewDirectDialer(name, localIP string) *DirectDialer {
 	d := &DirectDialer{
+		name: name,
 		dialer: net.Dialer{
 			Timeout:   10 * time.Second,
 			KeepAlive: 30 * time.Second,
@@ -32,14 +35,14 @@ func NewDirectDialer(localIP string) *DirectDialer {
 	return d
 }
 
-// Dial connects to the address using direct routing
-func (d *DirectDialer) Dial(network, address string) (net.Conn, error) {
-	return d.dialer.Dial(network, address)
+// DialContext connects to the address using direct routing
+func (d *DirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, network, address)
 }
 
 // Name returns the dialer name
 func (d *DirectDialer) Name() string {
-	return "direct"
+	return d.name
 }
 
 // LocalIP returns the bound local IP
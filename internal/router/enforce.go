@@ -0,0 +1,156 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// LimitCheckInterval is how often limits and billing periods are checked.
+// Reached limits are also handled right away when a connection hits them.
+const LimitCheckInterval = 10 * time.Second
+
+// ErrLimitExhausted is returned by reads and writes of a connection whose
+// mode's traffic limit (plus overshoot) or client quota is used up. The
+// connection is closed.
+var ErrLimitExhausted = errors.New("traffic limit exhausted")
+
+// limitEventQueue is the number of reached events waiting for the router
+const limitEventQueue = 16
+
+// quotaGate enforces a limit inside the connections it applies to. It counts
+// the bytes left until the cut point (limit plus overshoot) down as they
+// are relayed; the router resyncs it from the usage on every check.
+type quotaGate struct {
+	name      string // Logged when flows are cut
+	mode      Mode
+	active    atomic.Bool  // The limit has a byte or money budget
+	cut       atomic.Bool  // Stop flows at the cut point (not for throttle)
+	remaining atomic.Int64 // Bytes until the cut point
+	overshoot atomic.Int64 // Bytes allowed past the limit
+	fired     atomic.Bool  // The reached event was sent or handled
+	closing   atomic.Bool  // Flows are being cut (logged once)
+	events    chan<- Mode  // Reached events for the router (nil: none)
+}
+
+// newLimitGate creates the gate of a mode's traffic limit
+func newLimitGate(mode Mode, events chan<- Mode) *quotaGate {
+	return &quotaGate{name: mode.String() + " traffic limit", mode: mode, events: events}
+}
+
+// allow returns how many of n bytes may be transferred (0: exhausted)
+func (g *quotaGate) allow(n int) int {
+	if g == nil || !g.cut.Load() || !g.active.Load() {
+		return n
+	}
+	rem := g.remaining.Load()
+	if rem <= 0 {
+		if !g.closing.Swap(true) {
+			log.Printf("WARN: %s exhausted, closing its connections", g.name)
+		}
+		return 0
+	}
+	return int(min(int64(n), rem))
+}
+
+// count records n relayed bytes and sends the reached event once the
+// limit itself is used up
+func (g *quotaGate) count(n int) {
+	if g == nil || n <= 0 || !g.active.Load() {
+		return
+	}
+	if g.remaining.Add(-int64(n)) <= g.overshoot.Load() && g.events != nil && !g.fired.Swap(true) {
+		// Non-blocking: the ticker catches up if the queue is full
+		select {
+		case g.events <- g.mode:
+		default:
+		}
+	}
+}
+
+// limitBytes returns the usage at which the limit or its budget is used up,
+// whichever comes first. Returns false if the limit has neither.
+func (l *modeLimit) limitBytes() (uint64, bool) {
+	limit := uint64(math.MaxUint64)
+	if l.maxBytes > 0 {
+		limit = l.maxBytes
+	}
+	budget := l.budget > 0 && l.pricing != nil
+	if budget {
+		q := &l.quota
+		left := max(l.budget-l.pricing.fixed(q.period, q.start, q.end), 0)
+		limit = min(limit, l.pricing.bytesFor(left))
+	}
+	return limit, l.maxBytes > 0 || budget
+}
+
+// quotaGates are the gates a connection passes
+type quotaGates []*quotaGate
+
+// allow returns how many of n bytes every gate allows (0: one is exhausted)
+func (gs quotaGates) allow(n int) int {
+	for _, g := range gs {
+		n = g.allow(n)
+	}
+	return n
+}
+
+func (gs quotaGates) count(n int) {
+	for _, g := range gs {
+		g.count(n)
+	}
+}
+
+// syncGateLocked sets the gate of a mode's limit from its current usage
+func (r *Router) syncGateLocked(mode Mode) {
+	l, ok := r.limits[mode]
+	if !ok {
+		return
+	}
+	g := l.gate
+	limit, ok := l.limitBytes()
+	if !ok {
+		g.active.Store(false)
+		return
+	}
+
+	used := l.quota.usage(r.metrics.GetBytes(mode.String()))
+	overshoot := int64(min(l.overshoot, math.MaxInt64/2))
+	remaining := int64(min(limit, math.MaxInt64/2)) + overshoot - int64(min(used, math.MaxInt64/2))
+
+	g.overshoot.Store(overshoot)
+	g.remaining.Store(remaining)
+	g.cut.Store(l.action != LimitThrottle)
+	g.fired.Store(l.reached)
+	g.closing.Store(remaining <= 0)
+	g.active.Store(true)
+}
+
+// syncGatesLocked sets the gates of all limits
+func (r *Router) syncGatesLocked() {
+	for mode := range r.limits {
+		r.syncGateLocked(mode)
+	}
+}
+
+// RunLimitCheck checks limits and billing periods every LimitCheckInterval
+// and handles limits right away when a connection reaches them, until ctx
+// is done
+func (r *Router) RunLimitCheck(ctx context.Context) {
+	ticker := time.NewTicker(LimitCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.CheckLimits()
+		case mode := <-r.limitEvents:
+			r.checkLimit(mode)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package router
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// trafficServer accepts connections, discards what they send and sends
+// them send bytes, then closes them (without sending: when the client
+// does). Returns the address to dial.
+func trafficServer(t *testing.T, send int) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				if send == 0 {
+					_, _ = io.Copy(io.Discard, conn)
+					return
+				}
+				go func() { _, _ = io.Copy(io.Discard, conn) }()
+				_, _ = conn.Write(make([]byte, send))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestQuotaGate(t *testing.T) {
+	events := make(chan Mode, 4)
+	g := newLimitGate("a", events)
+
+	// Inactive gates and throttled limits let everything through
+	if got := g.allow(100); got != 100 {
+		t.Errorf("inactive gate allows %d of 100", got)
+	}
+	g.active.Store(true)
+	g.remaining.Store(50)
+	if got := g.allow(100); got != 100 {
+		t.Errorf("gate without cut allows %d of 100", got)
+	}
+
+	g.cut.Store(true)
+	g.overshoot.Store(20)
+	steps := []struct {
+		count int // Bytes relayed before the check
+		allow int // Of 100
+		fired bool
+	}{
+		{0, 50, false},
+		{20, 30, false},
+		{10, 20, true}, // The limit is used up, the overshoot is left
+		{15, 5, true},
+		{5, 0, true},
+		{10, 0, true}, // Past the cut point
+	}
+	for i, step := range steps {
+		g.count(step.count)
+		if got := g.allow(100); got != step.allow {
+			t.Errorf("step %d: allows %d of 100, want %d", i+1, got, step.allow)
+		}
+		if g.fired.Load() != step.fired {
+			t.Errorf("step %d: fired %v, want %v", i+1, g.fired.Load(), step.fired)
+		}
+	}
+	if n := len(events); n != 1 {
+		t.Errorf("%d reached events, want 1", n)
+	} else if mode := <-events; mode != "a" {
+		t.Errorf("reached event of %s, want a", mode)
+	}
+
+	// Gates of a connection: the tightest one wins
+	other := newLimitGate("client", nil)
+	other.active.Store(true)
+	other.cut.Store(true)
+	other.remaining.Store(30)
+	gates := quotaGates{other, nil}
+	if got := gates.allow(100); got != 30 {
+		t.Errorf("gates allow %d of 100, want 30", got)
+	}
+}
+
+func TestGateClosesConnMidStream(t *testing.T) {
+	const mb = 1024 * 1024
+
+	tests := []struct {
+		name   string
+		limits string
+		cutAt  int // Bytes relayed before the cut
+	}{
+		{"mode limit", "limits: {a: {max_mb: 1, action: block}}", mb},
+		{"mode limit with overshoot", "limits: {a: {max_mb: 1, action: block, overshoot_mb: 1}}", 2 * mb},
+		{"switch action", "limits: {a: {max_mb: 1, action: switch}}", mb},
+		{"client quota", "accounting: {quotas: {a: 1}}", mb},
+	}
+
+	for _, tt := range tests {
+		cfg := `
+modes:
+  a: {type: direct}
+rules:
+  - {domain: [a.test], mode: a}
+` + tt.limits + "\n"
+
+		// Uploads: the write that crosses the cut point is cut short
+		r := newTestRouter(t, cfg)
+		mc := dialTest(t, r, "a.test", trafficServer(t, 0))
+		n, err := mc.Write(make([]byte, 3*mb))
+		if n != tt.cutAt || !errors.Is(err, ErrLimitExhausted) {
+			t.Errorf("%s: write = %d, %v, want %d, %v", tt.name, n, err, tt.cutAt, ErrLimitExhausted)
+		}
+		if got := r.ConnectionsByMode()["a"]; got != 0 {
+			t.Errorf("%s: %d connections open after the cut", tt.name, got)
+		}
+		if _, err := mc.Write([]byte("x")); err == nil {
+			t.Errorf("%s: write after the cut succeeded", tt.name)
+		}
+
+		// Downloads, and other open connections sharing the gate
+		r = newTestRouter(t, cfg)
+		addr := trafficServer(t, 3*mb)
+		first, second := dialTest(t, r, "a.test", addr), dialTest(t, r, "a.test", addr)
+		got, err := io.CopyN(io.Discard, first, int64(tt.cutAt)/2)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		more, err := io.Copy(io.Discard, second)
+		if got+more != int64(tt.cutAt) || !errors.Is(err, ErrLimitExhausted) {
+			t.Errorf("%s: read %d bytes, %v, want %d, %v", tt.name, got+more, err, tt.cutAt, ErrLimitExhausted)
+		}
+		if _, err := first.Read(make([]byte, 1)); !errors.Is(err, ErrLimitExhausted) {
+			t.Errorf("%s: read of the other connection = %v, want %v", tt.name, err, ErrLimitExhausted)
+		}
+		if got := r.ConnectionsByMode()["a"]; got != 0 {
+			t.Errorf("%s: %d connections open after the cut", tt.name, got)
+		}
+	}
+}
+
+func TestGateThrottleDoesNotCut(t *testing.T) {
+	r := newTestRouter(t, `
+modes:
+  a: {type: direct}
+rules:
+  - {domain: [a.test], mode: a}
+limits:
+  a: {max_mb: 1, action: throttle, throttle: 1000mbit}
+`)
+	mc := dialTest(t, r, "a.test", trafficServer(t, 0))
+	if n, err := mc.Write(make([]byte, 2*1024*1024)); n != 2*1024*1024 || err != nil {
+		t.Errorf("write = %d, %v, want all bytes", n, err)
+	}
+}
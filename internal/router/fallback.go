@@ -0,0 +1,126 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// DialErrorClass is a kind of dial failure that may trigger a fallback
+type DialErrorClass string
+
+const (
+	ErrClassTimeout DialErrorClass = "timeout" // Dial or handshake timed out
+	ErrClassRefused DialErrorClass = "refused" // Connection refused or unreachable, proxy refused the target
+	ErrClassAuth    DialErrorClass = "auth"    // Proxy authentication failed
+	ErrClassOther   DialErrorClass = "other"   // Anything else
+)
+
+// fallbackStep is a mode tried after the previous ones failed
+type fallbackStep struct {
+	mode    Mode
+	timeout time.Duration // 0 for no timeout
+}
+
+// fallbackPolicy describes what happens when a dial through a mode fails
+type fallbackPolicy struct {
+	timeout time.Duration           // Timeout of the mode's own dial, 0 for none
+	steps   []fallbackStep          // Modes tried in order
+	on      map[DialErrorClass]bool // Error classes that trigger fallback, nil for any
+}
+
+// triggers reports whether an error of the class moves on to the next step
+func (p *fallbackPolicy) triggers(class DialErrorClass) bool {
+	return p.on == nil || p.on[class]
+}
+
+// newFallbackPolicies builds the fallback policy of every mode.
+// Modes without a configured fallback list keep the historic behaviour:
+// tunnels fall back to direct, other modes do not fall back.
+func newFallbackPolicies(reg *Registry) (map[Mode]*fallbackPolicy, error) {
+	policies := make(map[Mode]*fallbackPolicy, len(reg.Modes()))
+
+	for _, info := range reg.Modes() {
+		mc := info.Config
+		p := &fallbackPolicy{timeout: mc.DialTimeout}
+
+		fallback := mc.Fallback
+		if fallback == nil && info.Type == TypeTunnel {
+			fallback = config.FallbackList{{Mode: ModeDirect.String()}}
+		}
+
+		for _, step := range fallback {
+			mode := Mode(step.Mode)
+			if !reg.Has(mode) {
+				return nil, fmt.Errorf("mode %s: unknown fallback mode %s", info.Name, mode)
+			}
+			if mode == info.Name {
+				return nil, fmt.Errorf("mode %s: cannot fall back to itself", info.Name)
+			}
+
+			timeout := step.Timeout
+			if timeout == 0 {
+				stepInfo, _ := reg.Get(mode)
+				timeout = stepInfo.Config.DialTimeout
+			}
+			p.steps = append(p.steps, fallbackStep{mode: mode, timeout: timeout})
+		}
+
+		if len(mc.FallbackOn) > 0 {
+			p.on = make(map[DialErrorClass]bool, len(mc.FallbackOn))
+			for _, s := range mc.FallbackOn {
+				class := DialErrorClass(s)
+				switch class {
+				case ErrClassTimeout, ErrClassRefused, ErrClassAuth, ErrClassOther:
+				default:
+					return nil, fmt.Errorf("mode %s: unknown fallback_on class %q", info.Name, s)
+				}
+				p.on[class] = true
+			}
+		}
+
+		policies[info.Name] = p
+	}
+
+	return policies, nil
+}
+
+// classifyDialError returns the class of a dial error
+func classifyDialError(err error) DialErrorClass {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrClassTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) {
+		return ErrClassRefused
+	}
+
+	// Proxy protocols report failures as text only
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return ErrClassTimeout
+	case strings.Contains(msg, "authentication failed"), strings.Contains(msg, "no acceptable authentication"),
+		strings.Contains(msg, "decrypt failed"):
+		return ErrClassAuth
+	case strings.Contains(msg, "refused"), strings.Contains(msg, "unreachable"):
+		return ErrClassRefused
+	default:
+		return ErrClassOther
+	}
+}
+
+// dialStep dials through a dialer, bounded by timeout if set
+func dialStep(ctx context.Context, dialer Dialer, network, address string, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		return dialWithTimeout(ctx, dialer, network, address, timeout)
+	}
+	return dialer.DialContext(ctx, network, address)
+}
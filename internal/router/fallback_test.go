@@ -0,0 +1,209 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// newFallbackRouter routes a.test to mode a, which falls back to b, then c
+func newFallbackRouter(t *testing.T, fallbackOn string) *Router {
+	t.Helper()
+	return newTestRouter(t, fmt.Sprintf(`
+modes:
+  a: {type: direct, fallback: [{mode: b, timeout: 50ms}, c], fallback_on: [%s]}
+  b: {type: direct}
+  c: {type: direct}
+rules:
+  - {domain: [a.test], mode: a}
+`, fallbackOn))
+}
+
+func TestFallback(t *testing.T) {
+	refused := errors.New("connection refused")
+	authFailed := errors.New("proxy authentication failed")
+
+	tests := []struct {
+		name       string
+		fallbackOn string
+		a, b, c    *stubDialer // nil: the mode dials directly
+		wantMode   string
+		wantErr    error
+		wantDials  [3]int32 // Dials of the stubs of a, b and c
+	}{
+		{
+			name:      "primary succeeds",
+			wantMode:  "a",
+			wantDials: [3]int32{0, 0, 0},
+		},
+		{
+			name:      "primary fails",
+			a:         &stubDialer{err: refused},
+			wantMode:  "b",
+			wantDials: [3]int32{1, 0, 0},
+		},
+		{
+			name:      "first step fails",
+			a:         &stubDialer{err: refused},
+			b:         &stubDialer{err: refused},
+			wantMode:  "c",
+			wantDials: [3]int32{1, 1, 0},
+		},
+		{
+			name:      "step timeout",
+			a:         &stubDialer{err: refused},
+			b:         &stubDialer{block: true},
+			wantMode:  "c",
+			wantDials: [3]int32{1, 1, 0},
+		},
+		{
+			name:      "chain fails",
+			a:         &stubDialer{err: refused},
+			b:         &stubDialer{err: refused},
+			c:         &stubDialer{err: authFailed},
+			wantErr:   authFailed,
+			wantDials: [3]int32{1, 1, 1},
+		},
+		{
+			name:       "class does not trigger",
+			fallbackOn: "timeout, auth",
+			a:          &stubDialer{err: refused},
+			b:          &stubDialer{err: refused},
+			c:          &stubDialer{err: refused},
+			wantErr:    refused,
+			wantDials:  [3]int32{1, 0, 0},
+		},
+		{
+			name:       "chain stops at a class that does not trigger",
+			fallbackOn: "auth",
+			a:          &stubDialer{err: authFailed},
+			b:          &stubDialer{err: refused},
+			c:          &stubDialer{err: refused},
+			wantErr:    refused,
+			wantDials:  [3]int32{1, 1, 0},
+		},
+	}
+
+	addr := echoServer(t)
+	for _, tt := range tests {
+		r := newFallbackRouter(t, tt.fallbackOn)
+		stubs := []*stubDialer{tt.a, tt.b, tt.c}
+		for i, mode := range []Mode{"a", "b", "c"} {
+			if stubs[i] != nil {
+				r.dialers[mode] = stubs[i]
+			}
+		}
+
+		conn, err := r.DialContext(context.Background(), testClient("a.test"), "tcp", addr)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else {
+			mc := conn.(*MeteredConn)
+			if mc.mode != tt.wantMode || mc.selected != "a" {
+				t.Errorf("%s: carried by %s, selected %s, want %s, a", tt.name, mc.mode, mc.selected, tt.wantMode)
+			}
+			_ = conn.Close()
+		}
+
+		for i, stub := range stubs {
+			if stub != nil && stub.dials.Load() != tt.wantDials[i] {
+				t.Errorf("%s: %d dials of stub %d, want %d", tt.name, stub.dials.Load(), i, tt.wantDials[i])
+			}
+		}
+	}
+}
+
+func TestFallbackCancelled(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b, c *stubDialer
+		next    int // Index of the step that must not be dialed
+	}{
+		{"during the primary dial", &stubDialer{block: true}, &stubDialer{}, &stubDialer{}, 1},
+		{"during a step", &stubDialer{err: errors.New("connection refused")}, &stubDialer{block: true}, &stubDialer{}, 2},
+	}
+
+	for _, tt := range tests {
+		// No step timeout, so only the cancellation ends the blocked dial
+		r := newTestRouter(t, `
+modes:
+  a: {type: direct, fallback: [b, c]}
+  b: {type: direct}
+  c: {type: direct}
+rules:
+  - {domain: [a.test], mode: a}
+`)
+		r.dialers["a"], r.dialers["b"], r.dialers["c"] = tt.a, tt.b, tt.c
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := r.DialContext(ctx, testClient("a.test"), "tcp", "192.0.2.1:80")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, context.Canceled)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: dial returned after %v", tt.name, elapsed)
+		}
+		if next := []*stubDialer{tt.a, tt.b, tt.c}[tt.next]; next.dials.Load() != 0 {
+			t.Errorf("%s: fell back after the cancellation (%d dials of step %d)", tt.name, next.dials.Load(), tt.next)
+		}
+		cancel()
+	}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want DialErrorClass
+	}{
+		{context.DeadlineExceeded, ErrClassTimeout},
+		{fmt.Errorf("dial warp: %w", context.DeadlineExceeded), ErrClassTimeout},
+		{errors.New("socks5: handshake timed out"), ErrClassTimeout},
+		{errors.New("dial tcp 192.0.2.1:80: connect: connection refused"), ErrClassRefused},
+		{errors.New("network is unreachable"), ErrClassRefused},
+		{errors.New("proxy authentication failed"), ErrClassAuth},
+		{errors.New("no acceptable authentication methods"), ErrClassAuth},
+		{errors.New("shadowsocks: decrypt failed"), ErrClassAuth},
+		{errors.New("unexpected EOF"), ErrClassOther},
+	}
+	for _, tt := range tests {
+		if got := classifyDialError(tt.err); got != tt.want {
+			t.Errorf("classifyDialError(%q) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFallbackPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+	}{
+		{"unknown mode", "{type: direct, fallback: [nope]}"},
+		{"itself", "{type: direct, fallback: [a]}"},
+		{"unknown class", "{type: direct, fallback: [direct], fallback_on: [dns]}"},
+	}
+	for _, tt := range tests {
+		var modes config.ModesConfig
+		if err := yaml.Unmarshal([]byte("a: "+tt.mode), &modes); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		reg, err := NewRegistry(modes)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err := newFallbackPolicies(reg); err == nil {
+			t.Errorf("%s: fallback policy accepted", tt.name)
+		}
+	}
+}
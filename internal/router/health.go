@@ -0,0 +1,228 @@
+package router
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// Health monitor defaults
+const (
+	defaultHealthInterval  = 30 * time.Second
+	defaultHealthTimeout   = 5 * time.Second
+	defaultHealthThreshold = 3
+)
+
+// defaultHealthEndpoints are probed when no endpoints are configured
+var defaultHealthEndpoints = []string{"1.1.1.1:443", "8.8.8.8:443"}
+
+// healthDefaults fills in unset health settings
+func healthDefaults(cfg config.HealthConfig) config.HealthConfig {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultHealthInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultHealthTimeout
+	}
+	if len(cfg.Endpoints) == 0 {
+		cfg.Endpoints = defaultHealthEndpoints
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = defaultHealthThreshold
+	}
+	if cfg.SuccessThreshold <= 0 {
+		cfg.SuccessThreshold = defaultHealthThreshold
+	}
+	return cfg
+}
+
+// modeHealth is the probe history of a mode
+type modeHealth struct {
+	healthy   bool
+	failures  int // Consecutive failures
+	successes int // Consecutive successes
+	lastErr   string
+	lastCheck time.Time
+}
+
+// ModeHealth is a snapshot of the health of a mode
+type ModeHealth struct {
+	Mode                 Mode
+	Healthy              bool
+	ConsecutiveFailures  int
+	ConsecutiveSuccesses int
+	LastError            string
+	LastCheck            time.Time
+}
+
+// RunHealthMonitor probes every available mode on an interval until ctx is done.
+// After FailureThreshold consecutive failures of the current mode it switches
+// to the first healthy mode of its fallback list (else direct); after
+// SuccessThreshold consecutive successes it restores the preferred mode.
+func (r *Router) RunHealthMonitor(ctx context.Context) {
+	log.Printf("INFO: Health monitor started (every %v, %d endpoints)", r.health.Interval, len(r.health.Endpoints))
+
+	ticker := time.NewTicker(r.health.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.probeAll(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		r.applyHealth()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probeAll tests all available modes concurrently and updates their state
+func (r *Router) probeAll(ctx context.Context) {
+	modes := r.AvailableModes()
+
+	var wg sync.WaitGroup
+	for _, mode := range modes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.testMode(ctx, mode)
+			if ctx.Err() != nil {
+				return // Shutting down, the result means nothing
+			}
+			r.recordProbe(mode, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// recordProbe updates the health state of a mode with a probe result
+func (r *Router) recordProbe(mode Mode, err error) {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+
+	h, ok := r.healthState[mode]
+	if !ok {
+		h = &modeHealth{healthy: true}
+		r.healthState[mode] = h
+	}
+	h.lastCheck = time.Now()
+
+	if err == nil {
+		h.successes++
+		h.failures = 0
+		if !h.healthy && h.successes >= r.health.SuccessThreshold {
+			h.healthy = true
+			log.Printf("INFO: Health: %s is healthy again", mode)
+		}
+		return
+	}
+
+	h.failures++
+	h.successes = 0
+	h.lastErr = err.Error()
+	if h.healthy && h.failures >= r.health.FailureThreshold {
+		h.healthy = false
+		log.Printf("WARN: Health: %s is unhealthy after %d failures: %v", mode, h.failures, err)
+	}
+}
+
+// isHealthy reports whether a mode is healthy (modes not probed yet are)
+func (r *Router) isHealthy(mode Mode) bool {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+
+	h, ok := r.healthState[mode]
+	return !ok || h.healthy
+}
+
+// isRestorable reports whether a mode had enough consecutive successes to switch back to
+func (r *Router) isRestorable(mode Mode) bool {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+
+	h, ok := r.healthState[mode]
+	return ok && h.healthy && h.successes >= r.health.SuccessThreshold
+}
+
+// applyHealth fails over from an unhealthy current mode, or restores the preferred one
+func (r *Router) applyHealth() {
+	r.mu.RLock()
+	current := r.mode
+	preferred := r.preferred
+	r.mu.RUnlock()
+	if r.health.Preferred != "" {
+		preferred = Mode(r.health.Preferred)
+	}
+
+	if !r.isHealthy(current) {
+		target := r.failoverTarget(current)
+		if target == "" {
+			log.Printf("WARN: Health: %s is unhealthy, no healthy mode to fail over to", current)
+			return
+		}
+		if err := r.SwitchMode(target, TriggerHealth); err != nil {
+			log.Printf("WARN: Health: failover from %s to %s failed: %v", current, target, err)
+			return
+		}
+		log.Printf("WARN: Health: failed over from %s to %s", current, target)
+		return
+	}
+
+	if current != preferred && r.isRestorable(preferred) {
+		if err := r.SwitchMode(preferred, TriggerHealth); err != nil {
+			log.Printf("DEBUG: Health: restore of %s skipped: %v", preferred, err)
+			return
+		}
+		log.Printf("INFO: Health: restored %s", preferred)
+	}
+}
+
+// failoverTarget returns the first healthy, usable mode of the fallback list
+// of mode, then direct; empty if there is none
+func (r *Router) failoverTarget(mode Mode) Mode {
+	candidates := make([]Mode, 0, len(r.fallbacks[mode].steps)+1)
+	for _, step := range r.fallbacks[mode].steps {
+		candidates = append(candidates, step.mode)
+	}
+	candidates = append(candidates, ModeDirect)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, m := range candidates {
+		if m != mode && r.isUsableLocked(m) && r.isHealthy(m) {
+			return m
+		}
+	}
+	return ""
+}
+
+// HealthStatus returns the probe state of all probed modes in configuration order
+func (r *Router) HealthStatus() []ModeHealth {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+
+	var result []ModeHealth
+	for _, info := range r.registry.Modes() {
+		h, ok := r.healthState[info.Name]
+		if !ok {
+			continue
+		}
+		result = append(result, ModeHealth{
+			Mode:                 info.Name,
+			Healthy:              h.healthy,
+			ConsecutiveFailures:  h.failures,
+			ConsecutiveSuccesses: h.successes,
+			LastError:            h.lastErr,
+			LastCheck:            h.lastCheck,
+		})
+	}
+	return result
+}
@@ -0,0 +1,148 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newHealthRouter creates a router with proxy modes p and q whose dials go
+// to stub dialers, p falling back to q
+func newHealthRouter(t *testing.T, health string) (*Router, *stubDialer, *stubDialer) {
+	t.Helper()
+	r := newTestRouter(t, `
+modes:
+  p: {type: socks5, host: 192.0.2.1, port: 1080, fallback: [q]}
+  q: {type: socks5, host: 192.0.2.2, port: 1080}
+health:
+  endpoints: ["192.0.2.10:443"]
+`+health)
+	p, q := &stubDialer{}, &stubDialer{}
+	r.dialers["p"], r.dialers["q"] = p, q
+	return r, p, q
+}
+
+func TestHealthThresholds(t *testing.T) {
+	r, p, _ := newHealthRouter(t, `
+  failure_threshold: 2
+  success_threshold: 2
+`)
+	if err := r.SetMode("p"); err != nil {
+		t.Fatal(err)
+	}
+	down := errors.New("connection refused")
+
+	steps := []struct {
+		err     error // Result of the probes of p
+		healthy bool
+		mode    Mode
+	}{
+		{down, true, "p"},
+		{down, false, "q"}, // Failed over to the fallback of p
+		{nil, false, "q"},
+		{down, false, "q"}, // Resets the successes
+		{nil, false, "q"},
+		{nil, true, "p"}, // Restored
+		{down, true, "p"},
+		{nil, true, "p"}, // Resets the failures
+		{down, true, "p"},
+	}
+	for i, step := range steps {
+		p.err = step.err
+		r.probeAll(context.Background())
+		r.applyHealth()
+
+		if got := r.isHealthy("p"); got != step.healthy {
+			t.Errorf("step %d: p healthy = %v, want %v", i+1, got, step.healthy)
+		}
+		if got := r.GetMode(); got != step.mode {
+			t.Errorf("step %d: mode %s, want %s", i+1, got, step.mode)
+		}
+	}
+
+	status := r.HealthStatus()
+	if len(status) != 3 || status[0].Mode != "p" {
+		t.Fatalf("HealthStatus = %+v, want p, q and direct", status)
+	}
+	if s := status[0]; !s.Healthy || s.ConsecutiveFailures != 1 || s.LastError == "" || s.LastCheck.IsZero() {
+		t.Errorf("p status = %+v", s)
+	}
+}
+
+func TestHealthFailoverTarget(t *testing.T) {
+	r, p, q := newHealthRouter(t, `
+  failure_threshold: 1
+`)
+	if err := r.SetMode("p"); err != nil {
+		t.Fatal(err)
+	}
+	p.err = errors.New("connection refused")
+	q.err = errors.New("connection refused")
+
+	// The fallback of p is unhealthy as well: direct is left
+	r.probeAll(context.Background())
+	r.applyHealth()
+	if got := r.GetMode(); got != ModeDirect {
+		t.Errorf("mode %s, want %s", got, ModeDirect)
+	}
+}
+
+func TestHealthMonitorInterval(t *testing.T) {
+	r, p, _ := newHealthRouter(t, `
+  interval: 20ms
+`)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.RunHealthMonitor(ctx)
+		close(done)
+	}()
+
+	// Probes right away, then every interval
+	time.Sleep(110 * time.Millisecond)
+	if n := p.dials.Load(); n < 3 || n > 10 {
+		t.Errorf("%d probes in 110ms at a 20ms interval", n)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("health monitor did not stop")
+	}
+	n := p.dials.Load()
+	time.Sleep(60 * time.Millisecond)
+	if p.dials.Load() != n {
+		t.Error("probes after the health monitor stopped")
+	}
+}
+
+func TestHealthMonitorStopDuringProbe(t *testing.T) {
+	r, p, q := newHealthRouter(t, "")
+	p.block, q.block = true, true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.RunHealthMonitor(ctx)
+		close(done)
+	}()
+	for p.dials.Load() == 0 || q.dials.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("health monitor did not stop during a probe")
+	}
+
+	// Probes cut short by the shutdown are not recorded
+	for _, s := range r.HealthStatus() {
+		if s.Mode != ModeDirect {
+			t.Errorf("%s: probe recorded after the shutdown: %+v", s.Mode, s)
+		}
+	}
+}
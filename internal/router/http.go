@@ -0,0 +1,184 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// httpHandshakeTimeout bounds the TLS handshake and CONNECT exchange
+const httpHandshakeTimeout = 10 * time.Second
+
+// HTTPDialer connects through an HTTP(S) CONNECT upstream proxy
+type HTTPDialer struct {
+	name       string
+	proxyAddr  string
+	authHeader string      // "Basic ..." or empty
+	tlsConfig  *tls.Config // nil for plain HTTP proxies
+	forward    proxy.ContextDialer
+}
+
+// NewHTTPDialer creates a dialer that routes through an HTTP CONNECT proxy,
+// reaching the proxy itself through forward.
+// If tlsConfig is set, the connection to the proxy itself uses TLS.
+func NewHTTPDialer(name, host string, port int, username, password string, forward proxy.ContextDialer, tlsConfig *tls.Config) (*HTTPDialer, error) {
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port: %d", port)
+	}
+
+	d := &HTTPDialer{
+		name:      name,
+		proxyAddr: net.JoinHostPort(host, fmt.Sprint(port)),
+		tlsConfig: tlsConfig,
+		forward:   forward,
+	}
+
+	if username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		d.authHeader = "Basic " + creds
+	}
+
+	return d, nil
+}
+
+// newProxyTLSConfig builds the TLS client config for connecting to a proxy.
+// If a CA file is set, only that CA is trusted (pinning).
+func newProxyTLSConfig(tc config.TLSConfig, host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         tc.ServerName,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+
+	if tc.CAFile != "" {
+		pem, err := os.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", tc.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// DialContext connects to the address through the HTTP CONNECT proxy
+func (d *HTTPDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s not supported by HTTP proxy", network)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to proxy %s: %w", d.proxyAddr, err)
+	}
+
+	deadline := time.Now().Add(httpHandshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+
+	// Abort the handshake if ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if d.tlsConfig != nil {
+		tlsConn := tls.Client(conn, d.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy %s: %w", d.proxyAddr, ctxError(ctx, err))
+		}
+		conn = tlsConn
+	}
+
+	br, err := d.connect(conn, address)
+	if err != nil {
+		_ = conn.Close()
+		return nil, ctxError(ctx, err)
+	}
+
+	if !stop() {
+		// ctx was cancelled right after the handshake
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// The proxy may have sent tunnel data right after its response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connect sends the CONNECT request and checks the proxy response
+func (d *HTTPDialer) connect(conn net.Conn, address string) (*bufio.Reader, error) {
+	msg := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if d.authHeader != "" {
+		msg += "Proxy-Authorization: " + d.authHeader + "\r\n"
+	}
+	msg += "\r\n"
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return nil, fmt.Errorf("write CONNECT: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("read CONNECT response: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return nil, fmt.Errorf("proxy authentication failed: %s", resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+
+	return br, nil
+}
+
+// ctxError returns the context error if ctx is done, else err
+func ctxError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// Name returns the dialer name
+func (d *HTTPDialer) Name() string {
+	return d.name
+}
+
+// bufferedConn returns bytes already read into a buffer before reading the conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,194 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connectProxy is an HTTP CONNECT proxy for tests. Tunnels echo what the
+// client sends after a greeting, instead of reaching the target.
+type connectProxy struct {
+	status int    // Response to CONNECT requests
+	auth   string // Required Proxy-Authorization (empty: none)
+
+	mu      sync.Mutex
+	targets []string // Requested targets
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.mu.Unlock()
+
+	if p.auth != "" && r.Header.Get("Proxy-Authorization") != p.auth {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	if p.status != http.StatusOK {
+		w.WriteHeader(p.status)
+		return
+	}
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	// The greeting follows the response in the same write
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+	_, _ = io.Copy(conn, conn)
+}
+
+// newHTTPTestDialer creates a dialer for the proxy at a test server URL
+func newHTTPTestDialer(t *testing.T, url, username, password string, tlsConfig *tls.Config) *HTTPDialer {
+	t.Helper()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(strings.TrimPrefix(url, "http://"), "https://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	d, err := NewHTTPDialer("proxy", host, portNum, username, password, &net.Dialer{}, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestHTTPDialer(t *testing.T) {
+	// "Basic " + base64("alice:secret")
+	const aliceAuth = "Basic YWxpY2U6c2VjcmV0"
+
+	tests := []struct {
+		name     string
+		status   int
+		auth     string
+		username string
+		password string
+		tls      bool
+		wantErr  DialErrorClass // Empty: the tunnel is established
+	}{
+		{name: "200", status: http.StatusOK},
+		{name: "200 over TLS", status: http.StatusOK, tls: true},
+		{name: "502", status: http.StatusBadGateway, wantErr: ErrClassRefused},
+		{name: "403", status: http.StatusForbidden, wantErr: ErrClassRefused},
+		{name: "auth", status: http.StatusOK, auth: aliceAuth, username: "alice", password: "secret"},
+		{name: "auth over TLS", status: http.StatusOK, auth: aliceAuth, username: "alice", password: "secret", tls: true},
+		{name: "wrong password", status: http.StatusOK, auth: aliceAuth, username: "alice", password: "guess", wantErr: ErrClassAuth},
+		{name: "no credentials", status: http.StatusOK, auth: aliceAuth, wantErr: ErrClassAuth},
+	}
+
+	for _, tt := range tests {
+		p := &connectProxy{status: tt.status, auth: tt.auth}
+		var srv *httptest.Server
+		var tlsConfig *tls.Config
+		if tt.tls {
+			srv = httptest.NewTLSServer(p)
+			roots := x509.NewCertPool()
+			roots.AddCert(srv.Certificate())
+			tlsConfig = &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+		} else {
+			srv = httptest.NewServer(p)
+		}
+		d := newHTTPTestDialer(t, srv.URL, tt.username, tt.password, tlsConfig)
+
+		conn, err := d.DialContext(context.Background(), "tcp", "target.example:443")
+		p.mu.Lock()
+		targets := p.targets
+		p.mu.Unlock()
+		if len(targets) != 1 || targets[0] != "target.example:443" {
+			t.Errorf("%s: proxy got CONNECT to %v, want target.example:443", tt.name, targets)
+		}
+
+		if tt.wantErr != "" {
+			if err == nil {
+				_ = conn.Close()
+				t.Errorf("%s: dial succeeded", tt.name)
+			} else if class := classifyDialError(err); class != tt.wantErr {
+				t.Errorf("%s: error %q is %s, want %s", tt.name, err, class, tt.wantErr)
+			}
+			srv.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			srv.Close()
+			continue
+		}
+
+		// Data sent with the response is not lost, the tunnel carries data
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("%s: greeting %q, %v", tt.name, buf, err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil || string(buf[:4]) != "ping" {
+			t.Errorf("%s: echo %q, %v", tt.name, buf[:4], err)
+		}
+		_ = conn.Close()
+		srv.Close()
+	}
+}
+
+func TestHTTPDialerUntrustedProxy(t *testing.T) {
+	srv := httptest.NewTLSServer(&connectProxy{status: http.StatusOK})
+	defer srv.Close()
+
+	// The proxy's certificate is not trusted
+	d := newHTTPTestDialer(t, srv.URL, "", "", &tls.Config{RootCAs: x509.NewCertPool(), ServerName: "127.0.0.1"})
+	if conn, err := d.DialContext(context.Background(), "tcp", "target.example:443"); err == nil {
+		_ = conn.Close()
+		t.Error("dial through an untrusted proxy succeeded")
+	}
+}
+
+func TestHTTPDialerCancelled(t *testing.T) {
+	// A proxy that accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+
+	d := newHTTPTestDialer(t, "http://"+ln.Addr().String(), "", "", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = d.DialContext(ctx, "tcp", "target.example:443")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial returned after %v", elapsed)
+	}
+
+	if _, err := d.DialContext(context.Background(), "udp", "target.example:53"); err == nil {
+		t.Error("udp dial succeeded")
+	}
+}
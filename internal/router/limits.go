@@ -0,0 +1,596 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// LimitAction is what happens when a mode's traffic limit is reached
+type LimitAction string
+
+// Limit actions
+const (
+	LimitSwitch   LimitAction = "switch"   // Switch away from the mode if current, reject new connections (default)
+	LimitBlock    LimitAction = "block"    // Reject new connections through the mode
+	LimitThrottle LimitAction = "throttle" // Slow the mode's connections down to a rate
+)
+
+// ParseRate parses a transfer rate in bytes per second: a plain number of
+// bytes, a number with KB/MB/GB (binary), or with kbit/mbit/gbit (decimal).
+// A trailing "/s" or "ps" is accepted.
+func ParseRate(s string) (float64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "/s"), "ps")
+
+	unit, bits := 1.0, false
+	for _, u := range []struct {
+		suffix string
+		mult   float64
+		bits   bool
+	}{
+		{"gbit", 1e9, true}, {"mbit", 1e6, true}, {"kbit", 1e3, true}, {"bit", 1, true},
+		{"gb", 1 << 30, false}, {"mb", 1 << 20, false}, {"kb", 1 << 10, false}, {"b", 1, false},
+	} {
+		if strings.HasSuffix(v, u.suffix) {
+			v, unit, bits = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.mult, u.bits
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate: %s", s)
+	}
+	if bits {
+		return n * unit / 8, nil
+	}
+	return n * unit, nil
+}
+
+// throttle slows the connections of a mode down to a shared rate while active
+type throttle struct {
+	spec   string
+	active atomic.Bool
+	bucket *bucket
+}
+
+func newThrottle(spec string) (*throttle, error) {
+	bps, err := ParseRate(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &throttle{spec: spec, bucket: newBucket(bps)}, nil
+}
+
+// chunk returns how many of n bytes may be transferred at once
+func (t *throttle) chunk(n int) int {
+	if t == nil || !t.active.Load() {
+		return n
+	}
+	return t.bucket.chunk(n)
+}
+
+// wait blocks until n bytes (at most a chunk) may be transferred or ctx is done
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t == nil || !t.active.Load() {
+		return nil
+	}
+	return t.bucket.wait(ctx, n)
+}
+
+// modeLimit is the traffic limit and budget of a mode
+type modeLimit struct {
+	maxBytes uint64  // 0 = unlimited
+	budget   float64 // 0 = no budget
+	pricing  *pricing
+	action   LimitAction
+	switchTo Mode      // switch
+	throttle *throttle // throttle
+	quota    quota
+	reached  bool // limit.reached was handled in this period
+
+	overshoot uint64     // Bytes relayed past the limit before flows are cut
+	gate      *quotaGate // Inline enforcement in the mode's connections
+
+	warnings []int // Thresholds in percent, ascending
+	warned   int   // Highest threshold warned about in this period
+	trend    usageTrend
+}
+
+// exhausted reports whether the usage reached the limit or its cost the budget
+func (l *modeLimit) exhausted(counter uint64) bool {
+	return l.trafficExhausted(counter) || (l.budget > 0 && l.cost(counter) >= l.budget)
+}
+
+func (l *modeLimit) trafficExhausted(counter uint64) bool {
+	return l.maxBytes > 0 && l.quota.usage(counter) >= l.maxBytes
+}
+
+// cost returns the spend of the usage in the current period
+func (l *modeLimit) cost(counter uint64) float64 {
+	q := &l.quota
+	return l.pricing.cost(q.usage(counter), q.period, q.start, q.end)
+}
+
+// setAction validates and applies an action; an empty target defaults to direct
+func (l *modeLimit) setAction(action LimitAction, switchTo Mode, throttleSpec string, registry *Registry) error {
+	mode := l.quota.mode
+	switch action {
+	case "", LimitSwitch:
+		action = LimitSwitch
+		if switchTo == "" {
+			switchTo = ModeDirect
+		} else if !registry.Has(switchTo) {
+			return fmt.Errorf("auto_switch_to uses unknown mode: %s", switchTo)
+		}
+		if switchTo == mode {
+			return fmt.Errorf("auto_switch_to must be another mode")
+		}
+	case LimitBlock:
+	case LimitThrottle:
+		if throttleSpec == "" {
+			return fmt.Errorf("throttle action needs a throttle rate")
+		}
+		if l.throttle == nil || l.throttle.spec != throttleSpec {
+			t, err := newThrottle(throttleSpec)
+			if err != nil {
+				return err
+			}
+			if l.throttle != nil {
+				t.active.Store(l.throttle.active.Load())
+			}
+			l.throttle = t
+		}
+	default:
+		return fmt.Errorf("unknown limit action %q (switch, block, throttle)", action)
+	}
+
+	l.action, l.switchTo = action, switchTo
+	if action != LimitThrottle && l.throttle != nil {
+		l.throttle.active.Store(false)
+	}
+	return nil
+}
+
+// newLimits parses the configured limits. home always has one
+// (unlimited by default) so its limit can be set at runtime.
+func newLimits(cfg config.LimitsConfig, registry *Registry, prices map[Mode]*pricing, events chan<- Mode) (map[Mode]*modeLimit, error) {
+	limits := make(map[Mode]*modeLimit)
+	if registry.Has(ModeHome) {
+		cfg = withDefaultLimit(cfg, ModeHome)
+	}
+
+	now := time.Now()
+	for name, c := range cfg {
+		mode := Mode(name)
+		if !registry.Has(mode) {
+			return nil, fmt.Errorf("limit for unknown mode: %s", name)
+		}
+		if c.MaxMB < 0 {
+			return nil, fmt.Errorf("%s: invalid max_mb: %d", name, c.MaxMB)
+		}
+		if c.Budget < 0 {
+			return nil, fmt.Errorf("%s: invalid budget: %g", name, c.Budget)
+		}
+		if c.OvershootMB < 0 {
+			return nil, fmt.Errorf("%s: invalid overshoot_mb: %d", name, c.OvershootMB)
+		}
+		if c.Budget > 0 && prices[mode] == nil {
+			return nil, fmt.Errorf("%s: budget needs a price (pricing.modes)", name)
+		}
+		warnings, err := parseWarnings(c.Warnings)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		period, err := NewPeriod(c.Period)
+		if err != nil {
+			return nil, fmt.Errorf("%s: period: %w", name, err)
+		}
+		if err := prices[mode].checkBudget(c.Budget, period); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		l := &modeLimit{
+			maxBytes: uint64(c.MaxMB) * 1024 * 1024,
+			budget:   c.Budget,
+			pricing:  prices[mode],
+			quota:    quota{mode: mode, period: period},
+			warnings: warnings,
+
+			overshoot: uint64(c.OvershootMB) * 1024 * 1024,
+			gate:      newLimitGate(mode, events),
+		}
+		if period != nil {
+			l.quota.start, l.quota.end = period.bounds(now, time.Time{})
+		}
+		if err := l.setAction(LimitAction(c.Action), Mode(c.AutoSwitchTo), c.Throttle, registry); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		limits[mode] = l
+	}
+	return limits, nil
+}
+
+// withDefaultLimit adds an unlimited entry for mode if none is configured
+func withDefaultLimit(cfg config.LimitsConfig, mode Mode) config.LimitsConfig {
+	if _, ok := cfg[mode.String()]; ok {
+		return cfg
+	}
+	result := make(config.LimitsConfig, len(cfg)+1)
+	for name, c := range cfg {
+		result[name] = c
+	}
+	result[mode.String()] = config.LimitConfig{}
+	return result
+}
+
+// LimitStatus describes the traffic limit of a mode and its usage
+type LimitStatus struct {
+	Mode        Mode
+	LimitBytes  uint64  // 0 = unlimited
+	UsedBytes   uint64  // In the current period
+	Budget      float64 // 0 = no budget
+	Cost        float64 // Spend of the usage in the current period
+	Action      LimitAction
+	SwitchTo    Mode   // switch
+	Throttle    string // throttle
+	Period      PeriodType
+	PeriodStart time.Time // Zero if the usage never resets
+	PeriodEnd   time.Time
+	Exhausted   bool
+	Throttled   bool      // Connections of the mode are throttled right now
+	Warnings    []int     // Warning thresholds in percent
+	Overshoot   uint64    // Bytes relayed past the limit before flows are cut
+	ExhaustedAt time.Time // Projected from the recent usage (zero: unknown)
+}
+
+func (r *Router) limitStatusLocked(mode Mode, l *modeLimit) LimitStatus {
+	counter := r.metrics.GetBytes(mode.String())
+	status := LimitStatus{
+		Mode:        mode,
+		LimitBytes:  l.maxBytes,
+		UsedBytes:   l.quota.usage(counter),
+		Budget:      l.budget,
+		Cost:        l.cost(counter),
+		Action:      l.action,
+		PeriodStart: l.quota.start,
+		PeriodEnd:   l.quota.end,
+		Exhausted:   l.exhausted(counter),
+		Warnings:    l.warnings,
+		Overshoot:   l.overshoot,
+	}
+	if !status.Exhausted {
+		_, status.ExhaustedAt = l.trend.project()
+	}
+	switch l.action {
+	case LimitSwitch:
+		status.SwitchTo = l.switchTo
+	case LimitThrottle:
+		status.Throttle = l.throttle.spec
+		status.Throttled = l.throttle.active.Load()
+	}
+	if l.quota.period != nil {
+		status.Period = l.quota.period.Type
+	}
+	return status
+}
+
+// Limit returns the traffic limit of a mode
+func (r *Router) Limit(mode Mode) (LimitStatus, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	l, ok := r.limits[mode]
+	if !ok {
+		return LimitStatus{Mode: mode}, false
+	}
+	return r.limitStatusLocked(mode, l), true
+}
+
+// Limits returns the modes with a traffic limit or budget in configuration order
+func (r *Router) Limits() []LimitStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var result []LimitStatus
+	for _, info := range r.registry.Modes() {
+		if l, ok := r.limits[info.Name]; ok && (l.maxBytes > 0 || l.budget > 0) {
+			result = append(result, r.limitStatusLocked(info.Name, l))
+		}
+	}
+	return result
+}
+
+// LimitUpdate changes the limit of a mode at runtime.
+// An empty action and nil budget and warnings keep the current ones.
+type LimitUpdate struct {
+	MaxMB       *int
+	Budget      *float64
+	Warnings    []int
+	OvershootMB *int
+	Action      LimitAction
+	SwitchTo    Mode
+	Throttle    string
+}
+
+// SetLimit sets the traffic limit of a mode. A mode without a limit gets
+// one without a billing period, counting from now.
+func (r *Router) SetLimit(mode Mode, u LimitUpdate) error {
+	if !r.registry.Has(mode) {
+		return fmt.Errorf("invalid mode: %s", mode)
+	}
+	if u.MaxMB != nil && *u.MaxMB < 0 {
+		return fmt.Errorf("invalid limit: %d", *u.MaxMB)
+	}
+	if u.Budget != nil && *u.Budget < 0 {
+		return fmt.Errorf("invalid budget: %g", *u.Budget)
+	}
+	if u.OvershootMB != nil && *u.OvershootMB < 0 {
+		return fmt.Errorf("invalid overshoot: %d", *u.OvershootMB)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.limits[mode]
+	if !ok {
+		l = &modeLimit{
+			action:   LimitSwitch,
+			switchTo: ModeDirect,
+			pricing:  r.pricing[mode],
+			gate:     newLimitGate(mode, r.limitEvents),
+			quota:    quota{mode: mode, mark: r.metrics.GetBytes(mode.String())},
+		}
+		if mode == ModeDirect {
+			l.action, l.switchTo = LimitBlock, ""
+		}
+	}
+
+	if u.Budget != nil && *u.Budget > 0 && l.pricing == nil {
+		return fmt.Errorf("budget needs a price for %s", mode)
+	}
+	if u.Budget != nil {
+		if err := l.pricing.checkBudget(*u.Budget, l.quota.period); err != nil {
+			return err
+		}
+	}
+	var warnings []int
+	if u.Warnings != nil {
+		var err error
+		if warnings, err = parseWarnings(u.Warnings); err != nil {
+			return err
+		}
+	}
+
+	if u.Action == "" && (u.SwitchTo != "" || u.Throttle != "") {
+		u.Action = l.action
+	}
+	if u.Action != "" {
+		switchTo, spec := u.SwitchTo, u.Throttle
+		if u.Action == l.action {
+			if switchTo == "" {
+				switchTo = l.switchTo
+			}
+			if spec == "" && l.throttle != nil {
+				spec = l.throttle.spec
+			}
+		}
+		if err := l.setAction(u.Action, switchTo, spec, r.registry); err != nil {
+			return err
+		}
+	}
+
+	if u.Budget != nil {
+		l.budget = *u.Budget
+	}
+	if u.Warnings != nil {
+		l.warnings = warnings
+	}
+	if u.OvershootMB != nil {
+		l.overshoot = uint64(*u.OvershootMB) * 1024 * 1024
+	}
+	if u.MaxMB != nil {
+		l.maxBytes = uint64(*u.MaxMB) * 1024 * 1024
+	}
+	l.trend.reset() // Fractions of the old limit
+	r.limits[mode] = l
+	r.syncGateLocked(mode)
+	return nil
+}
+
+// isExhaustedLocked reports whether the mode's traffic limit is reached
+func (r *Router) isExhaustedLocked(mode Mode) bool {
+	l, ok := r.limits[mode]
+	return ok && l.exhausted(r.metrics.GetBytes(mode.String()))
+}
+
+// isBlockedLocked reports whether the mode's limit rejects new connections
+func (r *Router) isBlockedLocked(mode Mode) bool {
+	l, ok := r.limits[mode]
+	return ok && l.action != LimitThrottle && l.exhausted(r.metrics.GetBytes(mode.String()))
+}
+
+// limitUsedLocked returns the usage of the mode's limit
+func (r *Router) limitUsedLocked(mode Mode) uint64 {
+	l, ok := r.limits[mode]
+	if !ok {
+		return 0
+	}
+	return l.quota.usage(r.metrics.GetBytes(mode.String()))
+}
+
+// CheckLimits resets the period counters and the usage of limits whose
+// period is over, drops idle client accounts, then applies the action of
+// every limit that was reached
+func (r *Router) CheckLimits() {
+	now := time.Now()
+	r.rollTraffic(now)
+	r.accounting.evictIdle(now)
+
+	for _, info := range r.registry.Modes() {
+		r.rollLimit(info.Name, now)
+		r.checkLimit(info.Name)
+		r.checkWarning(info.Name, now)
+	}
+}
+
+// checkLimit applies the action of a mode's limit once it is reached
+func (r *Router) checkLimit(mode Mode) {
+	r.mu.Lock()
+	l, ok := r.limits[mode]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+
+	exhausted := l.exhausted(r.metrics.GetBytes(mode.String()))
+	if l.throttle != nil {
+		l.throttle.active.Store(exhausted && l.action == LimitThrottle)
+	}
+	if !exhausted || l.reached {
+		l.reached = l.reached && exhausted
+		r.syncGateLocked(mode)
+		r.mu.Unlock()
+		return
+	}
+	l.reached = true
+	r.syncGateLocked(mode)
+
+	action := l.action
+	throttleSpec := ""
+	if action == LimitThrottle {
+		throttleSpec = l.throttle.spec
+	}
+	counter := r.metrics.GetBytes(mode.String())
+	usedMB, limitMB := r.limitUsedLocked(mode)/1024/1024, l.maxBytes/1024/1024
+	reason := "traffic limit"
+	if !l.trafficExhausted(counter) {
+		reason = "budget"
+	}
+	budget, cost, currency := l.budget, l.cost(counter), r.currency
+	oldMode, newMode := r.mode, Mode("")
+	if action == LimitSwitch && r.mode == mode {
+		newMode = l.switchTo
+		if _, ok := r.dialers[newMode]; !ok {
+			newMode = ModeDirect
+		}
+		if newMode == mode {
+			newMode = ""
+		} else {
+			r.mode = newMode
+		}
+	}
+	r.mu.Unlock()
+
+	payload := map[string]interface{}{
+		"mode":     mode.String(),
+		"used_mb":  usedMB,
+		"limit_mb": limitMB,
+		"action":   string(action),
+	}
+	if budget > 0 {
+		payload["budget"] = budget
+		payload["cost"] = roundCost(cost)
+		payload["currency"] = currency
+	}
+	switch {
+	case newMode != "":
+		log.Printf("WARN: %s %s reached, switching to %s", mode, reason, newMode)
+		payload["switched_to"] = newMode.String()
+	case action == LimitThrottle:
+		log.Printf("WARN: %s %s reached, throttling to %s", mode, reason, throttleSpec)
+		payload["throttle"] = throttleSpec
+	default:
+		log.Printf("WARN: %s %s reached, new connections are rejected", mode, reason)
+	}
+
+	policy := r.switchPolicies.forTrigger(TriggerLimitReached)
+	if newMode != "" {
+		r.applySwitchPolicy(oldMode, policy)
+	}
+
+	// Send webhook notifications (if enabled)
+	if r.webhook == nil {
+		return
+	}
+	if r.webhookEvents.LimitReached {
+		r.webhook.Send("limit.reached", payload)
+	}
+	if newMode != "" && r.webhookEvents.ModeChanged {
+		r.webhook.Send("mode.changed", map[string]interface{}{
+			"from":    oldMode.String(),
+			"to":      newMode.String(),
+			"trigger": TriggerLimitReached,
+			"policy":  string(policy.Action),
+		})
+	}
+}
+
+// rollLimit resets the usage of a mode's limit whose billing period is over.
+// If the limit had switched away from the mode and it is the mode to return
+// to, it is switched back.
+func (r *Router) rollLimit(mode Mode, now time.Time) {
+	r.mu.Lock()
+	l, ok := r.limits[mode]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	q := &l.quota
+	counter := r.metrics.GetBytes(mode.String())
+	wasExhausted := l.exhausted(counter)
+	prevStart, prevEnd := q.start, q.end
+	used, rolled := q.roll(now, counter)
+	if !rolled {
+		r.mu.Unlock()
+		return
+	}
+	l.reached, l.warned = false, 0
+	l.trend.reset()
+	r.syncGateLocked(mode)
+	if l.throttle != nil {
+		l.throttle.active.Store(false)
+	}
+	start, end := q.start, q.end
+	restore := wasExhausted && l.action == LimitSwitch && r.preferred == mode && r.mode != mode
+	limitMB := l.maxBytes / 1024 / 1024
+	r.mu.Unlock()
+
+	log.Printf("INFO: %s billing period %s - %s ended (%d MB used), usage reset",
+		mode, prevStart.Format(time.DateOnly), prevEnd.Format(time.DateOnly), used/1024/1024)
+	if err := r.SaveState(); err != nil {
+		log.Printf("WARN: Failed to save state: %v", err)
+	}
+
+	switchedTo := ""
+	if restore {
+		if err := r.SwitchMode(mode, TriggerLimitReset); err != nil {
+			log.Printf("WARN: Failed to switch back to %s: %v", mode, err)
+		} else {
+			switchedTo = mode.String()
+		}
+	}
+
+	if r.webhook != nil && r.webhookEvents.LimitReset {
+		payload := map[string]interface{}{
+			"mode":         mode.String(),
+			"period":       string(q.period.Type),
+			"used_mb":      used / 1024 / 1024,
+			"limit_mb":     limitMB,
+			"period_start": start.Format(time.RFC3339),
+			"period_end":   end.Format(time.RFC3339),
+		}
+		if switchedTo != "" {
+			payload["switched_to"] = switchedTo
+		}
+		r.webhook.Send("limit.reset", payload)
+	}
+}
@@ -1,7 +1,9 @@
 package router
 
 import (
+	"context"
 	"net"
+	"sync"
 
 	"github.com/scinfra-pro/switch-gate/internal/metrics"
 )
@@ -9,33 +11,94 @@ import (
 // MeteredConn wraps a connection to track bytes transferred
 type MeteredConn struct {
 	net.Conn
-	mode    string
-	metrics *metrics.Metrics
+	mode     string // Mode that carries the bytes, metered and limited against
+	selected Mode   // Mode the router selected, switch policies apply to it
+	metrics  *metrics.Metrics
+
+	tracker   *connTracker // Optional
+	throttle  *throttle    // Optional, active while the mode's limit is reached
+	gates     quotaGates   // Optional, cut the flow when the mode's limit or the client's quota is used up
+	client    *clientUsage // Optional, traffic of the client through the mode
+	upload    buckets      // Optional rate limits of writes
+	download  buckets      // Optional rate limits of reads
+	release   func()       // Optional, called once on close
+	closeOnce sync.Once
+
+	// Cancelled on close, so reads and writes waiting for the rate limits return
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewMeteredConn creates a new metered connection
 func NewMeteredConn(conn net.Conn, mode string, m *metrics.Metrics) *MeteredConn {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &MeteredConn{
 		Conn:    conn,
 		mode:    mode,
 		metrics: m,
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
-// Read reads data and tracks bytes
+// Read reads data and tracks bytes. Once the mode's limit or the client's
+// quota is used up the connection is closed.
 func (m *MeteredConn) Read(b []byte) (int, error) {
-	n, err := m.Conn.Read(b)
+	size := m.gates.allow(m.download.chunk(m.throttle.chunk(len(b))))
+	if size == 0 && len(b) > 0 {
+		_ = m.Close()
+		return 0, ErrLimitExhausted
+	}
+	n, err := m.Conn.Read(b[:size])
 	if n > 0 {
 		m.metrics.AddBytes(m.mode, int64(n))
+		m.gates.count(n)
+		m.client.add(n)
+		if m.throttle.wait(m.ctx, n) != nil || m.download.wait(m.ctx, n) != nil {
+			return n, net.ErrClosed
+		}
 	}
 	return n, err
 }
 
-// Write writes data and tracks bytes
+// Write writes data and tracks bytes. Rate limited connections write in
+// chunks. Once the mode's limit or the client's quota is used up the
+// connection is closed.
 func (m *MeteredConn) Write(b []byte) (int, error) {
-	n, err := m.Conn.Write(b)
-	if n > 0 {
-		m.metrics.AddBytes(m.mode, int64(n))
+	written := 0
+	for written < len(b) {
+		chunk := m.gates.allow(m.upload.chunk(m.throttle.chunk(len(b) - written)))
+		if chunk == 0 {
+			_ = m.Close()
+			return written, ErrLimitExhausted
+		}
+		if m.throttle.wait(m.ctx, chunk) != nil || m.upload.wait(m.ctx, chunk) != nil {
+			return written, net.ErrClosed
+		}
+		n, err := m.Conn.Write(b[written : written+chunk])
+		if n > 0 {
+			m.metrics.AddBytes(m.mode, int64(n))
+			m.gates.count(n)
+			m.client.add(n)
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
 	}
-	return n, err
+	return written, nil
+}
+
+// Close closes the connection and stops tracking it
+func (m *MeteredConn) Close() error {
+	m.closeOnce.Do(func() {
+		m.cancel()
+		if m.tracker != nil {
+			m.tracker.remove(m)
+		}
+		if m.release != nil {
+			m.release()
+		}
+	})
+	return m.Conn.Close()
 }
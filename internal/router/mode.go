@@ -1,25 +1,27 @@
 package router
 
+import "regexp"
+
 // Mode represents a routing mode
 type Mode string
 
+// Well-known mode names used by the default configuration
 const (
 	ModeDirect Mode = "direct"
 	ModeWarp   Mode = "warp"
 	ModeHome   Mode = "home"
 )
 
+// modeNameRe restricts mode names to safe identifiers (used as metric labels)
+var modeNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
 // String returns the mode as a string
 func (m Mode) String() string {
 	return string(m)
 }
 
-// IsValid checks if the mode is valid
+// IsValid checks if the mode name is well-formed.
+// Whether the mode is configured is decided by the Registry.
 func (m Mode) IsValid() bool {
-	switch m {
-	case ModeDirect, ModeWarp, ModeHome:
-		return true
-	default:
-		return false
-	}
+	return modeNameRe.MatchString(string(m))
 }
@@ -0,0 +1,311 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	mrand "math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolStrategy selects a pool member for each connection
+type PoolStrategy string
+
+const (
+	StrategyRoundRobin PoolStrategy = "round_robin" // Members in turn
+	StrategyLeastConn  PoolStrategy = "least_conn"  // Member with fewest active connections
+	StrategyRandom     PoolStrategy = "random"      // Weighted random
+	StrategyHash       PoolStrategy = "hash"        // Consistent hashing on destination host
+)
+
+// DefaultPoolCooldown is how long a member that failed to dial is out of rotation
+const DefaultPoolCooldown = 30 * time.Second
+
+func (s PoolStrategy) isKnown() bool {
+	switch s {
+	case StrategyRoundRobin, StrategyLeastConn, StrategyRandom, StrategyHash:
+		return true
+	default:
+		return false
+	}
+}
+
+// poolMember is an upstream of a pool with its own statistics
+type poolMember struct {
+	mode   Mode
+	dialer Dialer
+	weight int
+
+	active    atomic.Int32
+	bytes     atomic.Uint64
+	failures  atomic.Uint64 // Total dial failures
+	downUntil atomic.Int64  // Unix nanoseconds, 0 if in rotation
+
+	mu      sync.Mutex
+	lastErr string
+}
+
+func (m *poolMember) healthy(now time.Time) bool {
+	return m.downUntil.Load() <= now.UnixNano()
+}
+
+// PoolDialer balances connections across several modes
+type PoolDialer struct {
+	name     string
+	strategy PoolStrategy
+	cooldown time.Duration
+	members  []*poolMember
+	usable   func(Mode) bool // Members the router lets new connections use (nil: all)
+	next     atomic.Uint64   // round_robin position
+}
+
+// NewPoolDialer creates an empty pool; members are added with addMember
+func NewPoolDialer(name string, strategy PoolStrategy, cooldown time.Duration) (*PoolDialer, error) {
+	if strategy == "" {
+		strategy = StrategyRoundRobin
+	}
+	if !strategy.isKnown() {
+		return nil, fmt.Errorf("unknown pool strategy %q", strategy)
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultPoolCooldown
+	}
+	return &PoolDialer{name: name, strategy: strategy, cooldown: cooldown}, nil
+}
+
+func (d *PoolDialer) addMember(mode Mode, dialer Dialer, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	d.members = append(d.members, &poolMember{mode: mode, dialer: dialer, weight: weight})
+}
+
+// memberCheckKey is the context key of the member check of a dial
+type memberCheckKey struct{}
+
+// withMemberCheck returns a context in which pools and races only dial
+// through members that usable accepts, e.g. those the client's quota allows
+func withMemberCheck(ctx context.Context, usable func(Mode) bool) context.Context {
+	return context.WithValue(ctx, memberCheckKey{}, usable)
+}
+
+// memberUsable reports whether a pool or race may dial through a member:
+// the router lets new connections use it and the check of the dial passes
+func memberUsable(ctx context.Context, usable func(Mode) bool, mode Mode) bool {
+	if usable != nil && !usable(mode) {
+		return false
+	}
+	check, _ := ctx.Value(memberCheckKey{}).(func(Mode) bool)
+	return check == nil || check(mode)
+}
+
+// DialContext connects through a member picked by the pool strategy.
+// A member that fails to dial is put in cooldown and the next one is tried;
+// members that are blocked or exhausted, or whose quota the client used up,
+// are skipped.
+func (d *PoolDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	tried := make(map[*poolMember]bool, len(d.members))
+	var errs []error
+
+	for len(tried) < len(d.members) {
+		m := d.pick(ctx, host, tried)
+		if m == nil {
+			break
+		}
+		tried[m] = true
+
+		conn, err := m.dialer.DialContext(ctx, network, address)
+		if err != nil {
+			if ctx.Err() != nil {
+				// Cancelled by the caller, not the member's fault
+				return nil, err
+			}
+			d.markFailed(m, err)
+			errs = append(errs, fmt.Errorf("%s: %w", m.mode, err))
+			continue
+		}
+
+		m.downUntil.Store(0)
+		m.active.Add(1)
+		return &poolConn{Conn: conn, member: m}, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("pool %s: no usable member (traffic limits or quotas exhausted)", d.name)
+	}
+	return nil, fmt.Errorf("pool %s: all members failed: %w", d.name, errors.Join(errs...))
+}
+
+// pick returns the next member to try, nil if no untried member is usable.
+// Members in cooldown are only picked when all usable untried members are
+// in cooldown.
+func (d *PoolDialer) pick(ctx context.Context, host string, tried map[*poolMember]bool) *poolMember {
+	now := time.Now()
+	usable := make([]*poolMember, 0, len(d.members))
+	for _, m := range d.members {
+		if !tried[m] && memberUsable(ctx, d.usable, m.mode) {
+			usable = append(usable, m)
+		}
+	}
+	if len(usable) == 0 {
+		return nil
+	}
+	candidates := make([]*poolMember, 0, len(usable))
+	for _, m := range usable {
+		if m.healthy(now) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = usable
+	}
+
+	switch d.strategy {
+	case StrategyLeastConn:
+		best := candidates[0]
+		for _, m := range candidates[1:] {
+			if m.active.Load() < best.active.Load() {
+				best = m
+			}
+		}
+		return best
+
+	case StrategyRandom:
+		total := 0
+		for _, m := range candidates {
+			total += m.weight
+		}
+		n := mrand.IntN(total)
+		for _, m := range candidates {
+			if n < m.weight {
+				return m
+			}
+			n -= m.weight
+		}
+		return candidates[len(candidates)-1]
+
+	case StrategyHash:
+		// Weighted rendezvous hashing: a destination keeps its member
+		// as long as that member stays in rotation
+		var best *poolMember
+		bestScore := math.Inf(-1)
+		for _, m := range candidates {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(m.mode))
+			_, _ = h.Write([]byte{0})
+			_, _ = h.Write([]byte(host))
+			// Map the hash to (0, 1) and weight it
+			u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+			score := -float64(m.weight) / math.Log(u)
+			if score > bestScore {
+				best, bestScore = m, score
+			}
+		}
+		return best
+
+	default:
+		return candidates[int(d.next.Add(1)-1)%len(candidates)]
+	}
+}
+
+func (d *PoolDialer) markFailed(m *poolMember, err error) {
+	m.failures.Add(1)
+	m.downUntil.Store(time.Now().Add(d.cooldown).UnixNano())
+
+	m.mu.Lock()
+	m.lastErr = err.Error()
+	m.mu.Unlock()
+}
+
+// Name returns the dialer name
+func (d *PoolDialer) Name() string {
+	return d.name
+}
+
+// Strategy returns the member selection strategy
+func (d *PoolDialer) Strategy() PoolStrategy {
+	return d.strategy
+}
+
+// PoolMemberStatus is a snapshot of a pool member
+type PoolMemberStatus struct {
+	Mode        Mode
+	Weight      int
+	Healthy     bool          // Not in cooldown
+	CooldownFor time.Duration // Remaining cooldown, 0 if healthy
+	ActiveConns int
+	Bytes       uint64
+	Failures    uint64
+	LastError   string
+}
+
+// Members returns the status of all members in configuration order
+func (d *PoolDialer) Members() []PoolMemberStatus {
+	now := time.Now()
+	result := make([]PoolMemberStatus, 0, len(d.members))
+	for _, m := range d.members {
+		st := PoolMemberStatus{
+			Mode:        m.mode,
+			Weight:      m.weight,
+			Healthy:     m.healthy(now),
+			ActiveConns: int(m.active.Load()),
+			Bytes:       m.bytes.Load(),
+			Failures:    m.failures.Load(),
+		}
+		if !st.Healthy {
+			st.CooldownFor = time.Duration(m.downUntil.Load() - now.UnixNano())
+		}
+		m.mu.Lock()
+		st.LastError = m.lastErr
+		m.mu.Unlock()
+		result = append(result, st)
+	}
+	return result
+}
+
+// poolConn counts bytes and active connections for a pool member
+type poolConn struct {
+	net.Conn
+	member *poolMember
+	once   sync.Once
+}
+
+// dialedMode returns the member mode, so the router meters and limits the
+// connection against the member that carries it
+func (c *poolConn) dialedMode() Mode {
+	if mc, ok := c.Conn.(modeConn); ok {
+		return mc.dialedMode()
+	}
+	return c.member.mode
+}
+
+func (c *poolConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.member.bytes.Add(uint64(n))
+	}
+	return n, err
+}
+
+func (c *poolConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.member.bytes.Add(uint64(n))
+	}
+	return n, err
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() { c.member.active.Add(-1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,217 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// Pricing defaults
+const (
+	DefaultCurrency       = "USD"
+	DefaultHomePricePerGB = 3.50 // home without a configured price
+)
+
+// bytesPerGB is the size of the GB traffic is priced in
+const bytesPerGB = 1 << 30
+
+// priceTier is the price of the traffic up to a volume
+type priceTier struct {
+	upTo  uint64 // Bytes, 0 = no bound
+	perGB float64
+}
+
+// pricing is the price of a mode's traffic
+type pricing struct {
+	tiers   []priceTier // Graduated: each tier prices the bytes within it
+	monthly float64
+}
+
+// newPricing parses the configured prices. home is priced at
+// DefaultHomePricePerGB unless configured.
+func newPricing(cfg config.PricingConfig, registry *Registry) (map[Mode]*pricing, string, error) {
+	currency := cfg.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+
+	prices := make(map[Mode]*pricing)
+	if _, ok := cfg.Modes[ModeHome.String()]; !ok && registry.Has(ModeHome) {
+		prices[ModeHome] = &pricing{tiers: []priceTier{{perGB: DefaultHomePricePerGB}}}
+	}
+
+	for name, c := range cfg.Modes {
+		mode := Mode(name)
+		if !registry.Has(mode) {
+			return nil, "", fmt.Errorf("price for unknown mode: %s", name)
+		}
+		if c.PerGB < 0 || c.Monthly < 0 {
+			return nil, "", fmt.Errorf("%s: prices must not be negative", name)
+		}
+		if c.PerGB > 0 && len(c.Tiers) > 0 {
+			return nil, "", fmt.Errorf("%s: per_gb and tiers are exclusive", name)
+		}
+
+		p := &pricing{monthly: c.Monthly}
+		if len(c.Tiers) == 0 {
+			p.tiers = []priceTier{{perGB: c.PerGB}}
+		}
+		var prev float64
+		for i, t := range c.Tiers {
+			last := i == len(c.Tiers)-1
+			switch {
+			case t.PerGB < 0:
+				return nil, "", fmt.Errorf("%s: tier %d: prices must not be negative", name, i+1)
+			case t.UpToGB == 0 && !last:
+				return nil, "", fmt.Errorf("%s: tier %d: only the last tier may omit up_to_gb", name, i+1)
+			case t.UpToGB != 0 && !last && t.UpToGB <= prev:
+				return nil, "", fmt.Errorf("%s: tier %d: up_to_gb must increase", name, i+1)
+			}
+			prev = t.UpToGB
+			p.tiers = append(p.tiers, priceTier{upTo: uint64(t.UpToGB * bytesPerGB), perGB: t.PerGB})
+		}
+		if len(p.tiers) > 0 {
+			// The last tier prices all traffic beyond the others
+			p.tiers[len(p.tiers)-1].upTo = 0
+		}
+		prices[mode] = p
+	}
+	return prices, currency, nil
+}
+
+// variable returns the cost of bytes of traffic in one period
+func (p *pricing) variable(bytes uint64) float64 {
+	var cost float64
+	var from uint64
+	for _, t := range p.tiers {
+		to := bytes
+		if t.upTo != 0 {
+			to = min(bytes, t.upTo)
+		}
+		if to > from {
+			cost += float64(to-from) / bytesPerGB * t.perGB
+		}
+		if t.upTo == 0 || bytes <= t.upTo {
+			break
+		}
+		from = t.upTo
+	}
+	return cost
+}
+
+// bytesFor returns the traffic whose variable cost reaches amount
+// (math.MaxUint64 if it never does)
+func (p *pricing) bytesFor(amount float64) uint64 {
+	var from uint64
+	for _, t := range p.tiers {
+		if t.upTo == 0 {
+			if t.perGB <= 0 {
+				return math.MaxUint64
+			}
+			return from + uint64(amount/t.perGB*bytesPerGB)
+		}
+		band := float64(t.upTo-from) / bytesPerGB * t.perGB
+		if amount <= band && t.perGB > 0 {
+			return from + uint64(amount/t.perGB*bytesPerGB)
+		}
+		amount -= band
+		from = t.upTo
+	}
+	return math.MaxUint64
+}
+
+// fixed returns the fixed cost of a period: the monthly cost for monthly
+// periods, else prorated to the period length (30-day months). Usage that
+// never resets has no fixed cost.
+func (p *pricing) fixed(period *Period, start, end time.Time) float64 {
+	switch {
+	case period == nil || p.monthly == 0:
+		return 0
+	case period.Type == PeriodMonthly:
+		return p.monthly
+	default:
+		return p.monthly * end.Sub(start).Hours() / (30 * 24)
+	}
+}
+
+// maxFixed returns the largest fixed cost of a period: clock changes make
+// prorated periods up to an hour longer than their nominal length
+func (p *pricing) maxFixed(period *Period) float64 {
+	if p == nil || period == nil {
+		return 0
+	}
+	days := period.days
+	switch period.Type {
+	case PeriodMonthly:
+		return p.fixed(period, time.Time{}, time.Time{})
+	case PeriodDaily:
+		days = 1
+	case PeriodWeekly:
+		days = 7
+	}
+	start := time.Time{}
+	return p.fixed(period, start, start.Add(time.Duration(days)*24*time.Hour+time.Hour))
+}
+
+// checkBudget rejects a budget the fixed cost of a period already uses up:
+// the mode would be exhausted from the start of every period
+func (p *pricing) checkBudget(budget float64, period *Period) error {
+	if fixed := p.maxFixed(period); budget > 0 && budget <= fixed {
+		return fmt.Errorf("budget %g does not exceed the fixed cost of a period (%.2f)", budget, fixed)
+	}
+	return nil
+}
+
+// cost returns the spend of a period with bytes of traffic (nil: free)
+func (p *pricing) cost(bytes uint64, period *Period, start, end time.Time) float64 {
+	if p == nil {
+		return 0
+	}
+	return p.fixed(period, start, end) + p.variable(bytes)
+}
+
+// roundCost rounds a cost to cents
+func roundCost(c float64) float64 {
+	return math.Round(c*100) / 100
+}
+
+// ModeSpend is the spend of a mode
+type ModeSpend struct {
+	Mode   Mode
+	Period float64 // Current accounting period
+	Total  float64 // All accounting periods (since the first start with persisted state)
+}
+
+// SpendStatus is the spend of every priced mode in the accounting period
+type SpendStatus struct {
+	Currency string
+	Period   PeriodType
+	Start    time.Time
+	End      time.Time
+	Modes    []ModeSpend // Configuration order
+}
+
+// Spend returns the spend of every priced mode
+func (r *Router) Spend() SpendStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t := r.traffic
+	status := SpendStatus{Currency: r.currency, Period: t.period.Type, Start: t.start, End: t.end}
+	for _, info := range r.registry.Modes() {
+		p, ok := r.pricing[info.Name]
+		if !ok {
+			continue
+		}
+		used := t.modes[info.Name].usage(r.metrics.GetBytes(info.Name.String()))
+		period := p.cost(used, t.period, t.start, t.end)
+		status.Modes = append(status.Modes, ModeSpend{
+			Mode:   info.Name,
+			Period: period,
+			Total:  t.spent[info.Name] + period,
+		})
+	}
+	return status
+}
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// testPricing returns pricing with the given tiers; upTo in GB, 0 = no bound
+func testPricing(monthly float64, tiers ...[2]float64) *pricing {
+	p := &pricing{monthly: monthly}
+	for _, t := range tiers {
+		p.tiers = append(p.tiers, priceTier{upTo: uint64(t[0] * bytesPerGB), perGB: t[1]})
+	}
+	return p
+}
+
+func TestPricingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		pricing *pricing
+		amounts []float64
+	}{
+		{"flat", testPricing(0, [2]float64{0, 3.5}),
+			[]float64{0, 0.01, 1, 3.5, 1234.56}},
+		{"tiers", testPricing(0, [2]float64{10, 5}, [2]float64{100, 2}, [2]float64{0, 1}),
+			[]float64{0, 1, 49.99, 50, 50.01, 229.9, 230, 230.5, 1000}},
+		{"free first tier", testPricing(0, [2]float64{10, 0}, [2]float64{20, 2}, [2]float64{0, 1}),
+			[]float64{0.5, 19.99, 20, 20.5, 100}},
+		{"free middle tier", testPricing(0, [2]float64{10, 1}, [2]float64{20, 0}, [2]float64{0, 3}),
+			[]float64{0, 5, 10, 10.5, 99}},
+		{"fractional tier bounds", testPricing(0, [2]float64{0.5, 4}, [2]float64{0, 0.25}),
+			[]float64{1, 2, 2.25, 10}},
+	}
+
+	for _, tt := range tests {
+		for _, amount := range tt.amounts {
+			bytes := tt.pricing.bytesFor(amount)
+			if bytes == math.MaxUint64 {
+				t.Errorf("%s: bytesFor(%g) never reaches the amount", tt.name, amount)
+				continue
+			}
+			if got := tt.pricing.variable(bytes); math.Abs(got-amount) > 1e-6 {
+				t.Errorf("%s: variable(bytesFor(%g)) = %g", tt.name, amount, got)
+			}
+			// One byte less stays below a positive amount
+			if amount > 0 && bytes > 0 && tt.pricing.variable(bytes-1) >= amount+1e-9 {
+				t.Errorf("%s: bytesFor(%g) = %d is not the least traffic", tt.name, amount, bytes)
+			}
+		}
+	}
+}
+
+func TestPricingFree(t *testing.T) {
+	tests := []struct {
+		name    string
+		pricing *pricing
+		amount  float64
+	}{
+		{"free", testPricing(0, [2]float64{0, 0}), 1},
+		{"free beyond the tiers", testPricing(0, [2]float64{10, 1}, [2]float64{0, 0}), 10.01},
+		{"free after a free tier", testPricing(0, [2]float64{10, 0}, [2]float64{0, 0}), 0.01},
+	}
+	for _, tt := range tests {
+		if got := tt.pricing.bytesFor(tt.amount); got != math.MaxUint64 {
+			t.Errorf("%s: bytesFor(%g) = %d, want never", tt.name, tt.amount, got)
+		}
+	}
+
+	// Within the paid tier the amount is still reached
+	p := testPricing(0, [2]float64{10, 1}, [2]float64{0, 0})
+	if got := p.variable(p.bytesFor(10)); math.Abs(got-10) > 1e-6 {
+		t.Errorf("variable(bytesFor(10)) = %g", got)
+	}
+	if got := p.variable(1000 * bytesPerGB); got != 10 {
+		t.Errorf("variable(1000 GB) = %g, want 10", got)
+	}
+}
+
+func TestPricingVariable(t *testing.T) {
+	p := testPricing(0, [2]float64{10, 5}, [2]float64{100, 2}, [2]float64{0, 1})
+	tests := []struct {
+		gb   float64
+		want float64
+	}{
+		{0, 0},
+		{1, 5},
+		{10, 50},
+		{11, 52},
+		{100, 230},
+		{150, 280},
+	}
+	for _, tt := range tests {
+		if got := p.variable(uint64(tt.gb * bytesPerGB)); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("variable(%g GB) = %g, want %g", tt.gb, got, tt.want)
+		}
+	}
+}
+
+func TestPricingFixed(t *testing.T) {
+	p := testPricing(30, [2]float64{0, 1})
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		cfg  config.PeriodConfig
+		end  time.Time
+		want float64
+		max  float64
+	}{
+		{config.PeriodConfig{Type: "monthly"}, start.AddDate(0, 1, 0), 30, 30},
+		{config.PeriodConfig{Type: "daily"}, start.AddDate(0, 0, 1), 1, 25.0 / 24},
+		{config.PeriodConfig{Type: "weekly"}, start.AddDate(0, 0, 7), 7, 7 + 1.0/24},
+		{config.PeriodConfig{Type: "rolling", Days: 15}, start.AddDate(0, 0, 15), 15, 15 + 1.0/24},
+	}
+	for _, tt := range tests {
+		period, err := NewPeriod(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.fixed(period, start, tt.end); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: fixed = %g, want %g", tt.cfg.Type, got, tt.want)
+		}
+		if got := p.maxFixed(period); math.Abs(got-tt.max) > 1e-9 {
+			t.Errorf("%s: maxFixed = %g, want %g", tt.cfg.Type, got, tt.max)
+		}
+	}
+
+	if got := p.fixed(nil, start, start.AddDate(0, 1, 0)); got != 0 {
+		t.Errorf("fixed without period = %g, want 0", got)
+	}
+}
+
+func TestPricingCheckBudget(t *testing.T) {
+	monthly, _ := NewPeriod(config.PeriodConfig{Type: "monthly"})
+	daily, _ := NewPeriod(config.PeriodConfig{Type: "daily"})
+
+	tests := []struct {
+		name    string
+		pricing *pricing
+		budget  float64
+		period  *Period
+		wantErr bool
+	}{
+		{"below monthly cost", testPricing(30, [2]float64{0, 1}), 20, monthly, true},
+		{"at monthly cost", testPricing(30, [2]float64{0, 1}), 30, monthly, true},
+		{"above monthly cost", testPricing(30, [2]float64{0, 1}), 30.01, monthly, false},
+		{"prorated daily cost", testPricing(30, [2]float64{0, 1}), 1.02, daily, true},
+		{"above a long day", testPricing(30, [2]float64{0, 1}), 1.05, daily, false},
+		{"no budget", testPricing(30, [2]float64{0, 1}), 0, monthly, false},
+		{"no period", testPricing(30, [2]float64{0, 1}), 5, nil, false},
+		{"no fixed cost", testPricing(0, [2]float64{0, 1}), 0.01, monthly, false},
+	}
+	for _, tt := range tests {
+		if err := tt.pricing.checkBudget(tt.budget, tt.period); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkBudget(%g) = %v", tt.name, tt.budget, err)
+		}
+	}
+}
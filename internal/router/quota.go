@@ -0,0 +1,162 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// PeriodType is how often the usage of a limit resets
+type PeriodType string
+
+// Billing period types
+const (
+	PeriodDaily   PeriodType = "daily"
+	PeriodWeekly  PeriodType = "weekly"
+	PeriodMonthly PeriodType = "monthly"
+	PeriodRolling PeriodType = "rolling" // Every N days from the first start
+)
+
+// Period is a billing period. Periods start at midnight in their timezone.
+type Period struct {
+	Type     PeriodType
+	resetDay int          // monthly
+	weekday  time.Weekday // weekly
+	days     int          // rolling
+	location *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday,
+	"wednesday": time.Wednesday, "thursday": time.Thursday, "friday": time.Friday,
+	"saturday": time.Saturday,
+}
+
+// NewPeriod parses a billing period; returns nil if no period is configured
+func NewPeriod(cfg config.PeriodConfig) (*Period, error) {
+	if cfg.Type == "" {
+		return nil, nil
+	}
+
+	p := &Period{Type: PeriodType(cfg.Type), location: time.Local}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %w", err)
+		}
+		p.location = loc
+	}
+
+	switch p.Type {
+	case PeriodDaily:
+	case PeriodWeekly:
+		p.weekday = time.Monday
+		if cfg.Weekday != "" {
+			wd, ok := weekdays[strings.ToLower(cfg.Weekday)]
+			if !ok {
+				return nil, fmt.Errorf("invalid weekday: %s", cfg.Weekday)
+			}
+			p.weekday = wd
+		}
+	case PeriodMonthly:
+		p.resetDay = cfg.ResetDay
+		if p.resetDay == 0 {
+			p.resetDay = 1
+		}
+		if p.resetDay < 1 || p.resetDay > 31 {
+			return nil, fmt.Errorf("invalid reset_day: %d (1-31)", cfg.ResetDay)
+		}
+	case PeriodRolling:
+		if cfg.Days < 1 {
+			return nil, fmt.Errorf("rolling period needs days >= 1")
+		}
+		p.days = cfg.Days
+	default:
+		return nil, fmt.Errorf("unknown period %q (daily, weekly, monthly, rolling)", cfg.Type)
+	}
+	return p, nil
+}
+
+// bounds returns the period containing t. Rolling periods continue from
+// anchor, the start of an earlier period (zero: start a new one today).
+func (p *Period) bounds(t, anchor time.Time) (start, end time.Time) {
+	t = t.In(p.location)
+	y, m, d := t.Date()
+	midnight := func(y int, m time.Month, d int) time.Time {
+		day := time.Date(y, m, d, 0, 0, 0, 0, p.location)
+		if day.Hour() != 0 || day.Minute() != 0 {
+			// Midnight skipped by a clock change: the day starts with the change
+			_, day = day.ZoneBounds()
+		}
+		return day
+	}
+
+	switch p.Type {
+	case PeriodDaily:
+		return midnight(y, m, d), midnight(y, m, d+1)
+
+	case PeriodWeekly:
+		back := (int(t.Weekday()) - int(p.weekday) + 7) % 7
+		return midnight(y, m, d-back), midnight(y, m, d-back+7)
+
+	case PeriodMonthly:
+		// The reset day is clamped to the length of short months
+		reset := func(y int, m time.Month) time.Time {
+			last := midnight(y, m+1, 0).Day()
+			return midnight(y, m, min(p.resetDay, last))
+		}
+		start = reset(y, m)
+		if t.Before(start) {
+			start = reset(y, m-1)
+			return start, reset(y, m)
+		}
+		return start, reset(y, m+1)
+
+	default: // rolling
+		if anchor.IsZero() || anchor.After(t) {
+			start = midnight(y, m, d)
+		} else {
+			start = anchor.In(p.location)
+		}
+		next := func(from time.Time) time.Time {
+			y, m, d := from.Date()
+			return midnight(y, m, d+p.days)
+		}
+		end = next(start)
+		for !t.Before(end) {
+			start, end = end, next(end)
+		}
+		return start, end
+	}
+}
+
+// quota is the usage of a mode's limit in the current billing period.
+// Usage is the bytes counted up to the last sync plus the growth of the
+// mode's byte counter since.
+type quota struct {
+	mode       Mode
+	period     *Period // nil: usage never resets
+	start, end time.Time
+	used       uint64 // Bytes used in the period up to mark
+	mark       uint64 // Byte counter of the mode when used was taken
+}
+
+// usage returns the bytes used in the current period
+func (q *quota) usage(counter uint64) uint64 {
+	return q.used + counter - q.mark
+}
+
+// roll starts the period containing now if the current one is over.
+// Returns the usage of the period that ended and whether it did.
+func (q *quota) roll(now time.Time, counter uint64) (uint64, bool) {
+	if q.period == nil || now.Before(q.end) {
+		return 0, false
+	}
+
+	used := q.usage(counter)
+	q.start, q.end = q.period.bounds(now, q.end)
+	q.used, q.mark = 0, counter
+	return used, true
+}
@@ -0,0 +1,160 @@
+package router
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // Zones with DST and offset changes on any host
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+func TestPeriodBounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.PeriodConfig
+		at        string
+		anchor    string // rolling: start of an earlier period
+		wantStart string
+		wantEnd   string
+	}{
+		// daily
+		{"daily", config.PeriodConfig{Type: "daily", Timezone: "UTC"},
+			"2026-05-10T13:45:00Z", "", "2026-05-10T00:00:00Z", "2026-05-11T00:00:00Z"},
+		{"daily at midnight", config.PeriodConfig{Type: "daily", Timezone: "UTC"},
+			"2026-05-10T00:00:00Z", "", "2026-05-10T00:00:00Z", "2026-05-11T00:00:00Z"},
+		{"daily in timezone", config.PeriodConfig{Type: "daily", Timezone: "Asia/Tokyo"},
+			"2026-05-31T20:00:00Z", "", "2026-06-01T00:00:00+09:00", "2026-06-02T00:00:00+09:00"},
+		{"daily DST start (23h)", config.PeriodConfig{Type: "daily", Timezone: "Europe/Berlin"},
+			"2026-03-29T12:00:00+02:00", "", "2026-03-29T00:00:00+01:00", "2026-03-30T00:00:00+02:00"},
+		{"daily DST end (25h)", config.PeriodConfig{Type: "daily", Timezone: "Europe/Berlin"},
+			"2026-10-25T12:00:00+01:00", "", "2026-10-25T00:00:00+02:00", "2026-10-26T00:00:00+01:00"},
+		{"daily midnight skipped", config.PeriodConfig{Type: "daily", Timezone: "America/Santiago"},
+			"2026-09-06T12:00:00-03:00", "", "2026-09-06T01:00:00-03:00", "2026-09-07T00:00:00-03:00"},
+		{"daily before skipped midnight", config.PeriodConfig{Type: "daily", Timezone: "America/Santiago"},
+			"2026-09-05T23:30:00-04:00", "", "2026-09-05T00:00:00-04:00", "2026-09-06T01:00:00-03:00"},
+		{"daily offset change", config.PeriodConfig{Type: "daily", Timezone: "Europe/Volgograd"},
+			"2020-12-27T12:00:00+03:00", "", "2020-12-27T00:00:00+04:00", "2020-12-28T00:00:00+03:00"},
+
+		// weekly
+		{"weekly default monday", config.PeriodConfig{Type: "weekly", Timezone: "UTC"},
+			"2026-05-10T10:00:00Z", "", "2026-05-04T00:00:00Z", "2026-05-11T00:00:00Z"},
+		{"weekly on the weekday", config.PeriodConfig{Type: "weekly", Timezone: "UTC"},
+			"2026-05-11T00:00:00Z", "", "2026-05-11T00:00:00Z", "2026-05-18T00:00:00Z"},
+		{"weekly sunday", config.PeriodConfig{Type: "weekly", Weekday: "Sunday", Timezone: "UTC"},
+			"2026-05-16T23:59:59Z", "", "2026-05-10T00:00:00Z", "2026-05-17T00:00:00Z"},
+		{"weekly across DST", config.PeriodConfig{Type: "weekly", Timezone: "Europe/Berlin"},
+			"2026-03-29T12:00:00+02:00", "", "2026-03-23T00:00:00+01:00", "2026-03-30T00:00:00+02:00"},
+		{"weekly across year", config.PeriodConfig{Type: "weekly", Weekday: "wednesday", Timezone: "UTC"},
+			"2027-01-01T08:00:00Z", "", "2026-12-30T00:00:00Z", "2027-01-06T00:00:00Z"},
+
+		// monthly
+		{"monthly default day 1", config.PeriodConfig{Type: "monthly", Timezone: "UTC"},
+			"2026-05-10T10:00:00Z", "", "2026-05-01T00:00:00Z", "2026-06-01T00:00:00Z"},
+		{"monthly before reset day", config.PeriodConfig{Type: "monthly", ResetDay: 15, Timezone: "UTC"},
+			"2026-05-14T23:59:59Z", "", "2026-04-15T00:00:00Z", "2026-05-15T00:00:00Z"},
+		{"monthly across year", config.PeriodConfig{Type: "monthly", ResetDay: 15, Timezone: "UTC"},
+			"2026-01-10T00:00:00Z", "", "2025-12-15T00:00:00Z", "2026-01-15T00:00:00Z"},
+		{"monthly 31 in february", config.PeriodConfig{Type: "monthly", ResetDay: 31, Timezone: "UTC"},
+			"2026-02-15T00:00:00Z", "", "2026-01-31T00:00:00Z", "2026-02-28T00:00:00Z"},
+		{"monthly 31 on the clamped day", config.PeriodConfig{Type: "monthly", ResetDay: 31, Timezone: "UTC"},
+			"2026-02-28T00:00:00Z", "", "2026-02-28T00:00:00Z", "2026-03-31T00:00:00Z"},
+		{"monthly 31 in march", config.PeriodConfig{Type: "monthly", ResetDay: 31, Timezone: "UTC"},
+			"2026-03-15T00:00:00Z", "", "2026-02-28T00:00:00Z", "2026-03-31T00:00:00Z"},
+		{"monthly 31 in april", config.PeriodConfig{Type: "monthly", ResetDay: 31, Timezone: "UTC"},
+			"2026-04-30T12:00:00Z", "", "2026-04-30T00:00:00Z", "2026-05-31T00:00:00Z"},
+		{"monthly 31 leap year", config.PeriodConfig{Type: "monthly", ResetDay: 31, Timezone: "UTC"},
+			"2028-02-29T10:00:00Z", "", "2028-02-29T00:00:00Z", "2028-03-31T00:00:00Z"},
+		{"monthly 30 leap year", config.PeriodConfig{Type: "monthly", ResetDay: 30, Timezone: "UTC"},
+			"2028-02-28T10:00:00Z", "", "2028-01-30T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"monthly in timezone", config.PeriodConfig{Type: "monthly", Timezone: "Asia/Tokyo"},
+			"2026-05-31T20:00:00Z", "", "2026-06-01T00:00:00+09:00", "2026-07-01T00:00:00+09:00"},
+		{"monthly across DST", config.PeriodConfig{Type: "monthly", Timezone: "Europe/Berlin"},
+			"2026-03-31T12:00:00+02:00", "", "2026-03-01T00:00:00+01:00", "2026-04-01T00:00:00+02:00"},
+
+		// rolling
+		{"rolling without anchor", config.PeriodConfig{Type: "rolling", Days: 7, Timezone: "UTC"},
+			"2026-05-10T13:00:00Z", "", "2026-05-10T00:00:00Z", "2026-05-17T00:00:00Z"},
+		{"rolling anchor in the future", config.PeriodConfig{Type: "rolling", Days: 7, Timezone: "UTC"},
+			"2026-05-10T13:00:00Z", "2026-06-01T00:00:00Z", "2026-05-10T00:00:00Z", "2026-05-17T00:00:00Z"},
+		{"rolling within the anchor period", config.PeriodConfig{Type: "rolling", Days: 30, Timezone: "UTC"},
+			"2026-01-15T00:00:00Z", "2026-01-01T00:00:00Z", "2026-01-01T00:00:00Z", "2026-01-31T00:00:00Z"},
+		{"rolling periods later", config.PeriodConfig{Type: "rolling", Days: 30, Timezone: "UTC"},
+			"2026-03-15T00:00:00Z", "2026-01-01T00:00:00Z", "2026-03-02T00:00:00Z", "2026-04-01T00:00:00Z"},
+		{"rolling at the period end", config.PeriodConfig{Type: "rolling", Days: 30, Timezone: "UTC"},
+			"2026-01-31T00:00:00Z", "2026-01-01T00:00:00Z", "2026-01-31T00:00:00Z", "2026-03-02T00:00:00Z"},
+		{"rolling across DST", config.PeriodConfig{Type: "rolling", Days: 7, Timezone: "Europe/Berlin"},
+			"2026-04-02T12:00:00+02:00", "2026-03-23T00:00:00+01:00", "2026-03-30T00:00:00+02:00", "2026-04-06T00:00:00+02:00"},
+		{"rolling across skipped midnight", config.PeriodConfig{Type: "rolling", Days: 2, Timezone: "America/Santiago"},
+			"2026-09-07T12:00:00-03:00", "2026-09-04T00:00:00-04:00", "2026-09-06T01:00:00-03:00", "2026-09-08T00:00:00-03:00"},
+		{"rolling after skipped midnight", config.PeriodConfig{Type: "rolling", Days: 2, Timezone: "America/Santiago"},
+			"2026-09-09T12:00:00-03:00", "2026-09-04T00:00:00-04:00", "2026-09-08T00:00:00-03:00", "2026-09-10T00:00:00-03:00"},
+	}
+
+	parse := func(s string) time.Time {
+		if s == "" {
+			return time.Time{}
+		}
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	for _, tt := range tests {
+		p, err := NewPeriod(tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		start, end := p.bounds(parse(tt.at), parse(tt.anchor))
+		if !start.Equal(parse(tt.wantStart)) || !end.Equal(parse(tt.wantEnd)) {
+			t.Errorf("%s: bounds(%s) = %s, %s; want %s, %s", tt.name, tt.at,
+				start.Format(time.RFC3339), end.Format(time.RFC3339), tt.wantStart, tt.wantEnd)
+		}
+	}
+}
+
+func TestQuotaRoll(t *testing.T) {
+	p, err := NewPeriod(config.PeriodConfig{Type: "rolling", Days: 10, Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := &quota{period: p, start: start, end: start.AddDate(0, 0, 10), used: 100, mark: 1000}
+
+	if _, rolled := q.roll(start.AddDate(0, 0, 9), 1500); rolled {
+		t.Fatal("rolled within the period")
+	}
+
+	// Several periods missed: the new one continues the schedule
+	used, rolled := q.roll(time.Date(2026, 2, 5, 12, 0, 0, 0, time.UTC), 1500)
+	if !rolled || used != 600 {
+		t.Fatalf("roll = %d, %v; want 600, true", used, rolled)
+	}
+	if want := time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC); !q.start.Equal(want) || !q.end.Equal(want.AddDate(0, 0, 10)) {
+		t.Errorf("period %s - %s, want from %s", q.start, q.end, want)
+	}
+	if q.usage(1700) != 200 {
+		t.Errorf("usage = %d, want 200", q.usage(1700))
+	}
+}
+
+func TestNewPeriodErrors(t *testing.T) {
+	tests := []config.PeriodConfig{
+		{Type: "hourly"},
+		{Type: "weekly", Weekday: "someday"},
+		{Type: "monthly", ResetDay: 32},
+		{Type: "monthly", ResetDay: -1},
+		{Type: "rolling"},
+		{Type: "daily", Timezone: "Mars/Olympus_Mons"},
+	}
+	for _, cfg := range tests {
+		if _, err := NewPeriod(cfg); err == nil {
+			t.Errorf("NewPeriod(%+v) succeeded", cfg)
+		}
+	}
+
+	if p, err := NewPeriod(config.PeriodConfig{}); p != nil || err != nil {
+		t.Errorf("NewPeriod(empty) = %v, %v; want nil, nil", p, err)
+	}
+}
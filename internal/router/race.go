@@ -0,0 +1,177 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRaceStagger is the delay before the next member joins a race
+// (RFC 8305 "Connection Attempt Delay")
+const DefaultRaceStagger = 250 * time.Millisecond
+
+// modeConn is implemented by connections that know which mode carried them,
+// so the router meters their bytes against that mode
+type modeConn interface {
+	dialedMode() Mode
+}
+
+// raceMember is a participant of a race with its statistics
+type raceMember struct {
+	mode     Mode
+	dialer   Dialer
+	wins     atomic.Uint64
+	failures atomic.Uint64
+}
+
+// RaceDialer dials through several modes with a staggered start
+// and keeps the first connection that succeeds
+type RaceDialer struct {
+	name    string
+	stagger time.Duration
+	members []*raceMember
+	usable  func(Mode) bool // Members the router lets new connections use (nil: all)
+	races   atomic.Uint64
+}
+
+// NewRaceDialer creates an empty race; members are added with addMember
+func NewRaceDialer(name string, stagger time.Duration) *RaceDialer {
+	if stagger <= 0 {
+		stagger = DefaultRaceStagger
+	}
+	return &RaceDialer{name: name, stagger: stagger}
+}
+
+func (d *RaceDialer) addMember(mode Mode, dialer Dialer) {
+	d.members = append(d.members, &raceMember{mode: mode, dialer: dialer})
+}
+
+type raceResult struct {
+	member *raceMember
+	conn   net.Conn
+	err    error
+}
+
+// DialContext starts the members in order, one every stagger interval (or
+// right away when the previous one failed). The first connection wins, the
+// other dials are cancelled. Members that are blocked or exhausted, or whose
+// quota the client used up, do not take part.
+func (d *RaceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	members := make([]*raceMember, 0, len(d.members))
+	for _, m := range d.members {
+		if memberUsable(ctx, d.usable, m.mode) {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("race %s: no usable member (traffic limits or quotas exhausted)", d.name)
+	}
+	d.races.Add(1)
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, len(members))
+	next, pending := 0, 0
+	startNext := func() {
+		m := members[next]
+		next++
+		pending++
+		go func() {
+			conn, err := m.dialer.DialContext(raceCtx, network, address)
+			results <- raceResult{member: m, conn: conn, err: err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(d.stagger)
+	defer timer.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				r.member.wins.Add(1)
+				go closeLosers(results, pending)
+				return &raceConn{Conn: r.conn, mode: r.member.mode}, nil
+			}
+
+			r.member.failures.Add(1)
+			errs = append(errs, fmt.Errorf("%s: %w", r.member.mode, r.err))
+			if next < len(members) {
+				startNext()
+				timer.Reset(d.stagger)
+			}
+
+		case <-timer.C:
+			if next < len(members) {
+				startNext()
+				timer.Reset(d.stagger)
+			}
+
+		case <-ctx.Done():
+			go closeLosers(results, pending)
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, fmt.Errorf("race %s: all members failed: %w", d.name, errors.Join(errs...))
+}
+
+// closeLosers waits for the remaining (cancelled) dials of a decided race
+// and closes connections that were established anyway
+func closeLosers(results <-chan raceResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.conn != nil {
+			_ = r.conn.Close()
+		}
+	}
+}
+
+// Name returns the dialer name
+func (d *RaceDialer) Name() string {
+	return d.name
+}
+
+// Races returns the number of races run
+func (d *RaceDialer) Races() uint64 {
+	return d.races.Load()
+}
+
+// RaceMemberStatus is a snapshot of a race member's statistics
+type RaceMemberStatus struct {
+	Mode     Mode
+	Wins     uint64
+	Failures uint64 // Failed dials before the race was decided
+}
+
+// Members returns the statistics of all members in configuration order
+func (d *RaceDialer) Members() []RaceMemberStatus {
+	result := make([]RaceMemberStatus, 0, len(d.members))
+	for _, m := range d.members {
+		result = append(result, RaceMemberStatus{
+			Mode:     m.mode,
+			Wins:     m.wins.Load(),
+			Failures: m.failures.Load(),
+		})
+	}
+	return result
+}
+
+// raceConn is the winning connection of a race
+type raceConn struct {
+	net.Conn
+	mode Mode
+}
+
+func (c *raceConn) dialedMode() Mode {
+	if mc, ok := c.Conn.(modeConn); ok {
+		return mc.dialedMode()
+	}
+	return c.mode
+}
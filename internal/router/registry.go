@@ -0,0 +1,361 @@
+package router
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// ModeType is the kind of dialer behind a mode
+type ModeType string
+
+const (
+	TypeDirect ModeType = "direct" // Server's own routing, optionally bound to a local IP
+	TypeTunnel ModeType = "tunnel" // Tunnel interface via policy routing
+	TypeSocks5 ModeType = "socks5" // Upstream SOCKS5 proxy
+	TypeHTTP   ModeType = "http"   // Upstream HTTP CONNECT proxy
+	TypeHTTPS  ModeType = "https"  // Upstream HTTP CONNECT proxy over TLS
+
+	TypeShadowsocks ModeType = "shadowsocks" // Shadowsocks AEAD / 2022 server
+
+	TypeChain ModeType = "chain" // Proxy chain across other modes
+	TypePool  ModeType = "pool"  // Load-balanced set of other modes
+	TypeRace  ModeType = "race"  // Other modes dialed in parallel, first success wins
+)
+
+// legacyTypes infers the type of the well-known modes when it is omitted
+var legacyTypes = map[Mode]ModeType{
+	ModeDirect: TypeDirect,
+	ModeWarp:   TypeTunnel,
+	ModeHome:   TypeSocks5,
+}
+
+// ModeInfo describes a configured mode
+type ModeInfo struct {
+	Name   Mode
+	Type   ModeType
+	Config config.ModeConfig
+}
+
+// Registry holds the configured modes in configuration order
+type Registry struct {
+	modes []ModeInfo
+	index map[Mode]int
+}
+
+// NewRegistry builds the mode registry from configuration.
+// A direct mode is always registered, even if not configured.
+func NewRegistry(cfg config.ModesConfig) (*Registry, error) {
+	reg := &Registry{index: make(map[Mode]int)}
+
+	for _, mc := range cfg {
+		name := Mode(mc.Name)
+		if !name.IsValid() {
+			return nil, fmt.Errorf("invalid mode name: %q", mc.Name)
+		}
+
+		typ := ModeType(mc.Type)
+		if typ == "" {
+			legacy, ok := legacyTypes[name]
+			if !ok {
+				return nil, fmt.Errorf("mode %s: type is required", name)
+			}
+			typ = legacy
+		}
+		if !typ.isKnown() {
+			return nil, fmt.Errorf("mode %s: unknown type %q", name, typ)
+		}
+
+		reg.add(ModeInfo{Name: name, Type: typ, Config: mc})
+	}
+
+	if !reg.Has(ModeDirect) {
+		reg.add(ModeInfo{
+			Name:   ModeDirect,
+			Type:   TypeDirect,
+			Config: config.ModeConfig{Name: ModeDirect.String()},
+		})
+	}
+
+	return reg, nil
+}
+
+func (reg *Registry) add(info ModeInfo) {
+	reg.index[info.Name] = len(reg.modes)
+	reg.modes = append(reg.modes, info)
+}
+
+func (t ModeType) isKnown() bool {
+	switch t {
+	case TypeDirect, TypeTunnel, TypeSocks5, TypeHTTP, TypeHTTPS, TypeShadowsocks, TypeChain, TypePool, TypeRace:
+		return true
+	default:
+		return false
+	}
+}
+
+// Has reports whether the mode is configured
+func (reg *Registry) Has(mode Mode) bool {
+	_, ok := reg.index[mode]
+	return ok
+}
+
+// Get returns the configured mode
+func (reg *Registry) Get(mode Mode) (ModeInfo, bool) {
+	i, ok := reg.index[mode]
+	if !ok {
+		return ModeInfo{}, false
+	}
+	return reg.modes[i], true
+}
+
+// Modes returns all configured modes in configuration order
+func (reg *Registry) Modes() []ModeInfo {
+	return reg.modes
+}
+
+// Names returns all configured mode names in configuration order
+func (reg *Registry) Names() []string {
+	names := make([]string, 0, len(reg.modes))
+	for _, info := range reg.modes {
+		names = append(names, info.Name.String())
+	}
+	return names
+}
+
+// isProxy reports whether the type connects through an upstream proxy server
+// (and can therefore be reached through another mode)
+func (t ModeType) isProxy() bool {
+	switch t {
+	case TypeSocks5, TypeHTTP, TypeHTTPS, TypeShadowsocks:
+		return true
+	default:
+		return false
+	}
+}
+
+// dialerBuilder creates dialers for all modes, resolving dependencies
+// between modes (via, chain hops) in any configuration order
+type dialerBuilder struct {
+	registry *Registry
+	bypassIP string          // default source IP for connections to upstream proxies
+	usable   func(Mode) bool // whether pools and races may use a member mode (nil: always)
+
+	built    map[Mode]Dialer
+	errs     map[Mode]error
+	building map[Mode]bool
+}
+
+func newDialerBuilder(reg *Registry, bypassIP string, usable func(Mode) bool) *dialerBuilder {
+	return &dialerBuilder{
+		registry: reg,
+		bypassIP: bypassIP,
+		usable:   usable,
+		built:    make(map[Mode]Dialer),
+		errs:     make(map[Mode]error),
+		building: make(map[Mode]bool),
+	}
+}
+
+// build returns the dialer for a mode, creating it on first use
+func (b *dialerBuilder) build(mode Mode) (Dialer, error) {
+	if d, ok := b.built[mode]; ok {
+		return d, nil
+	}
+	if err, ok := b.errs[mode]; ok {
+		return nil, err
+	}
+	if b.building[mode] {
+		return nil, fmt.Errorf("mode %s depends on itself", mode)
+	}
+
+	info, ok := b.registry.Get(mode)
+	if !ok {
+		return nil, fmt.Errorf("unknown mode %s", mode)
+	}
+
+	b.building[mode] = true
+	d, err := b.create(info)
+	delete(b.building, mode)
+	if err == nil {
+		d, err = withResolver(info, d)
+	}
+
+	if err != nil {
+		b.errs[mode] = err
+		return nil, err
+	}
+	b.built[mode] = d
+	return d, nil
+}
+
+// create makes a new dialer for a mode
+func (b *dialerBuilder) create(info ModeInfo) (Dialer, error) {
+	mc := info.Config
+
+	switch info.Type {
+	case TypeDirect:
+		return NewDirectDialer(info.Name.String(), mc.LocalIP), nil
+
+	case TypeTunnel:
+		if mc.Interface == "" {
+			return nil, fmt.Errorf("interface is not configured")
+		}
+		return NewWarpDialer(info.Name.String(), mc.Interface)
+
+	case TypeChain:
+		return b.createChain(info)
+
+	case TypePool:
+		return b.createPool(info)
+
+	case TypeRace:
+		return b.createRace(info)
+	}
+
+	if !info.Type.isProxy() {
+		return nil, fmt.Errorf("unknown type %q", info.Type)
+	}
+
+	// Upstream proxies: reached through another mode if "via" is set,
+	// otherwise directly from the bypass IP
+	if mc.Via != "" {
+		return b.createChain(ModeInfo{
+			Name:   info.Name,
+			Type:   TypeChain,
+			Config: config.ModeConfig{Hops: []string{mc.Via, info.Name.String()}},
+		})
+	}
+
+	localIP := mc.LocalIP
+	if localIP == "" {
+		localIP = b.bypassIP
+	}
+	return newProxyDialer(info, newForwardDialer(localIP))
+}
+
+// createChain builds a chain of modes: the first hop is an existing mode,
+// every next hop is a proxy reached through the previous ones
+func (b *dialerBuilder) createChain(info ModeInfo) (Dialer, error) {
+	names := info.Config.Hops
+	if len(names) < 2 {
+		return nil, fmt.Errorf("chain needs at least 2 hops")
+	}
+
+	hops := make([]Mode, 0, len(names))
+	for _, name := range names {
+		hops = append(hops, Mode(name))
+	}
+
+	first, err := b.build(hops[0])
+	if err != nil {
+		return nil, fmt.Errorf("hop 1 (%s): %w", hops[0], err)
+	}
+	var forward Dialer = &hopDialer{hop: 1, mode: hops[0], dialer: first}
+
+	for i, mode := range hops[1:] {
+		hop, ok := b.registry.Get(mode)
+		if !ok {
+			return nil, fmt.Errorf("hop %d: unknown mode %s", i+2, mode)
+		}
+		if !hop.Type.isProxy() {
+			return nil, fmt.Errorf("hop %d (%s): %s mode cannot be reached through another mode", i+2, mode, hop.Type)
+		}
+
+		// A dedicated dialer for this hop, so the mode's own dialer
+		// keeps its own forward path
+		d, err := newProxyDialer(hop, contextForward{forward})
+		if err != nil {
+			return nil, fmt.Errorf("hop %d (%s): %w", i+2, mode, err)
+		}
+		forward = &hopDialer{hop: i + 2, mode: mode, dialer: d}
+	}
+
+	return &ChainDialer{name: info.Name.String(), hops: hops, last: forward}, nil
+}
+
+// createPool builds a pool from the dialers of its member modes
+func (b *dialerBuilder) createPool(info ModeInfo) (Dialer, error) {
+	mc := info.Config
+	if len(mc.Members) == 0 {
+		return nil, fmt.Errorf("pool has no members")
+	}
+
+	pool, err := NewPoolDialer(info.Name.String(), PoolStrategy(mc.Strategy), mc.Cooldown)
+	if err != nil {
+		return nil, err
+	}
+	pool.usable = b.usable
+
+	for _, member := range mc.Members {
+		mode := Mode(member.Mode)
+		d, err := b.build(mode)
+		if err != nil {
+			// The pool works with the remaining members
+			log.Printf("WARN: Pool %s: member %s not available: %v", info.Name, mode, err)
+			continue
+		}
+		pool.addMember(mode, d, member.Weight)
+	}
+
+	if len(pool.members) == 0 {
+		return nil, fmt.Errorf("no pool member available")
+	}
+	return pool, nil
+}
+
+// createRace builds a race from the dialers of its member modes
+func (b *dialerBuilder) createRace(info ModeInfo) (Dialer, error) {
+	mc := info.Config
+	if len(mc.Members) == 0 {
+		return nil, fmt.Errorf("race has no members")
+	}
+
+	race := NewRaceDialer(info.Name.String(), mc.Stagger)
+	race.usable = b.usable
+	for _, member := range mc.Members {
+		mode := Mode(member.Mode)
+		d, err := b.build(mode)
+		if err != nil {
+			log.Printf("WARN: Race %s: member %s not available: %v", info.Name, mode, err)
+			continue
+		}
+		race.addMember(mode, d)
+	}
+
+	if len(race.members) == 0 {
+		return nil, fmt.Errorf("no race member available")
+	}
+	return race, nil
+}
+
+// newProxyDialer creates an upstream proxy dialer that reaches the proxy via forward
+func newProxyDialer(info ModeInfo, forward forwardDialer) (Dialer, error) {
+	mc := info.Config
+	if mc.Host == "" {
+		return nil, fmt.Errorf("host is not configured")
+	}
+
+	switch info.Type {
+	case TypeSocks5:
+		return NewSocks5Dialer(info.Name.String(), mc.Host, mc.Port, mc.Username, mc.Password, forward)
+
+	case TypeHTTP, TypeHTTPS:
+		var tlsConfig *tls.Config
+		if info.Type == TypeHTTPS || mc.TLS.Enabled {
+			var err error
+			if tlsConfig, err = newProxyTLSConfig(mc.TLS, mc.Host); err != nil {
+				return nil, err
+			}
+		}
+		return NewHTTPDialer(info.Name.String(), mc.Host, mc.Port, mc.Username, mc.Password, forward, tlsConfig)
+
+	case TypeShadowsocks:
+		return NewShadowsocksDialer(info.Name.String(), mc.Host, mc.Port, mc.Method, mc.Password, forward)
+
+	default:
+		return nil, fmt.Errorf("%s is not a proxy type", info.Type)
+	}
+}
@@ -0,0 +1,83 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/scinfra-pro/switch-gate/internal/resolver"
+)
+
+// resolvingDialer resolves domain targets with the mode's resolver and
+// dials the addresses in order until one connects
+type resolvingDialer struct {
+	Dialer
+	resolver resolver.Resolver
+}
+
+// withResolver wraps the dialer of a mode with its configured resolver.
+// Modes that leave resolution to the dialer (system for direct and tunnel,
+// remote for proxies) are returned as is.
+func withResolver(info ModeInfo, d Dialer) (Dialer, error) {
+	rc := info.Config.Resolver
+	local := info.Type == TypeDirect || info.Type == TypeTunnel
+
+	switch rc.Type {
+	case "":
+		return d, nil
+	case resolver.TypeSystem:
+		if local {
+			return d, nil // The dialer already uses the host resolver
+		}
+	case resolver.TypeRemote:
+		if local {
+			return nil, fmt.Errorf("remote resolver needs an upstream proxy")
+		}
+		return d, nil
+	case resolver.TypeUDP:
+		if !local {
+			return nil, fmt.Errorf("udp resolver needs a direct or tunnel mode, use tcp, dot or doh")
+		}
+	}
+
+	res, err := resolver.New(rc, d.DialContext)
+	if err != nil {
+		return nil, err
+	}
+	return &resolvingDialer{Dialer: d, resolver: res}, nil
+}
+
+// baseDialer returns the dialer of a mode without its resolver
+func baseDialer(d Dialer) Dialer {
+	if rd, ok := d.(*resolvingDialer); ok {
+		return rd.Dialer
+	}
+	return d
+}
+
+// DialContext resolves a domain target and dials its addresses
+func (d *resolvingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+
+	ips, err := d.resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+
+	var errs []error
+	for _, ip := range ips {
+		conn, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -8,12 +9,9 @@ import (
 	"time"
 
 	"github.com/scinfra-pro/switch-gate/internal/config"
+	"github.com/scinfra-pro/switch-gate/internal/geoip"
 	"github.com/scinfra-pro/switch-gate/internal/metrics"
-)
-
-const (
-	// testDialTimeout is the timeout for testing mode connectivity
-	testDialTimeout = 5 * time.Second
+	"github.com/scinfra-pro/switch-gate/internal/state"
 )
 
 // WebhookSender is an interface for sending webhook events
@@ -23,102 +21,321 @@ type WebhookSender interface {
 
 // Router manages traffic routing through different modes
 type Router struct {
-	mu      sync.RWMutex
-	mode    Mode
-	dialers map[Mode]Dialer
-	metrics *metrics.Metrics
+	mu        sync.RWMutex
+	mode      Mode
+	preferred Mode // Last manually selected mode
+	registry  *Registry
+	dialers   map[Mode]Dialer
+	rules     *RuleSet
+	clients   *ClientTable
+	geo       *geoip.DB
+	metrics   *metrics.Metrics
+
+	// Per-mode fallback lists
+	fallbacks map[Mode]*fallbackPolicy
+
+	// Health probes and per-mode health state
+	health      config.HealthConfig
+	healthMu    sync.Mutex
+	healthState map[Mode]*modeHealth
+
+	// Scheduled mode switches
+	schedule []*scheduleEntry
+
+	// Open connections per mode and what happens to them on a switch
+	conns          *connTracker
+	switchPolicies switchPolicies
 
 	// Tunnel control (enable/disable)
 	warpControl *WarpControl
 
-	// Upstream proxy limits
-	homeLimitBytes uint64
-	homeAutoSwitch Mode
+	// Traffic limits per mode, usage per billing period
+	limits      map[Mode]*modeLimit
+	limitEvents chan Mode // Limits reached inside connections
+
+	// Price of the traffic per mode
+	pricing  map[Mode]*pricing
+	currency string
+
+	// Rate limits: global, per mode and per client
+	bandwidth *bandwidth
+
+	// Traffic and quotas per client
+	accounting *accounting
+
+	// Traffic per mode in the accounting period
+	traffic *trafficCounters
+
+	// Persisted state (nil: not persisted)
+	store         *state.Store
+	flushInterval time.Duration
+	saveMu        sync.Mutex // Serializes SaveState, so an older snapshot never replaces a newer one
 
 	// Webhook for event notifications
 	webhook       WebhookSender
 	webhookEvents config.EventsConfig
+
+	// Last mode.fallback webhook per "from>to", to avoid one event per connection
+	fallbackMu       sync.Mutex
+	fallbackNotified map[string]time.Time
 }
 
 // New creates a new router with configured dialers
 func New(cfg *config.Config, m *metrics.Metrics, webhook WebhookSender) (*Router, error) {
+	// GeoIP databases: optional, only needed for geoip/asn rules
+	var geo *geoip.DB
+	if cfg.GeoIP.CountryDB != "" || cfg.GeoIP.ASNDB != "" {
+		db, err := geoip.Open(cfg.GeoIP.CountryDB, cfg.GeoIP.ASNDB)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open geoip database: %w", err)
+		}
+		geo = db
+		log.Printf("INFO: GeoIP database loaded (country: %q, asn: %q)", cfg.GeoIP.CountryDB, cfg.GeoIP.ASNDB)
+	}
+
+	rules, err := NewRuleSet(cfg.Rules, geo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing rules: %w", err)
+	}
+
+	clients, err := NewClientTable(cfg.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client groups: %w", err)
+	}
+
+	registry, err := NewRegistry(cfg.Modes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modes: %w", err)
+	}
+
+	fallbacks, err := newFallbackPolicies(registry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fallback: %w", err)
+	}
+
+	switchPolicies, err := newSwitchPolicies(cfg.Switch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mode_switch: %w", err)
+	}
+
+	schedule, err := newSchedule(cfg.Schedule, registry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule: %w", err)
+	}
+
+	prices, currency, err := newPricing(cfg.Pricing, registry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pricing: %w", err)
+	}
+
+	limitEvents := make(chan Mode, limitEventQueue)
+	limits, err := newLimits(cfg.Limits, registry, prices, limitEvents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid limits: %w", err)
+	}
+
+	bandwidth, err := newBandwidth(cfg.Bandwidth, registry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bandwidth: %w", err)
+	}
+
+	accounting, err := newAccounting(cfg.Accounting, registry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid accounting: %w", err)
+	}
+
+	traffic, err := newTrafficCounters(cfg.State.Period, registry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state period: %w", err)
+	}
+
+	flushInterval := cfg.State.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+
 	r := &Router{
-		mode:           ModeDirect,
-		dialers:        make(map[Mode]Dialer),
-		metrics:        m,
-		homeLimitBytes: uint64(cfg.Limits.Home.MaxMB) * 1024 * 1024,
-		homeAutoSwitch: Mode(cfg.Limits.Home.AutoSwitchTo),
-		webhook:        webhook,
-		webhookEvents:  cfg.Webhooks.Events,
+		mode:          ModeDirect,
+		preferred:     ModeDirect,
+		health:        healthDefaults(cfg.Health),
+		healthState:   make(map[Mode]*modeHealth),
+		registry:      registry,
+		dialers:       make(map[Mode]Dialer),
+		rules:         rules,
+		clients:       clients,
+		geo:           geo,
+		metrics:       m,
+		limits:        limits,
+		limitEvents:   limitEvents,
+		pricing:       prices,
+		currency:      currency,
+		bandwidth:     bandwidth,
+		accounting:    accounting,
+		traffic:       traffic,
+		flushInterval: flushInterval,
+		webhook:       webhook,
+		webhookEvents: cfg.Webhooks.Events,
+
+		fallbacks:        fallbacks,
+		fallbackNotified: make(map[string]time.Time),
+
+		conns:          newConnTracker(),
+		switchPolicies: switchPolicies,
+		schedule:       schedule,
 	}
 
-	// Always available: direct (bound to local IP if configured)
-	r.dialers[ModeDirect] = NewDirectDialer(cfg.Modes.Direct.LocalIP)
-	if cfg.Modes.Direct.LocalIP != "" {
-		log.Printf("INFO: Direct dialer bound to %s", cfg.Modes.Direct.LocalIP)
+	// Upstream proxies connect from the direct mode's IP by default,
+	// so the proxy connection bypasses tunnel routing
+	var bypassIP string
+	if direct, ok := registry.Get(ModeDirect); ok {
+		bypassIP = direct.Config.LocalIP
 	}
 
-	// Tunnel mode: optional, depends on interface availability
-	if cfg.Modes.Warp.Interface != "" {
-		warpDialer, err := NewWarpDialer(cfg.Modes.Warp.Interface)
+	builder := newDialerBuilder(registry, bypassIP, r.isUsable)
+	for _, info := range registry.Modes() {
+		m.Register(info.Name.String())
+
+		dialer, err := builder.build(info.Name)
 		if err != nil {
-			log.Printf("WARN: Tunnel dialer not available: %v", err)
-		} else {
-			r.dialers[ModeWarp] = warpDialer
-			r.warpControl = NewWarpControl()
-			log.Printf("INFO: Tunnel dialer initialized on %s", cfg.Modes.Warp.Interface)
+			log.Printf("WARN: Mode %s (%s) not available: %v", info.Name, info.Type, err)
+			continue
+		}
+		r.dialers[info.Name] = dialer
+
+		switch d := baseDialer(dialer).(type) {
+		case *DirectDialer:
+			if d.LocalIP() != nil {
+				log.Printf("INFO: Direct dialer %s bound to %s", info.Name, d.LocalIP())
+			}
+		case *WarpDialer:
+			if r.warpControl == nil {
+				r.warpControl = NewWarpControl()
+			}
+			log.Printf("INFO: Tunnel dialer %s initialized on %s", info.Name, d.InterfaceName())
+		case *ChainDialer:
+			log.Printf("INFO: Chain dialer %s initialized (%s)", info.Name, d)
+		case *PoolDialer:
+			log.Printf("INFO: Pool dialer %s initialized (%s, %d members)", info.Name, d.Strategy(), len(d.members))
+		case *RaceDialer:
+			log.Printf("INFO: Race dialer %s initialized (%d members, stagger %v)", info.Name, len(d.members), d.stagger)
+		default:
+			log.Printf("INFO: %s dialer %s initialized (%s:%d)", info.Type, info.Name, info.Config.Host, info.Config.Port)
+		}
+		if _, ok := dialer.(*resolvingDialer); ok {
+			rc := info.Config.Resolver
+			log.Printf("INFO: Mode %s resolves domains with %s resolver %s", info.Name, rc.Type, rc.Server)
 		}
 	}
 
-	// Home (upstream) proxy: optional, depends on config
-	// Uses Direct.LocalIP to bypass tunnel when connecting to proxy
-	if cfg.Modes.Home.Host != "" {
-		homeDialer, err := NewSocks5Dialer(
-			cfg.Modes.Home.Host,
-			cfg.Modes.Home.Port,
-			cfg.Modes.Home.Username,
-			cfg.Modes.Home.Password,
-			cfg.Modes.Direct.LocalIP, // Bypass tunnel for proxy connection
-		)
-		if err != nil {
-			log.Printf("WARN: Home proxy dialer not available: %v", err)
-		} else {
-			r.dialers[ModeHome] = homeDialer
-			log.Printf("INFO: Home proxy dialer initialized (%s:%d via %s)", cfg.Modes.Home.Host, cfg.Modes.Home.Port, cfg.Modes.Direct.LocalIP)
+	if p := cfg.Health.Preferred; p != "" && !registry.Has(Mode(p)) {
+		return nil, fmt.Errorf("health preferred mode is unknown: %s", p)
+	}
+	for _, rule := range rules.rules {
+		if !registry.Has(rule.Mode) {
+			return nil, fmt.Errorf("routing rule uses unknown mode: %s", rule.Mode)
 		}
 	}
+	for _, g := range clients.Groups() {
+		for _, mode := range append([]Mode{g.Mode}, g.Allowed...) {
+			if mode != "" && !registry.Has(mode) {
+				return nil, fmt.Errorf("client group %s uses unknown mode: %s", g.Name, mode)
+			}
+		}
+	}
+
+	if rules.Len() > 0 {
+		for _, rule := range rules.rules {
+			if _, ok := r.dialers[rule.Mode]; !ok {
+				log.Printf("WARN: Routing rule uses unavailable mode %s, matching traffic will use the current mode", rule.Mode)
+			}
+		}
+		log.Printf("INFO: Loaded %d routing rules", rules.Len())
+	}
 
+	for _, g := range clients.Groups() {
+		if g.Mode != "" {
+			if _, ok := r.dialers[g.Mode]; !ok {
+				log.Printf("WARN: Client group %s uses unavailable mode %s", g.Name, g.Mode)
+			}
+		}
+	}
+
+	r.syncGatesLocked() // Not shared yet
 	return r, nil
 }
 
-// SetMode changes the current routing mode
+// Triggers of a mode change, reported in the mode.changed webhook
+const (
+	TriggerManual       = "manual"        // API request
+	TriggerLimitReached = "limit_reached" // Traffic limit exhausted
+	TriggerHealth       = "health"        // Health monitor failover or restore
+	TriggerSchedule     = "schedule"      // Scheduled switch
+	TriggerLimitReset   = "limit_reset"   // Billing period of an exhausted limit ended
+)
+
+// SetMode changes the current routing mode on request of the user
 func (r *Router) SetMode(mode Mode) error {
+	return r.SwitchMode(mode, TriggerManual)
+}
+
+// SetModeWithPolicy changes the current routing mode on request of the user,
+// applying policy instead of the configured one to the previous mode's connections
+func (r *Router) SetModeWithPolicy(mode Mode, policy SwitchPolicy) error {
+	return r.switchMode(mode, TriggerManual, policy)
+}
+
+// SwitchPolicyFor returns the configured switch policy of a trigger
+func (r *Router) SwitchPolicyFor(trigger string) SwitchPolicy {
+	return r.switchPolicies.forTrigger(trigger)
+}
+
+// SwitchMode changes the current routing mode. A manual switch also makes
+// the mode the one the health monitor restores after a failover.
+// Connections of the previous mode are handled by the policy of the trigger.
+func (r *Router) SwitchMode(mode Mode, trigger string) error {
+	return r.switchMode(mode, trigger, r.switchPolicies.forTrigger(trigger))
+}
+
+func (r *Router) switchMode(mode Mode, trigger string, policy SwitchPolicy) error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 
-	if !mode.IsValid() {
+	if !r.registry.Has(mode) {
+		r.mu.Unlock()
 		return fmt.Errorf("invalid mode: %s", mode)
 	}
 
 	if _, ok := r.dialers[mode]; !ok {
+		r.mu.Unlock()
 		return fmt.Errorf("mode %s is not available", mode)
 	}
 
-	if mode == ModeHome && r.isHomeExhaustedLocked() {
-		return fmt.Errorf("home proxy limit exhausted (%d MB used)",
-			r.metrics.GetBytes("home")/1024/1024)
+	if r.isBlockedLocked(mode) {
+		r.mu.Unlock()
+		return fmt.Errorf("%s traffic limit exhausted (%d MB used)",
+			mode, r.limitUsedLocked(mode)/1024/1024)
 	}
 
 	oldMode := r.mode
 	r.mode = mode
+	if trigger == TriggerManual || trigger == TriggerSchedule {
+		r.preferred = mode
+	}
+	r.mu.Unlock()
 	log.Printf("INFO: Mode switched to %s", mode)
 
+	if oldMode == mode {
+		return nil
+	}
+
+	r.applySwitchPolicy(oldMode, policy)
+
 	// Send webhook notification (if enabled)
-	if r.webhook != nil && oldMode != mode && r.webhookEvents.ModeChanged {
+	if r.webhook != nil && r.webhookEvents.ModeChanged {
 		r.webhook.Send("mode.changed", map[string]interface{}{
 			"from":    oldMode.String(),
 			"to":      mode.String(),
-			"trigger": "manual",
+			"trigger": trigger,
+			"policy":  string(policy.Action),
 		})
 	}
 
@@ -132,150 +349,373 @@ func (r *Router) GetMode() Mode {
 	return r.mode
 }
 
-// Dial connects to the address using the current mode
-func (r *Router) Dial(network, address string) (net.Conn, error) {
+// DialContext connects to the address for the given client. The mode is
+// taken from the first matching rule, then the client group default, then
+// the current mode. Cancelling ctx aborts the dial and its fallbacks.
+func (r *Router) DialContext(ctx context.Context, meta *Metadata, network, address string) (net.Conn, error) {
+	group := r.clients.Lookup(meta)
+	client := r.accounting.identify(meta, group)
+
+	// Match outside the lock: geoip/asn rules may resolve the target
+	rule, _ := r.rules.Match(ctx, address, meta.domain())
+
 	r.mu.RLock()
-	mode := r.mode
+	mode, err := r.selectModeLocked(rule, group, address)
 	dialer := r.dialers[mode]
+	if err == nil && r.isBlockedLocked(mode) && r.limits[mode].action == LimitBlock {
+		err = fmt.Errorf("mode %s blocked: traffic limit exhausted", mode)
+	}
 	r.mu.RUnlock()
+	if err == nil && r.accounting.exhausted(client, mode) {
+		err = fmt.Errorf("client %s: %s quota exhausted", client, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	conn, err := dialer.Dial(network, address)
+	// Pools, races and fallbacks only use modes the client's quota allows
+	ctx = withMemberCheck(ctx, func(m Mode) bool { return !r.accounting.exhausted(client, m) })
+	selected := mode
+	conn, err := dialStep(ctx, dialer, network, address, r.fallbacks[mode].timeout)
 	if err != nil {
-		// Fallback to direct if tunnel fails
-		if mode == ModeWarp {
-			log.Printf("WARN: Tunnel dial failed, falling back to direct: %v", err)
-			r.mu.RLock()
-			dialer = r.dialers[ModeDirect]
-			r.mu.RUnlock()
-			conn, err = dialer.Dial(network, address)
-			mode = ModeDirect
-		}
+		conn, mode, err = r.dialFallback(ctx, group, mode, network, address, err)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return NewMeteredConn(conn, mode.String(), r.metrics), nil
-}
+	// Race and pool modes: bytes belong to the member that carried them
+	if mc, ok := conn.(modeConn); ok {
+		mode = mc.dialedMode()
+	}
 
-// AvailableModes returns all available modes
-func (r *Router) AvailableModes() []Mode {
+	mc := NewMeteredConn(conn, mode.String(), r.metrics)
+	mc.selected = selected
+	var releaseBandwidth, releaseClient func()
+	mc.upload, mc.download, releaseBandwidth = r.bandwidth.acquire(mode, meta.sourceIP())
+	mc.client, releaseClient = r.accounting.acquire(client, mode)
+	mc.release = func() {
+		releaseBandwidth()
+		releaseClient()
+	}
+	mc.gates = quotaGates{mc.client.gate}
 	r.mu.RLock()
-	defer r.mu.RUnlock()
+	if l, ok := r.limits[mode]; ok {
+		mc.throttle = l.throttle
+		mc.gates = append(mc.gates, l.gate)
+	}
+	r.mu.RUnlock()
+	r.conns.add(mc)
+	return mc, nil
+}
 
-	modes := make([]Mode, 0, len(r.dialers))
-	for mode := range r.dialers {
-		modes = append(modes, mode)
+// ConnectionsByMode returns the number of open connections per mode
+func (r *Router) ConnectionsByMode() map[Mode]int {
+	return r.conns.counts()
+}
+
+// dialFallback walks the fallback list of a mode after its dial failed.
+// Steps the client group may not use, that are not usable, or that the
+// member check of ctx rejects, are skipped. Returns the last error if no
+// step succeeds.
+func (r *Router) dialFallback(ctx context.Context, group *ClientGroup, mode Mode, network, address string, dialErr error) (net.Conn, Mode, error) {
+	policy := r.fallbacks[mode]
+	from, err := mode, dialErr
+
+	for _, step := range policy.steps {
+		if ctx.Err() != nil {
+			// The client is gone or the server is shutting down
+			break
+		}
+		class := classifyDialError(err)
+		if !policy.triggers(class) {
+			break
+		}
+
+		r.mu.RLock()
+		dialer := r.dialers[step.mode]
+		usable := r.isUsableLocked(step.mode)
+		r.mu.RUnlock()
+		if !usable || !group.allows(step.mode) || !memberUsable(ctx, nil, step.mode) {
+			continue
+		}
+
+		log.Printf("WARN: %s dial failed (%s), falling back to %s: %v", from, class, step.mode, err)
+		r.metrics.AddFallback(from.String(), step.mode.String(), string(class))
+		r.notifyFallback(mode, from, step.mode, class, dialErr, address)
+
+		conn, stepErr := dialStep(ctx, dialer, network, address, step.timeout)
+		if stepErr == nil {
+			return conn, step.mode, nil
+		}
+		from, err = step.mode, stepErr
 	}
-	return modes
+
+	return nil, "", err
 }
 
-// SetHomeLimit sets the home proxy traffic limit in MB
-func (r *Router) SetHomeLimit(mb int) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.homeLimitBytes = uint64(mb) * 1024 * 1024
+// fallbackNotifyInterval limits mode.fallback webhooks per mode pair
+const fallbackNotifyInterval = time.Minute
+
+// notifyFallback sends a mode.fallback webhook (if enabled), at most once
+// per fallbackNotifyInterval for the same pair of modes
+func (r *Router) notifyFallback(mode, from, to Mode, class DialErrorClass, origErr error, address string) {
+	if r.webhook == nil || !r.webhookEvents.ModeFallback {
+		return
+	}
+
+	key := from.String() + ">" + to.String()
+	r.fallbackMu.Lock()
+	if last, ok := r.fallbackNotified[key]; ok && time.Since(last) < fallbackNotifyInterval {
+		r.fallbackMu.Unlock()
+		return
+	}
+	r.fallbackNotified[key] = time.Now()
+	r.fallbackMu.Unlock()
+
+	r.webhook.Send("mode.fallback", map[string]interface{}{
+		"mode":        mode.String(),
+		"from":        from.String(),
+		"to":          to.String(),
+		"reason":      string(class),
+		"error":       origErr.Error(),
+		"destination": address,
+	})
+}
+
+// selectModeLocked returns the mode for a destination given its matching
+// rule and client group (both may be nil). Rules whose mode is not usable
+// or not allowed for the group fall back to the default mode.
+func (r *Router) selectModeLocked(rule *Rule, group *ClientGroup, address string) (Mode, error) {
+	if rule != nil && group.allows(rule.Mode) {
+		if r.isUsableLocked(rule.Mode) {
+			return rule.Mode, nil
+		}
+		log.Printf("DEBUG: Rule for %s skipped, mode %s not usable", address, rule.Mode)
+	}
+
+	return r.defaultModeLocked(group)
+}
+
+// defaultModeLocked returns the mode for traffic not matched by any rule:
+// the group's own mode, else the current mode if the group may use it,
+// else the first usable allowed mode.
+func (r *Router) defaultModeLocked(group *ClientGroup) (Mode, error) {
+	if group == nil {
+		return r.mode, nil
+	}
+
+	if group.Mode != "" && r.isUsableLocked(group.Mode) {
+		return group.Mode, nil
+	}
+	if group.allows(r.mode) {
+		return r.mode, nil
+	}
+	for _, m := range group.Allowed {
+		if r.isUsableLocked(m) {
+			return m, nil
+		}
+	}
+
+	return "", fmt.Errorf("no allowed mode available for client group %s", group.Name)
 }
 
-// GetHomeLimit returns the home proxy traffic limit in MB
-func (r *Router) GetHomeLimit() int {
+// isUsable reports whether new connections may use the mode
+func (r *Router) isUsable(mode Mode) bool {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return int(r.homeLimitBytes / 1024 / 1024)
+	return r.isUsableLocked(mode)
 }
 
-func (r *Router) isHomeExhaustedLocked() bool {
-	if r.homeLimitBytes == 0 {
+// isUsableLocked reports whether new connections may use the mode
+func (r *Router) isUsableLocked(mode Mode) bool {
+	if _, ok := r.dialers[mode]; !ok {
 		return false
 	}
-	return r.metrics.GetBytes("home") >= r.homeLimitBytes
+	return !r.isBlockedLocked(mode)
 }
 
-// IsHomeExhausted checks if home proxy limit is exhausted
-func (r *Router) IsHomeExhausted() bool {
+// ClientGroupStatus describes a client group and the mode it currently gets
+type ClientGroupStatus struct {
+	Name          string
+	Networks      []string
+	Mode          Mode // Configured default (may be empty)
+	EffectiveMode Mode // Mode unmatched traffic is routed through right now
+	AllowedModes  []Mode
+}
+
+// ClientGroups returns the status of all configured client groups
+func (r *Router) ClientGroups() []ClientGroupStatus {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return r.isHomeExhaustedLocked()
+
+	groups := r.clients.Groups()
+	result := make([]ClientGroupStatus, 0, len(groups))
+	for _, g := range groups {
+		effective, _ := r.defaultModeLocked(g)
+		result = append(result, ClientGroupStatus{
+			Name:          g.Name,
+			Networks:      g.Networks(),
+			Mode:          g.Mode,
+			EffectiveMode: effective,
+			AllowedModes:  g.Allowed,
+		})
+	}
+	return result
 }
 
-// CheckLimits checks if any limits are exceeded and switches mode if needed
-func (r *Router) CheckLimits() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// PoolStatus describes a pool mode and its members
+type PoolStatus struct {
+	Name     Mode
+	Strategy PoolStrategy
+	Members  []PoolMemberStatus
+}
+
+// Pools returns the status of all available pool modes in configuration order
+func (r *Router) Pools() []PoolStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	if r.mode == ModeHome && r.isHomeExhaustedLocked() {
-		oldMode := r.mode
-		newMode := r.homeAutoSwitch
-		if _, ok := r.dialers[newMode]; !ok {
-			newMode = ModeDirect
+	var result []PoolStatus
+	for _, info := range r.registry.Modes() {
+		pool, ok := baseDialer(r.dialers[info.Name]).(*PoolDialer)
+		if !ok {
+			continue
 		}
+		result = append(result, PoolStatus{
+			Name:     info.Name,
+			Strategy: pool.Strategy(),
+			Members:  pool.Members(),
+		})
+	}
+	return result
+}
 
-		log.Printf("WARN: Home proxy limit reached, switching to %s", newMode)
-		r.mode = newMode
-
-		// Send webhook notifications (if enabled)
-		if r.webhook != nil {
-			usedMB := r.metrics.GetBytes("home") / 1024 / 1024
-			limitMB := r.homeLimitBytes / 1024 / 1024
-
-			if r.webhookEvents.LimitReached {
-				r.webhook.Send("limit.reached", map[string]interface{}{
-					"mode":        "home",
-					"used_mb":     usedMB,
-					"limit_mb":    limitMB,
-					"switched_to": newMode.String(),
-				})
-			}
+// RaceStatus describes a race mode and the wins of its members
+type RaceStatus struct {
+	Name    Mode
+	Races   uint64
+	Members []RaceMemberStatus
+}
 
-			if r.webhookEvents.ModeChanged {
-				r.webhook.Send("mode.changed", map[string]interface{}{
-					"from":    oldMode.String(),
-					"to":      newMode.String(),
-					"trigger": "limit_reached",
-				})
-			}
+// Races returns the statistics of all available race modes in configuration order
+func (r *Router) Races() []RaceStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var result []RaceStatus
+	for _, info := range r.registry.Modes() {
+		race, ok := baseDialer(r.dialers[info.Name]).(*RaceDialer)
+		if !ok {
+			continue
 		}
+		result = append(result, RaceStatus{
+			Name:    info.Name,
+			Races:   race.Races(),
+			Members: race.Members(),
+		})
 	}
+	return result
+}
+
+// GeoIP returns the GeoIP database used by rules (nil if not configured)
+func (r *Router) GeoIP() *geoip.DB {
+	return r.geo
+}
+
+// AvailableModes returns all available modes in configuration order
+func (r *Router) AvailableModes() []Mode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	modes := make([]Mode, 0, len(r.dialers))
+	for _, info := range r.registry.Modes() {
+		if _, ok := r.dialers[info.Name]; ok {
+			modes = append(modes, info.Name)
+		}
+	}
+	return modes
+}
+
+// Modes returns all configured modes (available or not) in configuration order
+func (r *Router) Modes() []ModeInfo {
+	return r.registry.Modes()
+}
+
+// ModeType returns the type of a configured mode (empty if unknown)
+func (r *Router) ModeType(mode Mode) ModeType {
+	return r.modeType(mode)
+}
+
+func (r *Router) modeType(mode Mode) ModeType {
+	info, _ := r.registry.Get(mode)
+	return info.Type
 }
 
 // TestCurrentMode tests if the current mode is working by attempting a test connection.
 // Returns (healthy, error). For direct mode, always returns (true, nil).
-func (r *Router) TestCurrentMode() (bool, error) {
+func (r *Router) TestCurrentMode(ctx context.Context) (bool, error) {
+	if err := r.testMode(ctx, r.GetMode()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// testMode checks a mode by dialing the health endpoints through it
+func (r *Router) testMode(ctx context.Context, mode Mode) error {
 	r.mu.RLock()
-	mode := r.mode
 	dialer, ok := r.dialers[mode]
 	r.mu.RUnlock()
 
 	if !ok {
-		return false, fmt.Errorf("%s dialer not available", mode)
+		return fmt.Errorf("%s dialer not available", mode)
 	}
 
-	// Direct mode is always considered healthy
-	if mode == ModeDirect {
-		return true, nil
+	// Direct modes are always considered healthy
+	if r.modeType(mode) == TypeDirect {
+		return nil
 	}
 
-	// For WARP: first check if interface exists and is up
-	if mode == ModeWarp {
-		if warpDialer, ok := dialer.(*WarpDialer); ok {
+	// For tunnels: first check if interface exists and is up
+	if r.modeType(mode) == TypeTunnel {
+		if warpDialer, ok := baseDialer(dialer).(*WarpDialer); ok {
 			if err := checkInterfaceUp(warpDialer.InterfaceName()); err != nil {
-				return false, err
+				return err
 			}
 		}
 	}
 
-	// TCP test - verify actual connectivity
-	endpoints := []string{"1.1.1.1:443", "8.8.8.8:443"}
+	// For chains starting with a tunnel: same check on the first hop
+	if chain, ok := baseDialer(dialer).(*ChainDialer); ok {
+		first := chain.Hops()[0]
+		r.mu.RLock()
+		warpDialer, isWarp := baseDialer(r.dialers[first]).(*WarpDialer)
+		r.mu.RUnlock()
+		if isWarp {
+			if err := checkInterfaceUp(warpDialer.InterfaceName()); err != nil {
+				return &HopError{Hop: 1, Mode: first, Err: err}
+			}
+		}
+	}
 
-	for _, ep := range endpoints {
-		conn, err := dialWithTimeout(dialer, "tcp", ep, testDialTimeout)
+	// TCP test - verify actual connectivity
+	var hopErr *HopError
+	for _, ep := range r.health.Endpoints {
+		conn, err := dialWithTimeout(ctx, dialer, "tcp", ep, r.health.Timeout)
 		if err == nil {
 			_ = conn.Close()
-			return true, nil
+			return nil
+		}
+		if h := FailedHop(err); h != nil {
+			hopErr = h
 		}
 	}
 
-	return false, fmt.Errorf("%s unreachable", mode)
+	// Chains report which hop failed
+	if hopErr != nil {
+		return fmt.Errorf("%s unreachable: %w", mode, hopErr)
+	}
+	return fmt.Errorf("%s unreachable", mode)
 }
 
 // checkInterfaceUp verifies that a network interface exists and is up
@@ -290,23 +730,14 @@ func checkInterfaceUp(name string) error {
 	return nil
 }
 
-// dialWithTimeout wraps dialer.Dial with a timeout
-func dialWithTimeout(dialer Dialer, network, address string, timeout time.Duration) (net.Conn, error) {
-	type dialResult struct {
-		conn net.Conn
-		err  error
-	}
-
-	result := make(chan dialResult, 1)
-	go func() {
-		conn, err := dialer.Dial(network, address)
-		result <- dialResult{conn, err}
-	}()
+// dialWithTimeout dials with a timeout; a dial that times out is cancelled
+func dialWithTimeout(ctx context.Context, dialer Dialer, network, address string, timeout time.Duration) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	select {
-	case r := <-result:
-		return r.conn, r.err
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("timeout after %v", timeout)
+	conn, err := dialer.DialContext(dialCtx, network, address)
+	if err != nil && ctx.Err() == nil && dialCtx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timeout after %v: %w", timeout, err)
 	}
+	return conn, err
 }
@@ -0,0 +1,134 @@
+package router
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+	"github.com/scinfra-pro/switch-gate/internal/metrics"
+)
+
+// newTestRouter creates a router from a YAML configuration
+func newTestRouter(t *testing.T, cfg string) *Router {
+	t.Helper()
+	r, err := newTestRouterErr(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// newTestRouterErr creates a router from a YAML configuration that may be invalid
+func newTestRouterErr(cfg string) (*Router, error) {
+	var c config.Config
+	if err := yaml.Unmarshal([]byte(cfg), &c); err != nil {
+		return nil, err
+	}
+	return New(&c, metrics.New(), nil)
+}
+
+// echoServer accepts connections and echoes what they send.
+// Returns the address to dial.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// testClient is the metadata of the client in router tests
+func testClient(host string) *Metadata {
+	return &Metadata{Source: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}, Host: host}
+}
+
+// dialTest dials through the router and fails the test on error
+func dialTest(t *testing.T, r *Router, host, address string) *MeteredConn {
+	t.Helper()
+	conn, err := r.DialContext(context.Background(), testClient(host), "tcp", address)
+	if err != nil {
+		t.Fatalf("dial %s: %v", address, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn.(*MeteredConn)
+}
+
+// isOpen reports whether a connection still carries data
+func isOpen(c net.Conn) bool {
+	if _, err := c.Write([]byte("ping")); err != nil {
+		return false
+	}
+	_, err := io.ReadFull(c, make([]byte, 4))
+	return err == nil
+}
+
+// stubDialer is a dialer for tests. It fails with err, waits until the dial
+// is cancelled with block set, and connects to a closed pipe otherwise.
+type stubDialer struct {
+	err   error
+	block bool
+	dials atomic.Int32
+}
+
+func (d *stubDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	d.dials.Add(1)
+	if d.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	conn, peer := net.Pipe()
+	_ = peer.Close()
+	return conn, nil
+}
+
+func (d *stubDialer) Name() string {
+	return "stub"
+}
+
+// webhookRecorder records the payloads of the events sent through it
+type webhookRecorder struct {
+	mu     sync.Mutex
+	events map[string][]map[string]interface{}
+}
+
+func (w *webhookRecorder) Send(event string, payload map[string]interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.events == nil {
+		w.events = make(map[string][]map[string]interface{})
+	}
+	w.events[event] = append(w.events[event], payload)
+}
+
+// take returns and forgets the payloads of an event sent so far
+func (w *webhookRecorder) take(event string) []map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	payloads := w.events[event]
+	delete(w.events, event)
+	return payloads
+}
@@ -0,0 +1,298 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+	"github.com/scinfra-pro/switch-gate/internal/geoip"
+)
+
+// resolveTimeout bounds DNS lookups made for IP-based rules
+const resolveTimeout = 5 * time.Second
+
+// destination is the target of a dial as seen by rule matchers
+type destination struct {
+	host string // normalized domain, empty for IP targets
+	ip   net.IP // literal IP target
+	port int
+
+	lookupIP net.IP          // resolved address of a domain target
+	resolved bool            // domain resolution was attempted
+	ctx      context.Context // bounds the resolution
+}
+
+// resolvedIP returns the target IP, resolving a domain target on first use
+func (d *destination) resolvedIP() net.IP {
+	if d.ip != nil {
+		return d.ip
+	}
+	if d.resolved || d.host == "" {
+		return d.lookupIP
+	}
+	d.resolved = true
+
+	ctx, cancel := context.WithTimeout(d.ctx, resolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, d.host)
+	if err != nil || len(addrs) == 0 {
+		log.Printf("DEBUG: Rule resolution failed for %s: %v", d.host, err)
+		return nil
+	}
+	d.lookupIP = addrs[0].IP
+	return d.lookupIP
+}
+
+// matcher checks a single destination condition of a rule
+type matcher interface {
+	match(dst *destination) bool
+}
+
+// domainMatcher matches a domain exactly
+type domainMatcher string
+
+func (d domainMatcher) match(dst *destination) bool {
+	return dst.host == string(d)
+}
+
+// suffixMatcher matches a domain and all of its subdomains
+type suffixMatcher string
+
+func (s suffixMatcher) match(dst *destination) bool {
+	return dst.host == string(s) || strings.HasSuffix(dst.host, "."+string(s))
+}
+
+// keywordMatcher matches domains containing a keyword
+type keywordMatcher string
+
+func (k keywordMatcher) match(dst *destination) bool {
+	return dst.host != "" && strings.Contains(dst.host, string(k))
+}
+
+// cidrMatcher matches IP destinations inside a network
+type cidrMatcher struct {
+	network *net.IPNet
+}
+
+func (c cidrMatcher) match(dst *destination) bool {
+	return dst.ip != nil && c.network.Contains(dst.ip)
+}
+
+// geoMatcher matches destinations by country or ASN from the GeoIP database.
+// Domain targets are resolved first unless noResolve is set.
+type geoMatcher struct {
+	db        *geoip.DB
+	countries map[string]struct{}
+	asns      map[uint]struct{}
+	noResolve bool
+}
+
+func (g *geoMatcher) match(dst *destination) bool {
+	ip := dst.ip
+	if ip == nil && !g.noResolve {
+		ip = dst.resolvedIP()
+	}
+	if ip == nil {
+		return false
+	}
+
+	if len(g.countries) > 0 {
+		if _, ok := g.countries[g.db.Country(ip)]; ok {
+			return true
+		}
+	}
+	if len(g.asns) > 0 {
+		if _, ok := g.asns[g.db.ASN(ip)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// portRange is an inclusive range of destination ports
+type portRange struct {
+	from, to int
+}
+
+// Rule maps matching destinations to a routing mode
+type Rule struct {
+	Mode     Mode
+	matchers []matcher
+	ports    []portRange
+}
+
+// match reports whether the rule applies to the destination.
+// Destination conditions are OR-ed together, ports (if any) must match as well.
+func (r *Rule) match(dst *destination) bool {
+	if len(r.ports) > 0 && !matchPort(r.ports, dst.port) {
+		return false
+	}
+	if len(r.matchers) == 0 {
+		return true
+	}
+	for _, m := range r.matchers {
+		if m.match(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ranges []portRange, port int) bool {
+	for _, pr := range ranges {
+		if port >= pr.from && port <= pr.to {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleSet is an ordered rule table, the first matching rule wins
+type RuleSet struct {
+	rules []*Rule
+}
+
+// NewRuleSet builds a rule table from configuration. geoip and asn
+// conditions need the matching database of geo (geo may be nil without them).
+func NewRuleSet(cfgs []config.RuleConfig, geo *geoip.DB) (*RuleSet, error) {
+	rs := &RuleSet{rules: make([]*Rule, 0, len(cfgs))}
+
+	for i, c := range cfgs {
+		rule, err := newRule(c, geo)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rs.rules = append(rs.rules, rule)
+	}
+
+	return rs, nil
+}
+
+func newRule(c config.RuleConfig, geo *geoip.DB) (*Rule, error) {
+	mode := Mode(c.Mode)
+	if !mode.IsValid() {
+		return nil, fmt.Errorf("invalid mode: %s", c.Mode)
+	}
+
+	rule := &Rule{Mode: mode}
+
+	for _, d := range c.Domain {
+		rule.matchers = append(rule.matchers, domainMatcher(normalizeHost(d)))
+	}
+	for _, d := range c.DomainSuffix {
+		rule.matchers = append(rule.matchers, suffixMatcher(strings.TrimPrefix(normalizeHost(d), ".")))
+	}
+	for _, k := range c.DomainKeyword {
+		rule.matchers = append(rule.matchers, keywordMatcher(strings.ToLower(k)))
+	}
+	for _, s := range c.CIDR {
+		network, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		rule.matchers = append(rule.matchers, cidrMatcher{network: network})
+	}
+	if len(c.GeoIP) > 0 && !geo.HasCountry() {
+		return nil, fmt.Errorf("geoip conditions require geoip.country_db")
+	}
+	if len(c.ASN) > 0 && !geo.HasASN() {
+		return nil, fmt.Errorf("asn conditions require geoip.asn_db")
+	}
+	if len(c.GeoIP) > 0 || len(c.ASN) > 0 {
+		gm := &geoMatcher{
+			db:        geo,
+			countries: make(map[string]struct{}),
+			asns:      make(map[uint]struct{}),
+			noResolve: c.NoResolve,
+		}
+		for _, cc := range c.GeoIP {
+			gm.countries[strings.ToUpper(strings.TrimSpace(cc))] = struct{}{}
+		}
+		for _, asn := range c.ASN {
+			gm.asns[asn] = struct{}{}
+		}
+		rule.matchers = append(rule.matchers, gm)
+	}
+	for _, p := range c.Port {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		rule.ports = append(rule.ports, pr)
+	}
+
+	if len(rule.matchers) == 0 && len(rule.ports) == 0 {
+		return nil, fmt.Errorf("no match conditions")
+	}
+
+	return rule, nil
+}
+
+// parsePortRange parses "443" or "8000-9000"
+func parsePortRange(s string) (portRange, error) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		to = from
+	}
+
+	lo, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port: %s", s)
+	}
+	hi, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port: %s", s)
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return portRange{}, fmt.Errorf("invalid port range: %s", s)
+	}
+
+	return portRange{from: lo, to: hi}, nil
+}
+
+// Match returns the first rule matching the destination address (host:port).
+// domain is the known domain of an IP target (may be empty); domain conditions
+// match it while CIDR and geoip/asn conditions use the IP.
+// Domain targets may be resolved here for geoip/asn rules.
+func (rs *RuleSet) Match(ctx context.Context, address, domain string) (*Rule, bool) {
+	if rs == nil || len(rs.rules) == 0 {
+		return nil, false
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	dst := &destination{host: normalizeHost(host), port: port, ctx: ctx}
+	if ip := net.ParseIP(dst.host); ip != nil {
+		dst.host, dst.ip = normalizeHost(domain), ip
+	}
+
+	for _, rule := range rs.rules {
+		if rule.match(dst) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// Len returns the number of rules
+func (rs *RuleSet) Len() int {
+	if rs == nil {
+		return 0
+	}
+	return len(rs.rules)
+}
+
+// normalizeHost lowercases a domain and strips the trailing dot
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
@@ -0,0 +1,130 @@
+package router
+
+import (
+	"context"
+	"testing"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+	"github.com/scinfra-pro/switch-gate/internal/geoip"
+)
+
+func TestNewRuleNeedsGeoSource(t *testing.T) {
+	empty, err := geoip.Open("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.RuleConfig
+	}{
+		{"geoip", config.RuleConfig{GeoIP: []string{"DE"}, Mode: "warp"}},
+		{"asn", config.RuleConfig{ASN: []uint{13335}, Mode: "warp"}},
+		{"geoip and cidr", config.RuleConfig{GeoIP: []string{"DE"}, CIDR: []string{"192.0.2.0/24"}, Mode: "warp"}},
+	}
+	for _, tt := range tests {
+		for _, db := range []*geoip.DB{nil, empty} {
+			if _, err := newRule(tt.cfg, db); err == nil {
+				t.Errorf("%s: rule accepted without its database (db %v)", tt.name, db)
+			}
+		}
+	}
+
+	// Rules without geo conditions need no database
+	if _, err := newRule(config.RuleConfig{CIDR: []string{"192.0.2.0/24"}, Mode: "warp"}, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	rs, err := NewRuleSet([]config.RuleConfig{
+		{Domain: []string{"Exact.Example."}, Mode: "a"},
+		{DomainSuffix: []string{".corp.example"}, Mode: "b"},
+		{DomainKeyword: []string{"Tracker"}, Mode: "c"},
+		{CIDR: []string{"10.0.0.0/8", "2001:db8::/32"}, Mode: "d"},
+		{CIDR: []string{"192.0.2.1"}, Port: []string{"22", "8000-8999"}, Mode: "e"},
+		{Port: []string{"25"}, Mode: "f"},
+		{DomainSuffix: []string{"example"}, Mode: "g"}, // Shadowed by earlier rules for their targets
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		domain  string // Known domain of an IP target
+		mode    Mode   // Empty: no rule matches
+	}{
+		{"exact.example:443", "", "a"},
+		{"EXACT.example.:443", "", "a"},
+		{"sub.exact.example:443", "", "g"},
+		{"corp.example:443", "", "b"},
+		{"a.b.corp.example:443", "", "b"},
+		{"notcorp.example:443", "", "g"},
+		{"ad.tracker.net:443", "", "c"},
+		{"10.1.2.3:443", "", "d"},
+		{"[2001:db8::1]:443", "", "d"},
+		{"11.0.0.1:443", "", ""},
+		{"192.0.2.1:22", "", "e"},
+		{"192.0.2.1:8080", "", "e"},
+		{"192.0.2.1:9000", "", ""},
+		{"192.0.2.2:22", "", ""},
+		{"mail.other.net:25", "", "f"},
+		{"mail.corp.example:25", "", "b"}, // First match wins
+		{"10.0.0.1:25", "", "d"},
+		{"203.0.113.1:443", "sub.corp.example", "b"}, // Domain of an IP target
+		{"10.0.0.1:443", "exact.example", "a"},
+		{"other.net:443", "", ""},
+		{"no-port", "", ""},
+	}
+	for _, tt := range tests {
+		rule, ok := rs.Match(context.Background(), tt.address, tt.domain)
+		var got Mode
+		if ok {
+			got = rule.Mode
+		}
+		if got != tt.mode {
+			t.Errorf("Match(%s, %q) = %q, want %q", tt.address, tt.domain, got, tt.mode)
+		}
+	}
+
+	var none *RuleSet
+	if _, ok := none.Match(context.Background(), "example.com:443", ""); ok {
+		t.Error("nil rule set matches")
+	}
+}
+
+func TestNewRuleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.RuleConfig
+	}{
+		{"no conditions", config.RuleConfig{Mode: "a"}},
+		{"invalid mode", config.RuleConfig{Domain: []string{"example.com"}, Mode: "Not A Mode"}},
+		{"invalid cidr", config.RuleConfig{CIDR: []string{"10.0.0.0/33"}, Mode: "a"}},
+		{"invalid port", config.RuleConfig{Port: []string{"http"}, Mode: "a"}},
+		{"port out of range", config.RuleConfig{Port: []string{"70000"}, Mode: "a"}},
+		{"reversed range", config.RuleConfig{Port: []string{"9000-8000"}, Mode: "a"}},
+	}
+	for _, tt := range tests {
+		if _, err := newRule(tt.cfg, nil); err == nil {
+			t.Errorf("%s: rule accepted", tt.name)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want portRange
+	}{
+		{"443", portRange{443, 443}},
+		{" 8000 - 9000 ", portRange{8000, 9000}},
+		{"1-65535", portRange{1, 65535}},
+	}
+	for _, tt := range tests {
+		if got, err := parsePortRange(tt.in); err != nil || got != tt.want {
+			t.Errorf("parsePortRange(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
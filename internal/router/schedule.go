@@ -0,0 +1,143 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// scheduleLookback bounds the search for the last slot on startup
+const scheduleLookback = 7 * 24 * time.Hour
+
+// scheduleEntry switches to a mode whenever its cron expression fires
+type scheduleEntry struct {
+	spec     string
+	mode     Mode
+	location *time.Location
+	schedule cron.Schedule
+}
+
+// next returns the first slot after t
+func (e *scheduleEntry) next(t time.Time) time.Time {
+	return e.schedule.Next(t.In(e.location))
+}
+
+// newSchedule parses the schedule entries
+func newSchedule(cfg config.ScheduleConfig, registry *Registry) ([]*scheduleEntry, error) {
+	defaultLoc := time.Local
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %w", err)
+		}
+		defaultLoc = loc
+	}
+
+	entries := make([]*scheduleEntry, 0, len(cfg.Entries))
+	for i, ec := range cfg.Entries {
+		sched, err := cron.ParseStandard(ec.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: cron %q: %w", i+1, ec.Cron, err)
+		}
+		if !registry.Has(Mode(ec.Mode)) {
+			return nil, fmt.Errorf("entry %d: unknown mode %q", i+1, ec.Mode)
+		}
+
+		loc := defaultLoc
+		if ec.Timezone != "" {
+			if loc, err = time.LoadLocation(ec.Timezone); err != nil {
+				return nil, fmt.Errorf("entry %d: timezone: %w", i+1, err)
+			}
+		}
+
+		entries = append(entries, &scheduleEntry{spec: ec.Cron, mode: Mode(ec.Mode), location: loc, schedule: sched})
+	}
+	return entries, nil
+}
+
+// ScheduledSwitch is an upcoming scheduled mode switch
+type ScheduledSwitch struct {
+	Mode Mode
+	At   time.Time
+	Cron string
+}
+
+// NextScheduled returns the next slot of every schedule entry, earliest first
+func (r *Router) NextScheduled() []ScheduledSwitch {
+	now := time.Now()
+	result := make([]ScheduledSwitch, 0, len(r.schedule))
+	for _, e := range r.schedule {
+		at := e.next(now)
+		if at.IsZero() {
+			continue // Never fires again
+		}
+		result = append(result, ScheduledSwitch{Mode: e.mode, At: at, Cron: e.spec})
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].At.Before(result[j].At) })
+	return result
+}
+
+// RunSchedule switches modes at the scheduled slots until ctx is done.
+// On start it applies the mode of the last slot that has passed (within a
+// week). Manual switches hold until the next slot.
+func (r *Router) RunSchedule(ctx context.Context) {
+	if len(r.schedule) == 0 {
+		return
+	}
+	log.Printf("INFO: Schedule started (%d entries)", len(r.schedule))
+
+	if mode, at := r.lastScheduled(time.Now()); mode != "" {
+		log.Printf("INFO: Schedule: applying %s of %s", mode, at.Format(time.RFC3339))
+		r.applyScheduled(mode)
+	}
+
+	for {
+		next := r.NextScheduled()
+		if len(next) == 0 {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next[0].At))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		// Entries due at the same time apply in configuration order, the last one wins
+		mode := next[0].Mode
+		for _, n := range next[1:] {
+			if n.At.Equal(next[0].At) {
+				mode = n.Mode
+			}
+		}
+		r.applyScheduled(mode)
+	}
+}
+
+// lastScheduled returns the mode and time of the latest slot before now
+func (r *Router) lastScheduled(now time.Time) (Mode, time.Time) {
+	var mode Mode
+	var last time.Time
+	for _, e := range r.schedule {
+		for t := e.next(now.Add(-scheduleLookback)); !t.IsZero() && t.Before(now); t = e.next(t) {
+			if !t.Before(last) {
+				mode, last = e.mode, t
+			}
+		}
+	}
+	return mode, last
+}
+
+func (r *Router) applyScheduled(mode Mode) {
+	if err := r.SwitchMode(mode, TriggerSchedule); err != nil {
+		log.Printf("WARN: Schedule: switch to %s failed: %v", mode, err)
+	}
+}
@@ -0,0 +1,139 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const scheduleModes = `
+modes:
+  a: {type: direct}
+  b: {type: direct}
+`
+
+func TestScheduleLoadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule string
+	}{
+		{"invalid cron", `{entries: [{cron: "0 25 * * *", mode: a}]}`},
+		{"too many fields", `{entries: [{cron: "0 0 8 * * *", mode: a}]}`},
+		{"unknown descriptor", `{entries: [{cron: "@fortnightly", mode: a}]}`},
+		{"unknown mode", `{entries: [{cron: "0 8 * * *", mode: nope}]}`},
+		{"unknown timezone", `{timezone: Mars/Olympus, entries: [{cron: "0 8 * * *", mode: a}]}`},
+		{"unknown entry timezone", `{entries: [{cron: "0 8 * * *", mode: a, timezone: Mars/Olympus}]}`},
+	}
+	for _, tt := range tests {
+		if _, err := newTestRouterErr(scheduleModes + "schedule: " + tt.schedule + "\n"); err == nil {
+			t.Errorf("%s: schedule accepted", tt.name)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	r := newTestRouter(t, scheduleModes+`
+schedule:
+  timezone: UTC
+  entries:
+    - {cron: "0 8 * * 1-5", mode: a}
+    - {cron: "0 8 * * *", mode: b, timezone: Europe/Berlin}
+`)
+	// Monday, 2026-01-05 06:00 UTC
+	now := time.Date(2026, 1, 5, 6, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		entry int
+		from  time.Time
+		want  time.Time
+	}{
+		{0, now, time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)},
+		{0, time.Date(2026, 1, 9, 9, 0, 0, 0, time.UTC), time.Date(2026, 1, 12, 8, 0, 0, 0, time.UTC)}, // Friday to Monday
+		{1, now, time.Date(2026, 1, 5, 7, 0, 0, 0, time.UTC)},                                          // CET
+		{1, time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 7, 1, 6, 0, 0, 0, time.UTC)},  // CEST
+	}
+	for _, tt := range tests {
+		if got := r.schedule[tt.entry].next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("entry %d: next(%s) = %s, want %s", tt.entry, tt.from, got.UTC(), tt.want)
+		}
+	}
+}
+
+func TestLastScheduled(t *testing.T) {
+	r := newTestRouter(t, scheduleModes+`
+schedule:
+  timezone: UTC
+  entries:
+    - {cron: "0 8 * * *", mode: a}
+    - {cron: "0 20 * * *", mode: b}
+    - {cron: "0 12 * * 0", mode: a}
+    - {cron: "0 12 * * 0", mode: b}
+`)
+
+	tests := []struct {
+		now  time.Time
+		mode Mode
+		at   time.Time
+	}{
+		{time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC), "a", time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 1, 5, 21, 0, 0, 0, time.UTC), "b", time.Date(2026, 1, 5, 20, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 1, 6, 7, 0, 0, 0, time.UTC), "b", time.Date(2026, 1, 5, 20, 0, 0, 0, time.UTC)},
+		// The slot of now has not passed yet
+		{time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC), "b", time.Date(2026, 1, 4, 20, 0, 0, 0, time.UTC)},
+		// Sunday noon: entries due at the same time, the last one wins
+		{time.Date(2026, 1, 4, 13, 0, 0, 0, time.UTC), "b", time.Date(2026, 1, 4, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		mode, at := r.lastScheduled(tt.now)
+		if mode != tt.mode || !at.Equal(tt.at) {
+			t.Errorf("lastScheduled(%s) = %s at %s, want %s at %s", tt.now, mode, at, tt.mode, tt.at)
+		}
+	}
+
+	// Nothing within the lookback
+	r = newTestRouter(t, scheduleModes+`
+schedule:
+  entries: [{cron: "0 8 29 2 *", mode: a}]
+`)
+	if mode, _ := r.lastScheduled(time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)); mode != "" {
+		t.Errorf("lastScheduled = %s, want none", mode)
+	}
+}
+
+func TestApplyScheduled(t *testing.T) {
+	r := newTestRouter(t, scheduleModes+`
+limits:
+  b: {max_mb: 1, action: block}
+`)
+
+	r.applyScheduled("a")
+	r.mu.RLock()
+	mode, preferred := r.mode, r.preferred
+	r.mu.RUnlock()
+	if mode != "a" || preferred != "a" {
+		t.Errorf("after applying a: mode %s, preferred %s", mode, preferred)
+	}
+
+	// A blocked mode is not switched to
+	r.metrics.AddBytes("b", 2*1024*1024)
+	r.checkLimit("b")
+	r.applyScheduled("b")
+	if got := r.GetMode(); got != "a" {
+		t.Errorf("applied blocked mode: mode %s, want a", got)
+	}
+}
+
+func TestRunScheduleAppliesLastSlot(t *testing.T) {
+	r := newTestRouter(t, scheduleModes+`
+schedule:
+  entries: [{cron: "* * * * *", mode: b}]
+`)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Applies the slot of the last minute, then stops with ctx
+	r.RunSchedule(ctx)
+	if got := r.GetMode(); got != "b" {
+		t.Errorf("mode %s, want b", got)
+	}
+}
@@ -0,0 +1,202 @@
+package router
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/net/proxy"
+	"lukechampine.com/blake3"
+)
+
+// ssCipher describes a Shadowsocks AEAD method
+type ssCipher struct {
+	keySize int
+	is2022  bool // SIP022 (2022-blake3-*): base64 PSK, BLAKE3 subkeys, headers
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ssCiphers lists supported methods by their standard names
+var ssCiphers = map[string]ssCipher{
+	"aes-128-gcm":                   {keySize: 16, newAEAD: newGCM},
+	"aes-256-gcm":                   {keySize: 32, newAEAD: newGCM},
+	"chacha20-ietf-poly1305":        {keySize: 32, newAEAD: chacha20poly1305.New},
+	"2022-blake3-aes-128-gcm":       {keySize: 16, is2022: true, newAEAD: newGCM},
+	"2022-blake3-aes-256-gcm":       {keySize: 32, is2022: true, newAEAD: newGCM},
+	"2022-blake3-chacha20-poly1305": {keySize: 32, is2022: true, newAEAD: chacha20poly1305.New},
+}
+
+// ShadowsocksDialer connects through a Shadowsocks AEAD server
+type ShadowsocksDialer struct {
+	name       string
+	serverAddr string
+	method     string
+	cipher     ssCipher
+	key        []byte
+	forward    proxy.ContextDialer
+}
+
+// NewShadowsocksDialer creates a dialer that routes through a Shadowsocks server,
+// reaching the server itself through forward.
+// For 2022-blake3-* methods the password is the base64-encoded PSK.
+func NewShadowsocksDialer(name, host string, port int, method, password string, forward proxy.ContextDialer) (*ShadowsocksDialer, error) {
+	c, ok := ssCiphers[method]
+	if !ok {
+		return nil, fmt.Errorf("unsupported shadowsocks method: %q", method)
+	}
+	if password == "" {
+		return nil, fmt.Errorf("password is not configured")
+	}
+
+	var key []byte
+	if c.is2022 {
+		psk, err := base64.StdEncoding.DecodeString(password)
+		if err != nil {
+			return nil, fmt.Errorf("decode 2022 PSK: %w", err)
+		}
+		if len(psk) != c.keySize {
+			return nil, fmt.Errorf("2022 PSK must be %d bytes, got %d", c.keySize, len(psk))
+		}
+		key = psk
+	} else {
+		key = evpBytesToKey(password, c.keySize)
+	}
+
+	return &ShadowsocksDialer{
+		name:       name,
+		serverAddr: net.JoinHostPort(host, strconv.Itoa(port)),
+		method:     method,
+		cipher:     c,
+		key:        key,
+		forward:    forward,
+	}, nil
+}
+
+// DialContext connects to the address through the Shadowsocks server
+func (d *ShadowsocksDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s not supported by shadowsocks", network)
+	}
+
+	target, err := encodeSocksAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to shadowsocks server %s: %w", d.serverAddr, err)
+	}
+
+	// The request write honours the deadline and cancellation of ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetWriteDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	ssConn := newSSConn(conn, d.cipher, d.key)
+	if err := ssConn.writeRequest(target); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("send shadowsocks request: %w", ctxError(ctx, err))
+	}
+
+	if !stop() {
+		// ctx was cancelled right after the request
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+	_ = conn.SetWriteDeadline(time.Time{})
+
+	return ssConn, nil
+}
+
+// Name returns the dialer name
+func (d *ShadowsocksDialer) Name() string {
+	return d.name
+}
+
+// evpBytesToKey derives the master key from a password (OpenSSL EVP_BytesToKey with MD5)
+func evpBytesToKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < keyLen {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-h.Size():]
+	}
+	return key[:keyLen]
+}
+
+// sessionKey derives the per-connection subkey from the master key and salt
+func (c ssCipher) sessionKey(key, salt []byte) ([]byte, error) {
+	if c.is2022 {
+		material := make([]byte, 0, len(key)+len(salt))
+		material = append(material, key...)
+		material = append(material, salt...)
+		subkey := make([]byte, c.keySize)
+		blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", material)
+		return subkey, nil
+	}
+	return hkdf.Key(sha1.New, key, salt, "ss-subkey", c.keySize)
+}
+
+// newSalt returns a random salt of the key size
+func (c ssCipher) newSalt() ([]byte, error) {
+	salt := make([]byte, c.keySize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// encodeSocksAddr encodes host:port as a SOCKS5 address (ATYP | ADDR | PORT)
+func encodeSocksAddr(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+
+	var buf []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append([]byte{0x01}, ip4...)
+		} else {
+			buf = append([]byte{0x04}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain too long: %s", host)
+		}
+		buf = append([]byte{0x03, byte(len(host))}, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
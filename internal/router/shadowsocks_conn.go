@@ -0,0 +1,249 @@
+package router
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ssTagSize        = 16
+	ssMaxPayload     = 0x3FFF // AEAD chunk limit
+	ss2022MaxPayload = 0xFFFF // SIP022 chunk limit
+	ss2022MaxPadding = 900
+
+	// ss2022MaxTimeDiff is the allowed clock skew for SIP022 headers
+	ss2022MaxTimeDiff = 30 * time.Second
+
+	ss2022ClientStream = 0
+	ss2022ServerStream = 1
+)
+
+// ssConn is a client-side Shadowsocks AEAD stream
+type ssConn struct {
+	net.Conn
+	cipher ssCipher
+	key    []byte
+
+	// Write side
+	wMu      sync.Mutex
+	enc      cipher.AEAD
+	encNonce []byte
+	reqSalt  []byte // SIP022: echoed back by the server
+
+	// Read side
+	rMu      sync.Mutex
+	dec      cipher.AEAD
+	decNonce []byte
+	pending  []byte // decrypted but not yet returned
+}
+
+func newSSConn(conn net.Conn, c ssCipher, key []byte) *ssConn {
+	return &ssConn{Conn: conn, cipher: c, key: key}
+}
+
+func (c *ssConn) maxPayload() int {
+	if c.cipher.is2022 {
+		return ss2022MaxPayload
+	}
+	return ssMaxPayload
+}
+
+// writeRequest sends the salt and the target address header
+func (c *ssConn) writeRequest(target []byte) error {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+
+	salt, err := c.cipher.newSalt()
+	if err != nil {
+		return err
+	}
+	subkey, err := c.cipher.sessionKey(c.key, salt)
+	if err != nil {
+		return err
+	}
+	if c.enc, err = c.cipher.newAEAD(subkey); err != nil {
+		return err
+	}
+	c.encNonce = make([]byte, c.enc.NonceSize())
+	c.reqSalt = salt
+
+	buf := append([]byte(nil), salt...)
+
+	if !c.cipher.is2022 {
+		// The address is simply the start of the payload stream
+		buf = c.sealChunk(buf, target)
+		_, err = c.Conn.Write(buf)
+		return err
+	}
+
+	// SIP022 variable-length header: address | padding length | padding.
+	// There is no initial payload, so padding is mandatory.
+	padLen := 1 + mrand.IntN(ss2022MaxPadding)
+	varHeader := make([]byte, 0, len(target)+2+padLen)
+	varHeader = append(varHeader, target...)
+	varHeader = binary.BigEndian.AppendUint16(varHeader, uint16(padLen))
+	varHeader = append(varHeader, make([]byte, padLen)...)
+
+	// Fixed-length header: type | timestamp | variable header length
+	fixed := make([]byte, 0, 11)
+	fixed = append(fixed, ss2022ClientStream)
+	fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+	fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(varHeader)))
+
+	buf = c.seal(buf, fixed)
+	buf = c.seal(buf, varHeader)
+	_, err = c.Conn.Write(buf)
+	return err
+}
+
+// seal appends one encrypted message and advances the nonce
+func (c *ssConn) seal(dst, plaintext []byte) []byte {
+	dst = c.enc.Seal(dst, c.encNonce, plaintext, nil)
+	incNonce(c.encNonce)
+	return dst
+}
+
+// sealChunk appends an encrypted length followed by the encrypted payload
+func (c *ssConn) sealChunk(dst, payload []byte) []byte {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(payload)))
+	dst = c.seal(dst, length[:])
+	return c.seal(dst, payload)
+}
+
+// Write encrypts b into one or more chunks
+func (c *ssConn) Write(b []byte) (int, error) {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+
+	limit := c.maxPayload()
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), limit)
+		buf := make([]byte, 0, n+2+2*ssTagSize)
+		buf = c.sealChunk(buf, b[:n])
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Read decrypts the next chunk(s) from the server
+func (c *ssConn) Read(b []byte) (int, error) {
+	c.rMu.Lock()
+	defer c.rMu.Unlock()
+
+	if len(c.pending) == 0 {
+		if c.dec == nil {
+			if err := c.readResponseHeader(); err != nil {
+				return 0, err
+			}
+		}
+		if len(c.pending) == 0 {
+			payload, err := c.readChunk()
+			if err != nil {
+				return 0, err
+			}
+			c.pending = payload
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readResponseHeader reads the server salt (and SIP022 response header)
+func (c *ssConn) readResponseHeader() error {
+	salt := make([]byte, c.cipher.keySize)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	subkey, err := c.cipher.sessionKey(c.key, salt)
+	if err != nil {
+		return err
+	}
+	if c.dec, err = c.cipher.newAEAD(subkey); err != nil {
+		return err
+	}
+	c.decNonce = make([]byte, c.dec.NonceSize())
+
+	if !c.cipher.is2022 {
+		return nil
+	}
+
+	// Fixed-length header: type | timestamp | request salt | first chunk length
+	header, err := c.open(1 + 8 + len(c.reqSalt) + 2)
+	if err != nil {
+		return err
+	}
+	if header[0] != ss2022ServerStream {
+		return fmt.Errorf("shadowsocks: unexpected stream type %d", header[0])
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(header[1:9])), 0)
+	if diff := time.Since(ts); diff > ss2022MaxTimeDiff || diff < -ss2022MaxTimeDiff {
+		return fmt.Errorf("shadowsocks: server timestamp out of range (%v)", diff.Round(time.Second))
+	}
+	// reqSalt is set in writeRequest, before the conn is returned from Dial
+	reqSalt := c.reqSalt
+	if !bytes.Equal(header[9:9+len(reqSalt)], reqSalt) {
+		return errors.New("shadowsocks: request salt mismatch")
+	}
+
+	length := int(binary.BigEndian.Uint16(header[9+len(reqSalt):]))
+	if length > 0 {
+		if c.pending, err = c.open(length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChunk reads one length-prefixed chunk
+func (c *ssConn) readChunk() ([]byte, error) {
+	lengthBuf, err := c.open(2)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(lengthBuf))
+	if !c.cipher.is2022 {
+		length &= ssMaxPayload
+	}
+	return c.open(length)
+}
+
+// open reads and decrypts a message of the given plaintext size
+func (c *ssConn) open(size int) ([]byte, error) {
+	buf := make([]byte, size+ssTagSize)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := c.dec.Open(buf[:0], c.decNonce, buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: decrypt failed (wrong password or method?)")
+	}
+	incNonce(c.decNonce)
+	return plaintext, nil
+}
+
+// incNonce increments a little-endian nonce
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
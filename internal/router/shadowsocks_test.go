@@ -0,0 +1,367 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ssTestServer is an in-process Shadowsocks server. It checks the target
+// of every connection, echoes the payload back and reports errors.
+func ssTestServer(t *testing.T, c ssCipher, key []byte, wantTarget []byte) (string, <-chan error) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	errs := make(chan error, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				if err := serveSS(conn, c, key, wantTarget); err != nil && !errors.Is(err, io.EOF) {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), errs
+}
+
+// serveSS handles one connection on the server side, reusing the AEAD
+// framing of ssConn with the roles swapped
+func serveSS(conn net.Conn, c ssCipher, key []byte, wantTarget []byte) error {
+	s := &ssConn{Conn: conn, cipher: c, key: key}
+
+	reqSalt := make([]byte, c.keySize)
+	if _, err := io.ReadFull(conn, reqSalt); err != nil {
+		return err
+	}
+	subkey, err := c.sessionKey(key, reqSalt)
+	if err != nil {
+		return err
+	}
+	if s.dec, err = c.newAEAD(subkey); err != nil {
+		return err
+	}
+	s.decNonce = make([]byte, s.dec.NonceSize())
+
+	var target []byte
+	if c.is2022 {
+		if target, err = readSS2022Request(s); err != nil {
+			return err
+		}
+	} else if target, err = s.readChunk(); err != nil {
+		return err
+	}
+	if !bytes.Equal(target, wantTarget) {
+		return fmt.Errorf("target %x, want %x", target, wantTarget)
+	}
+
+	salt, err := c.newSalt()
+	if err != nil {
+		return err
+	}
+	if subkey, err = c.sessionKey(key, salt); err != nil {
+		return err
+	}
+	if s.enc, err = c.newAEAD(subkey); err != nil {
+		return err
+	}
+	s.encNonce = make([]byte, s.enc.NonceSize())
+
+	for first := true; ; first = false {
+		payload, err := s.readChunk()
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := s.Write(payload); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Salt and response header precede the first chunk
+		buf := append([]byte(nil), salt...)
+		if !c.is2022 {
+			buf = s.sealChunk(buf, payload)
+		} else {
+			fixed := []byte{ss2022ServerStream}
+			fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+			fixed = append(fixed, reqSalt...)
+			fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(payload)))
+			buf = s.seal(buf, fixed)
+			buf = s.seal(buf, payload)
+		}
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+	}
+}
+
+// readSS2022Request reads the SIP022 request header and returns the target
+func readSS2022Request(s *ssConn) ([]byte, error) {
+	fixed, err := s.open(11)
+	if err != nil {
+		return nil, err
+	}
+	if fixed[0] != ss2022ClientStream {
+		return nil, fmt.Errorf("stream type %d", fixed[0])
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(fixed[1:9])), 0)
+	if diff := time.Since(ts); diff > ss2022MaxTimeDiff || diff < -ss2022MaxTimeDiff {
+		return nil, fmt.Errorf("timestamp off by %v", diff)
+	}
+	header, err := s.open(int(binary.BigEndian.Uint16(fixed[9:])))
+	if err != nil {
+		return nil, err
+	}
+
+	var addrLen int
+	switch header[0] {
+	case 0x01:
+		addrLen = 1 + 4 + 2
+	case 0x03:
+		addrLen = 2 + int(header[1]) + 2
+	case 0x04:
+		addrLen = 1 + 16 + 2
+	default:
+		return nil, fmt.Errorf("address type %d", header[0])
+	}
+	padLen := int(binary.BigEndian.Uint16(header[addrLen:]))
+	if padLen < 1 || padLen > ss2022MaxPadding {
+		return nil, fmt.Errorf("padding length %d", padLen)
+	}
+	if rest := len(header) - addrLen - 2; rest != padLen {
+		return nil, fmt.Errorf("%d bytes after the address, want %d of padding", rest, padLen)
+	}
+	return header[:addrLen], nil
+}
+
+func TestShadowsocksRoundTrip(t *testing.T) {
+	psk16 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, 16))
+	psk32 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, 32))
+
+	tests := []struct {
+		method   string
+		password string
+	}{
+		{"aes-128-gcm", "secret"},
+		{"aes-256-gcm", "secret"},
+		{"chacha20-ietf-poly1305", "secret"},
+		{"2022-blake3-aes-128-gcm", psk16},
+		{"2022-blake3-aes-256-gcm", psk32},
+		{"2022-blake3-chacha20-poly1305", psk32},
+	}
+
+	// Larger than both chunk limits
+	payload := make([]byte, 200_000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			for _, address := range []string{"example.com:443", "192.0.2.1:80", "[2001:db8::1]:8080"} {
+				target, err := encodeSocksAddr(address)
+				if err != nil {
+					t.Fatal(err)
+				}
+				probe, err := NewShadowsocksDialer("ss", "127.0.0.1", 1, tt.method, tt.password, &net.Dialer{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				addr, errs := ssTestServer(t, probe.cipher, probe.key, target)
+				server, _ := net.ResolveTCPAddr("tcp", addr)
+
+				d, err := NewShadowsocksDialer("ss", "127.0.0.1", server.Port, tt.method, tt.password, &net.Dialer{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				conn, err := d.DialContext(ctx, "tcp", address)
+				cancel()
+				if err != nil {
+					t.Fatalf("dial %s: %v", address, err)
+				}
+
+				go func() { _, _ = conn.Write(payload) }()
+				got := make([]byte, len(payload))
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.ReadFull(conn, got); err != nil {
+					select {
+					case serverErr := <-errs:
+						t.Fatalf("%s: read echo: %v (server: %v)", address, err, serverErr)
+					default:
+						t.Fatalf("%s: read echo: %v", address, err)
+					}
+				}
+				if !bytes.Equal(got, payload) {
+					t.Fatalf("%s: echoed payload differs", address)
+				}
+				_ = conn.Close()
+			}
+		})
+	}
+}
+
+func TestShadowsocksWrongPassword(t *testing.T) {
+	target, _ := encodeSocksAddr("example.com:443")
+	server, err := NewShadowsocksDialer("ss", "127.0.0.1", 1, "aes-256-gcm", "server", &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, errs := ssTestServer(t, server.cipher, server.key, target)
+
+	ln, _ := net.ResolveTCPAddr("tcp", addr)
+	d, err := NewShadowsocksDialer("ss", "127.0.0.1", ln.Port, "aes-256-gcm", "client", &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_, _ = conn.Write([]byte("hello"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Fatal("read succeeded with a wrong password")
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "decrypt failed") {
+			t.Fatalf("server: %v, want decrypt error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server accepted the request")
+	}
+}
+
+// pipeDialer returns one end of a pipe nobody reads from
+type pipeDialer struct{}
+
+func (pipeDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	client, _ := net.Pipe()
+	return client, nil
+}
+
+func TestShadowsocksDialContextDeadline(t *testing.T) {
+	d, err := NewShadowsocksDialer("ss", "127.0.0.1", 1, "aes-128-gcm", "secret", pipeDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.DialContext(ctx, "tcp", "example.com:443")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		// The write deadline and ctx expire together: either error will do
+		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("err = %v, want deadline exceeded", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request write ignored the context deadline")
+	}
+}
+
+func TestEVPBytesToKey(t *testing.T) {
+	tests := []struct {
+		keyLen int
+		want   string
+	}{
+		{16, "5f4dcc3b5aa765d61d8327deb882cf99"},
+		{32, "5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(evpBytesToKey("password", tt.keyLen)); got != tt.want {
+			t.Errorf("evpBytesToKey(password, %d) = %s, want %s", tt.keyLen, got, tt.want)
+		}
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	seq := func(from, n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(from + i)
+		}
+		return b
+	}
+
+	tests := []struct {
+		method string
+		key    []byte
+		salt   []byte
+		want   string
+	}{
+		// HKDF-SHA1 with info "ss-subkey"
+		{"aes-128-gcm", evpBytesToKey("password", 16), seq(100, 16), "cc6f6e5cc78258582bf2385915807bcd"},
+		{"aes-256-gcm", evpBytesToKey("password", 32), seq(100, 32), "ddedc9c9ee41c1bee0afe2333c4ead2b0f99331af73a9070a86741dbf622c4ec"},
+		// BLAKE3 derive_key "shadowsocks 2022 session subkey" over key | salt
+		{"2022-blake3-aes-128-gcm", seq(0, 16), seq(100, 16), "7e504e78da28b14d4fb48f08430baf79"},
+		{"2022-blake3-aes-256-gcm", seq(0, 32), seq(100, 32), "1cb1daec0bd7d02d913a22b60d39e518259adb8f0b63c445b8a5e04a8e52bf65"},
+	}
+	for _, tt := range tests {
+		got, err := ssCiphers[tt.method].sessionKey(tt.key, tt.salt)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.method, err)
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%s: subkey %x, want %s", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeSocksAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr bool
+	}{
+		{"192.0.2.1:80", "01c00002010050", false},
+		{"example.com:443", "030b6578616d706c652e636f6d01bb", false},
+		{"[2001:db8::1]:8080", "0420010db80000000000000000000000011f90", false},
+		{"example.com", "", true},
+		{"example.com:70000", "", true},
+	}
+	for _, tt := range tests {
+		got, err := encodeSocksAddr(tt.address)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v", tt.address, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%s: %x, want %s", tt.address, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"time"
@@ -10,9 +11,10 @@ import (
 
 // Socks5Dialer connects through a SOCKS5 upstream proxy
 type Socks5Dialer struct {
+	name      string
 	proxyAddr string
 	auth      *proxy.Auth
-	dialer    proxy.Dialer
+	dialer    proxy.ContextDialer
 }
 
 // localIPDialer wraps net.Dialer to bind to specific local IP
@@ -25,24 +27,23 @@ func (d *localIPDialer) Dial(network, addr string) (net.Conn, error) {
 	return d.dialer.Dial(network, addr)
 }
 
-// NewSocks5Dialer creates a dialer that routes through a SOCKS5 proxy
-func NewSocks5Dialer(host string, port int, username, password string, localIP string) (*Socks5Dialer, error) {
-	proxyAddr := fmt.Sprintf("%s:%d", host, port)
+func (d *localIPDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, network, addr)
+}
 
-	var auth *proxy.Auth
-	if username != "" {
-		auth = &proxy.Auth{
-			User:     username,
-			Password: password,
-		}
-	}
+// forwardDialer reaches an upstream proxy server
+type forwardDialer interface {
+	proxy.Dialer
+	proxy.ContextDialer
+}
 
-	// Use custom dialer bound to server IP to bypass tunnel routing
-	var forward proxy.Dialer = proxy.Direct
+// newForwardDialer returns the dialer used to reach an upstream proxy,
+// bound to localIP if set
+func newForwardDialer(localIP string) forwardDialer {
 	if localIP != "" {
 		ip := net.ParseIP(localIP)
 		if ip != nil {
-			forward = &localIPDialer{
+			return &localIPDialer{
 				dialer: net.Dialer{
 					LocalAddr: &net.TCPAddr{IP: ip},
 					Timeout:   10 * time.Second,
@@ -51,25 +52,54 @@ func NewSocks5Dialer(host string, port int, username, password string, localIP s
 			}
 		}
 	}
+	return proxy.Direct
+}
+
+// contextForward adapts a Dialer to a forward dialer for another proxy
+type contextForward struct {
+	Dialer
+}
+
+func (f contextForward) Dial(network, addr string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, addr)
+}
+
+// NewSocks5Dialer creates a dialer that routes through a SOCKS5 proxy,
+// reaching the proxy itself through forward
+func NewSocks5Dialer(name, host string, port int, username, password string, forward forwardDialer) (*Socks5Dialer, error) {
+	proxyAddr := fmt.Sprintf("%s:%d", host, port)
+
+	var auth *proxy.Auth
+	if username != "" {
+		auth = &proxy.Auth{
+			User:     username,
+			Password: password,
+		}
+	}
 
 	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, forward)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
 	}
+	ctxDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("SOCKS5 dialer does not support contexts")
+	}
 
 	return &Socks5Dialer{
+		name:      name,
 		proxyAddr: proxyAddr,
 		auth:      auth,
-		dialer:    dialer,
+		dialer:    ctxDialer,
 	}, nil
 }
 
-// Dial connects to the address through the SOCKS5 proxy
-func (d *Socks5Dialer) Dial(network, address string) (net.Conn, error) {
-	return d.dialer.Dial(network, address)
+// DialContext connects to the address through the SOCKS5 proxy
+func (d *Socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, network, address)
 }
 
 // Name returns the dialer name
 func (d *Socks5Dialer) Name() string {
-	return "home"
+	return d.name
 }
@@ -0,0 +1,189 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+)
+
+// SwitchAction is what happens to open connections of the previous mode
+// when the current mode changes
+type SwitchAction string
+
+// Switch actions
+const (
+	SwitchKeep  SwitchAction = "keep"  // Let them run (default)
+	SwitchKill  SwitchAction = "kill"  // Close them right away
+	SwitchDrain SwitchAction = "drain" // Close the remaining ones after a grace period
+)
+
+// DefaultDrainGrace is the grace period of the drain action
+const DefaultDrainGrace = 30 * time.Second
+
+// SwitchPolicy is applied to the connections of the previous mode on a switch
+type SwitchPolicy struct {
+	Action SwitchAction
+	Grace  time.Duration // drain only
+}
+
+// ParseSwitchPolicy validates a policy name; grace defaults to DefaultDrainGrace
+func ParseSwitchPolicy(action string, grace time.Duration) (SwitchPolicy, error) {
+	if grace <= 0 {
+		grace = DefaultDrainGrace
+	}
+	switch a := SwitchAction(action); a {
+	case "", SwitchKeep:
+		return SwitchPolicy{Action: SwitchKeep}, nil
+	case SwitchKill, SwitchDrain:
+		return SwitchPolicy{Action: a, Grace: grace}, nil
+	default:
+		return SwitchPolicy{}, fmt.Errorf("unknown switch policy %q (keep, kill, drain)", action)
+	}
+}
+
+// switchPolicies holds the default policy and the per-trigger overrides
+type switchPolicies struct {
+	def       SwitchPolicy
+	byTrigger map[string]SwitchPolicy
+}
+
+// knownTriggers are the triggers a policy may be configured for
+var knownTriggers = []string{TriggerManual, TriggerLimitReached, TriggerLimitReset, TriggerHealth, TriggerSchedule}
+
+func newSwitchPolicies(cfg config.SwitchConfig) (switchPolicies, error) {
+	def, err := ParseSwitchPolicy(cfg.Policy, cfg.Grace)
+	if err != nil {
+		return switchPolicies{}, err
+	}
+
+	p := switchPolicies{def: def, byTrigger: make(map[string]SwitchPolicy)}
+	for trigger, tc := range cfg.Triggers {
+		known := false
+		for _, t := range knownTriggers {
+			known = known || t == trigger
+		}
+		if !known {
+			return switchPolicies{}, fmt.Errorf("unknown trigger %q", trigger)
+		}
+
+		grace := tc.Grace
+		if grace <= 0 {
+			grace = cfg.Grace
+		}
+		if p.byTrigger[trigger], err = ParseSwitchPolicy(tc.Policy, grace); err != nil {
+			return switchPolicies{}, fmt.Errorf("trigger %s: %w", trigger, err)
+		}
+	}
+	return p, nil
+}
+
+// forTrigger returns the policy for switches with the given trigger
+func (p switchPolicies) forTrigger(trigger string) SwitchPolicy {
+	if policy, ok := p.byTrigger[trigger]; ok {
+		return policy
+	}
+	return p.def
+}
+
+// connTracker keeps the open connections per mode
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*MeteredConn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[*MeteredConn]struct{})}
+}
+
+func (t *connTracker) add(c *MeteredConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c.tracker = t
+	t.conns[c] = struct{}{}
+}
+
+func (t *connTracker) remove(c *MeteredConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+// isOpen reports whether a connection is still tracked
+func (t *connTracker) isOpen(c *MeteredConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.conns[c]
+	return ok
+}
+
+// byMode returns the open connections the router selected a mode for,
+// whichever fallback or pool or race member carries them
+func (t *connTracker) byMode(mode Mode) []*MeteredConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var result []*MeteredConn
+	for c := range t.conns {
+		if c.selected == mode {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// counts returns the number of open connections per mode that carries them
+func (t *connTracker) counts() map[Mode]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[Mode]int)
+	for c := range t.conns {
+		result[Mode(c.mode)]++
+	}
+	return result
+}
+
+// applySwitchPolicy closes the connections of the previous mode as the policy says.
+// Drained connections are spared if the mode is current again when the grace period ends.
+func (r *Router) applySwitchPolicy(from Mode, policy SwitchPolicy) {
+	if policy.Action == SwitchKeep {
+		return
+	}
+	conns := r.conns.byMode(from)
+	if len(conns) == 0 {
+		return
+	}
+
+	switch policy.Action {
+	case SwitchKill:
+		closeConns(conns)
+		log.Printf("INFO: Closed %d %s connections (switch policy kill)", len(conns), from)
+
+	case SwitchDrain:
+		log.Printf("INFO: Draining %d %s connections for %v", len(conns), from, policy.Grace)
+		time.AfterFunc(policy.Grace, func() {
+			if r.GetMode() == from {
+				return // Switched back in the meantime
+			}
+			n := 0
+			for _, c := range conns {
+				if r.conns.isOpen(c) {
+					n++
+				}
+			}
+			closeConns(conns)
+			if n > 0 {
+				log.Printf("INFO: Closed %d %s connections after drain", n, from)
+			}
+		})
+	}
+}
+
+func closeConns(conns []*MeteredConn) {
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSwitchPolicy(t *testing.T) {
+	addr := echoServer(t)
+	modes := `
+modes:
+  a: {type: direct}
+  b: {type: direct}
+  p: {type: pool, members: [a, b]}
+  r: {type: race, members: [a, b]}
+rules:
+  - {domain: [member.test], mode: a}
+  - {domain: [pool.test], mode: p}
+  - {domain: [race.test], mode: r}
+`
+	tests := []struct {
+		from       Mode
+		bystanders []string // Hosts routed by rules to modes carried by the same members
+	}{
+		{"a", []string{"pool.test", "race.test"}},
+		{"p", []string{"member.test", "race.test"}},
+		{"r", []string{"member.test", "pool.test"}},
+	}
+
+	for _, tt := range tests {
+		for _, policy := range []string{"kill", "drain"} {
+			r := newTestRouter(t, modes+"mode_switch: {policy: "+policy+", grace: 100ms}\n")
+			if err := r.SetMode(tt.from); err != nil {
+				t.Fatal(err)
+			}
+			conn := dialTest(t, r, "", addr)
+			var others []*MeteredConn
+			for _, host := range tt.bystanders {
+				others = append(others, dialTest(t, r, host, addr))
+			}
+
+			if err := r.SetMode("b"); err != nil {
+				t.Fatal(err)
+			}
+			if policy == "drain" {
+				if !isOpen(conn) {
+					t.Fatalf("%s drain: closed before the grace period", tt.from)
+				}
+				time.Sleep(300 * time.Millisecond)
+			}
+			if isOpen(conn) {
+				t.Errorf("%s %s: connection of the previous mode (carried by %s) is open", tt.from, policy, conn.mode)
+			}
+			for i, c := range others {
+				if !isOpen(c) {
+					t.Errorf("%s %s: %s connection (carried by %s) was closed", tt.from, policy, tt.bystanders[i], c.mode)
+				}
+			}
+		}
+	}
+}
+
+func TestSwitchPolicyDrainSwitchedBack(t *testing.T) {
+	addr := echoServer(t)
+	r := newTestRouter(t, `
+modes:
+  a: {type: direct}
+  p: {type: pool, members: [a]}
+mode_switch: {policy: drain, grace: 100ms}
+`)
+	if err := r.SetMode("p"); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialTest(t, r, "", addr)
+
+	if err := r.SetMode("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetMode("p"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if !isOpen(conn) {
+		t.Error("drained connection closed although its mode is current again")
+	}
+}
+
+func TestSwitchPolicyKeep(t *testing.T) {
+	addr := echoServer(t)
+	r := newTestRouter(t, "modes:\n  a: {type: direct}\n")
+	if err := r.SetMode("a"); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialTest(t, r, "", addr)
+	if err := r.SetMode("direct"); err != nil {
+		t.Fatal(err)
+	}
+	if !isOpen(conn) {
+		t.Error("keep closed the connection")
+	}
+	if got := r.ConnectionsByMode()["a"]; got != 1 {
+		t.Errorf("connections of a = %d, want 1", got)
+	}
+}
@@ -0,0 +1,260 @@
+package router
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/scinfra-pro/switch-gate/internal/config"
+	"github.com/scinfra-pro/switch-gate/internal/state"
+)
+
+// DefaultFlushInterval is how often persisted state is saved
+const DefaultFlushInterval = time.Minute
+
+// State documents
+const (
+	quotaStateName   = "quotas"
+	trafficStateName = "traffic"
+	clientStateName  = "clients"
+)
+
+// quotaState is the persisted usage of a quota
+type quotaState struct {
+	PeriodStart time.Time `json:"period_start,omitempty"`
+	UsedBytes   uint64    `json:"used_bytes"`
+	Warned      int       `json:"warned,omitempty"` // Highest limit.warning threshold sent
+}
+
+// trafficState is the persisted traffic of all modes
+type trafficState struct {
+	PeriodStart time.Time                   `json:"period_start"`
+	Modes       map[string]modeTrafficState `json:"modes"`
+}
+
+// modeTrafficState is the persisted traffic of a mode
+type modeTrafficState struct {
+	TotalBytes  uint64  `json:"total_bytes"`     // Lifetime
+	PeriodBytes uint64  `json:"period_bytes"`    // In the accounting period
+	Spent       float64 `json:"spent,omitempty"` // Cost of the ended accounting periods
+}
+
+// clientState is the persisted traffic of all clients
+type clientState struct {
+	PeriodStart time.Time                              `json:"period_start"`
+	Clients     map[string]map[string]modeTrafficState `json:"clients"`         // By client and mode
+	Other       map[string]uint64                      `json:"other,omitempty"` // Lifetime bytes of dropped clients by mode
+}
+
+// trafficCounters count the bytes of every mode in the accounting period
+type trafficCounters struct {
+	period     *Period
+	start, end time.Time
+	modes      map[Mode]*quota
+	spent      map[Mode]float64 // Cost of the ended periods
+}
+
+// newTrafficCounters starts the accounting period (default: monthly)
+func newTrafficCounters(cfg config.PeriodConfig, registry *Registry) (*trafficCounters, error) {
+	if cfg.Type == "" {
+		cfg.Type = string(PeriodMonthly)
+	}
+	period, err := NewPeriod(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &trafficCounters{period: period, modes: make(map[Mode]*quota), spent: make(map[Mode]float64)}
+	t.start, t.end = period.bounds(time.Now(), time.Time{})
+	for _, info := range registry.Modes() {
+		t.modes[info.Name] = &quota{mode: info.Name, period: period, start: t.start, end: t.end}
+	}
+	return t, nil
+}
+
+// TrafficPeriodStatus is the traffic of every mode in the accounting period
+type TrafficPeriodStatus struct {
+	Period PeriodType
+	Start  time.Time
+	End    time.Time
+	Bytes  map[Mode]uint64
+}
+
+// TrafficPeriod returns the traffic of every mode in the current accounting period
+func (r *Router) TrafficPeriod() TrafficPeriodStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t := r.traffic
+	status := TrafficPeriodStatus{
+		Period: t.period.Type,
+		Start:  t.start,
+		End:    t.end,
+		Bytes:  make(map[Mode]uint64, len(t.modes)),
+	}
+	for mode, q := range t.modes {
+		status.Bytes[mode] = q.usage(r.metrics.GetBytes(mode.String()))
+	}
+	return status
+}
+
+// rollTraffic starts a new accounting period if the current one is over
+func (r *Router) rollTraffic(now time.Time) {
+	r.mu.Lock()
+	t := r.traffic
+	if now.Before(t.end) {
+		r.mu.Unlock()
+		return
+	}
+	prevStart, prevEnd := t.start, t.end
+	var total uint64
+	for mode, q := range t.modes {
+		used, _ := q.roll(now, r.metrics.GetBytes(mode.String()))
+		t.spent[mode] += r.pricing[mode].cost(used, t.period, prevStart, prevEnd)
+		total += used
+		t.start, t.end = q.start, q.end
+	}
+	r.mu.Unlock()
+	r.accounting.roll()
+
+	log.Printf("INFO: Accounting period %s - %s ended (%d MB total)",
+		prevStart.Format(time.DateOnly), prevEnd.Format(time.DateOnly), total/1024/1024)
+	if err := r.SaveState(); err != nil {
+		log.Printf("WARN: Failed to save state: %v", err)
+	}
+}
+
+// RestoreState loads the persisted traffic counters, quota usage and client
+// traffic from the store and keeps persisting them there. It must be called before any
+// traffic is relayed. Period counts of a period that ended while
+// switch-gate was stopped are discarded.
+func (r *Router) RestoreState(store *state.Store) error {
+	var traffic trafficState
+	if _, err := store.Load(trafficStateName, &traffic); err != nil {
+		return err
+	}
+	quotas := make(map[string]quotaState)
+	if _, err := store.Load(quotaStateName, &quotas); err != nil {
+		return err
+	}
+	var clients clientState
+	if _, err := store.Load(clientStateName, &clients); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.store = store
+	now := time.Now()
+
+	// Lifetime counters continue where they stopped
+	for mode, s := range traffic.Modes {
+		r.metrics.AddBytes(mode, int64(s.TotalBytes))
+	}
+
+	t := r.traffic
+	t.start, t.end = t.period.bounds(now, traffic.PeriodStart)
+	current := t.start.Equal(traffic.PeriodStart)
+	// Bounds of the saved period, to price it if it ended
+	savedStart, savedEnd := t.period.bounds(traffic.PeriodStart, traffic.PeriodStart)
+	for mode, q := range t.modes {
+		s := traffic.Modes[mode.String()]
+		q.start, q.end = t.start, t.end
+		q.used, q.mark = 0, r.metrics.GetBytes(mode.String())
+		t.spent[mode] = s.Spent
+		switch {
+		case current:
+			q.used = s.PeriodBytes
+		case !traffic.PeriodStart.IsZero():
+			t.spent[mode] += r.pricing[mode].cost(s.PeriodBytes, t.period, savedStart, savedEnd)
+		}
+	}
+	if !current && !traffic.PeriodStart.IsZero() {
+		log.Printf("INFO: Accounting period ended while stopped, period counters reset")
+	}
+	r.accounting.restore(clients, r.registry, t.start.Equal(clients.PeriodStart))
+
+	for mode, l := range r.limits {
+		q := &l.quota
+		q.used, q.mark = 0, r.metrics.GetBytes(mode.String())
+		s, ok := quotas[mode.String()]
+		if !ok {
+			continue
+		}
+		switch {
+		case q.period == nil:
+			q.used, l.warned = s.UsedBytes, s.Warned
+		default:
+			q.start, q.end = q.period.bounds(now, s.PeriodStart)
+			if q.start.Equal(s.PeriodStart) {
+				q.used, l.warned = s.UsedBytes, s.Warned
+			} else {
+				log.Printf("INFO: %s billing period ended while stopped, usage reset", mode)
+			}
+		}
+	}
+	r.syncGatesLocked()
+	r.mu.Unlock()
+
+	return r.SaveState()
+}
+
+// SaveState persists the traffic counters, quota usage and client traffic
+// (no-op without a state store). Concurrent calls are serialized: the
+// periodic flush, period ends and shutdown each write a complete snapshot.
+func (r *Router) SaveState() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.RLock()
+	store := r.store
+	traffic := trafficState{
+		PeriodStart: r.traffic.start,
+		Modes:       make(map[string]modeTrafficState, len(r.traffic.modes)),
+	}
+	for mode, q := range r.traffic.modes {
+		counter := r.metrics.GetBytes(mode.String())
+		traffic.Modes[mode.String()] = modeTrafficState{
+			TotalBytes:  counter,
+			PeriodBytes: q.usage(counter),
+			Spent:       r.traffic.spent[mode],
+		}
+	}
+	quotas := make(map[string]quotaState, len(r.limits))
+	for mode, l := range r.limits {
+		quotas[mode.String()] = quotaState{
+			PeriodStart: l.quota.start,
+			UsedBytes:   l.quota.usage(r.metrics.GetBytes(mode.String())),
+			Warned:      l.warned,
+		}
+	}
+	clients := r.accounting.state(r.traffic.start)
+	r.mu.RUnlock()
+
+	if store == nil {
+		return nil
+	}
+	if err := store.Save(trafficStateName, traffic); err != nil {
+		return err
+	}
+	if err := store.Save(quotaStateName, quotas); err != nil {
+		return err
+	}
+	return store.Save(clientStateName, clients)
+}
+
+// RunStateFlush saves the persisted state every interval until ctx is done
+func (r *Router) RunStateFlush(ctx context.Context) {
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.SaveState(); err != nil {
+				log.Printf("WARN: Failed to save state: %v", err)
+			}
+		}
+	}
+}
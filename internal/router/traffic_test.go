@@ -0,0 +1,100 @@
+package router
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/scinfra-pro/switch-gate/internal/state"
+)
+
+const stateConfig = `
+modes:
+  a: {type: direct}
+limits:
+  a: {max_mb: 100, warnings: [50]}
+`
+
+func TestStateRoundTrip(t *testing.T) {
+	store, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRouter(t, stateConfig)
+	if err := r.RestoreState(store); err != nil {
+		t.Fatal(err)
+	}
+	r.metrics.AddBytes("a", 60*1024*1024)
+	u, release := r.accounting.acquire("192.0.2.1", "a")
+	u.add(1024)
+	release()
+	r.mu.Lock()
+	r.limits["a"].warned = 50
+	r.mu.Unlock()
+	if err := r.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestRouter(t, stateConfig)
+	if err := restored.RestoreState(store); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.metrics.GetBytes("a"); got != 60*1024*1024 {
+		t.Errorf("lifetime bytes = %d, want %d", got, 60*1024*1024)
+	}
+	if got := restored.TrafficPeriod().Bytes["a"]; got != 60*1024*1024 {
+		t.Errorf("period bytes = %d, want %d", got, 60*1024*1024)
+	}
+	restored.mu.RLock()
+	l := restored.limits["a"]
+	used, warned := l.quota.usage(restored.metrics.GetBytes("a")), l.warned
+	restored.mu.RUnlock()
+	if used != 60*1024*1024 || warned != 50 {
+		t.Errorf("limit usage %d, warned %d, want %d, 50", used, warned, 60*1024*1024)
+	}
+	clients := restored.accounting.state(restored.traffic.start).Clients
+	if got := clients["192.0.2.1"]["a"].PeriodBytes; got != 1024 {
+		t.Errorf("client period bytes = %d, want 1024", got)
+	}
+}
+
+func TestSaveStateConcurrent(t *testing.T) {
+	store, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter(t, stateConfig)
+	if err := r.RestoreState(store); err != nil {
+		t.Fatal(err)
+	}
+
+	// Periodic flush, period ends and shutdown save at the same time
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.metrics.AddBytes("a", 1024)
+			if err := r.SaveState(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The last save wrote the final counters to every document
+	var traffic trafficState
+	if _, err := store.Load(trafficStateName, &traffic); err != nil {
+		t.Fatal(err)
+	}
+	quotas := make(map[string]quotaState)
+	if _, err := store.Load(quotaStateName, &quotas); err != nil {
+		t.Fatal(err)
+	}
+	if got := traffic.Modes["a"].TotalBytes; got != 20*1024 {
+		t.Errorf("saved traffic = %d, want %d", got, 20*1024)
+	}
+	if got := quotas["a"].UsedBytes; got != 20*1024 {
+		t.Errorf("saved quota usage = %d, want %d", got, 20*1024)
+	}
+}
@@ -0,0 +1,148 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"time"
+)
+
+// WarningWindow is how far back the usage trend of a limit reaches
+const WarningWindow = 10 * time.Minute
+
+// usageSample is the usage of a limit at one check
+type usageSample struct {
+	at       time.Time
+	used     uint64  // Bytes
+	fraction float64 // Of the limit or budget, whichever is closer
+}
+
+// usageTrend holds the usage samples of the last WarningWindow
+type usageTrend struct {
+	samples []usageSample
+}
+
+func (t *usageTrend) add(s usageSample) {
+	t.samples = append(t.samples, s)
+	cut := 0
+	for cut < len(t.samples)-1 && s.at.Sub(t.samples[cut].at) > WarningWindow {
+		cut++
+	}
+	t.samples = t.samples[cut:]
+}
+
+func (t *usageTrend) reset() {
+	t.samples = nil
+}
+
+// project returns the recent throughput in bytes per second and when the
+// limit will be exhausted at that pace (zero: not growing or unknown)
+func (t *usageTrend) project() (float64, time.Time) {
+	if len(t.samples) < 2 {
+		return 0, time.Time{}
+	}
+	first, last := t.samples[0], t.samples[len(t.samples)-1]
+	secs := last.at.Sub(first.at).Seconds()
+	if secs <= 0 || last.used < first.used {
+		return 0, time.Time{}
+	}
+
+	bps := float64(last.used-first.used) / secs
+	growth := (last.fraction - first.fraction) / secs
+	if growth <= 0 || last.fraction >= 1 {
+		return bps, time.Time{}
+	}
+	eta := time.Duration((1 - last.fraction) / growth * float64(time.Second))
+	return bps, last.at.Add(eta)
+}
+
+// parseWarnings validates warning thresholds (percent) and sorts them
+func parseWarnings(thresholds []int) ([]int, error) {
+	result := slices.Clone(thresholds)
+	for _, t := range result {
+		if t < 1 || t > 99 {
+			return nil, fmt.Errorf("invalid warning threshold: %d (1-99)", t)
+		}
+	}
+	slices.Sort(result)
+	return slices.Compact(result), nil
+}
+
+// fraction returns the used part of the limit or budget, whichever is higher
+func (l *modeLimit) fraction(counter uint64) float64 {
+	var f float64
+	if l.maxBytes > 0 {
+		f = float64(l.quota.usage(counter)) / float64(l.maxBytes)
+	}
+	if l.budget > 0 {
+		f = max(f, l.cost(counter)/l.budget)
+	}
+	return f
+}
+
+// checkWarning records the usage trend of a mode's limit and sends
+// limit.warning when the usage crosses a threshold, once per threshold and
+// period. If several thresholds are crossed at once, only the highest is
+// sent. Thresholds re-arm when the usage drops below them (limit raised).
+func (r *Router) checkWarning(mode Mode, now time.Time) {
+	r.mu.Lock()
+	l, ok := r.limits[mode]
+	if !ok || (l.maxBytes == 0 && l.budget == 0) {
+		r.mu.Unlock()
+		return
+	}
+
+	counter := r.metrics.GetBytes(mode.String())
+	used, fraction := l.quota.usage(counter), l.fraction(counter)
+	l.trend.add(usageSample{at: now, used: used, fraction: fraction})
+
+	crossed := 0
+	for _, t := range l.warnings {
+		if fraction*100 >= float64(t) {
+			crossed = t
+		}
+	}
+	if crossed <= l.warned || fraction >= 1 {
+		// Exhausted limits send limit.reached instead
+		l.warned = crossed
+		r.mu.Unlock()
+		return
+	}
+	l.warned = crossed
+
+	bps, exhaustedAt := l.trend.project()
+	payload := map[string]interface{}{
+		"mode":             mode.String(),
+		"threshold":        crossed,
+		"used_percent":     math.Round(fraction*1000) / 10,
+		"used_mb":          used / 1024 / 1024,
+		"limit_mb":         l.maxBytes / 1024 / 1024,
+		"rate_mb_per_hour": math.Round(bps*3600/1024/1024*10) / 10,
+	}
+	if l.budget > 0 {
+		payload["budget"] = l.budget
+		payload["cost"] = roundCost(l.cost(counter))
+		payload["currency"] = r.currency
+	}
+	if l.quota.period != nil {
+		payload["period_end"] = l.quota.end.Format(time.RFC3339)
+	}
+	eta := ""
+	if !exhaustedAt.IsZero() {
+		in := exhaustedAt.Sub(now)
+		payload["exhausted_at"] = exhaustedAt.Format(time.RFC3339)
+		payload["exhausted_in_sec"] = int64(in.Seconds())
+		if in >= time.Hour {
+			in = in.Round(time.Minute)
+		}
+		eta = fmt.Sprintf(", exhausted in ~%s at the current rate", in.Round(time.Second))
+	}
+	r.mu.Unlock()
+
+	log.Printf("WARN: %s limit %.0f%% used (threshold %d%%)%s", mode, fraction*100, crossed, eta)
+
+	if r.webhook != nil && r.webhookEvents.LimitWarning {
+		r.webhook.Send("limit.warning", payload)
+	}
+}
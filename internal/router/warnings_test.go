@@ -0,0 +1,132 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+// limitUsed returns the usage of a mode's limit
+func limitUsed(r *Router, mode Mode) uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.limitUsedLocked(mode)
+}
+
+func TestCheckWarning(t *testing.T) {
+	r := newTestRouter(t, `
+modes:
+  a: {type: direct}
+limits:
+  a: {max_mb: 100, action: block, warnings: [80, 50, 95], period: daily}
+webhooks:
+  events: {limit_warning: true}
+`)
+	hooks := &webhookRecorder{}
+	r.webhook = hooks
+
+	now := time.Now()
+	steps := []struct {
+		usedMB int // Usage of the limit after the step
+		want   int // Threshold sent, 0: none
+	}{
+		{10, 0},
+		{50, 50},
+		{60, 0},
+		{90, 80},
+		{92, 0},
+		{96, 95},
+		{99, 0},
+		{100, 0}, // Exhausted: limit.reached instead
+	}
+	check := func(period string, usedMB, want int) {
+		t.Helper()
+		r.metrics.AddBytes("a", int64(usedMB)*1024*1024-int64(limitUsed(r, "a")))
+		now = now.Add(time.Minute)
+		r.checkWarning("a", now)
+
+		sent := hooks.take("limit.warning")
+		switch {
+		case want == 0 && len(sent) > 0:
+			t.Errorf("%s, %d MB: sent %v, want none", period, usedMB, sent)
+		case want > 0 && (len(sent) != 1 || sent[0]["threshold"] != want):
+			t.Errorf("%s, %d MB: sent %v, want threshold %d once", period, usedMB, sent, want)
+		}
+	}
+	for _, step := range steps {
+		check("first period", step.usedMB, step.want)
+	}
+
+	// A new period re-arms every threshold; crossing several at once sends
+	// the highest only
+	r.rollLimit("a", now.Add(48*time.Hour))
+	for _, step := range []struct{ usedMB, want int }{{96, 95}, {97, 0}} {
+		check("second period", step.usedMB, step.want)
+	}
+}
+
+func TestCheckWarningPayload(t *testing.T) {
+	r := newTestRouter(t, `
+modes:
+  a: {type: direct}
+limits:
+  a: {max_mb: 100, warnings: [50]}
+webhooks:
+  events: {limit_warning: true}
+`)
+	hooks := &webhookRecorder{}
+	r.webhook = hooks
+
+	// 10 MB per minute: exhausted 5 minutes after the 50 MB sample
+	start := time.Now()
+	for i := range 6 {
+		r.metrics.AddBytes("a", int64(i*10*1024*1024)-int64(limitUsed(r, "a")))
+		r.checkWarning("a", start.Add(time.Duration(i)*time.Minute))
+	}
+
+	sent := hooks.take("limit.warning")
+	if len(sent) != 1 {
+		t.Fatalf("sent %d warnings, want 1", len(sent))
+	}
+	p := sent[0]
+	if p["mode"] != "a" || p["used_mb"] != uint64(50) || p["limit_mb"] != uint64(100) || p["used_percent"] != 50.0 {
+		t.Errorf("payload %v", p)
+	}
+	if p["rate_mb_per_hour"] != 600.0 || p["exhausted_in_sec"] != int64(300) {
+		t.Errorf("projection: rate %v MB/h, exhausted in %v s, want 600 MB/h in 300 s", p["rate_mb_per_hour"], p["exhausted_in_sec"])
+	}
+}
+
+func TestCheckWarningDisabled(t *testing.T) {
+	r := newTestRouter(t, `
+modes:
+  a: {type: direct}
+limits:
+  a: {max_mb: 100, warnings: [50]}
+`)
+	hooks := &webhookRecorder{}
+	r.webhook = hooks
+
+	r.metrics.AddBytes("a", 60*1024*1024)
+	r.checkWarning("a", time.Now())
+	if sent := hooks.take("limit.warning"); len(sent) != 0 {
+		t.Errorf("sent %v with limit_warning events off", sent)
+	}
+	r.mu.RLock()
+	warned := r.limits["a"].warned
+	r.mu.RUnlock()
+	if warned != 50 {
+		t.Errorf("warned = %d, want 50", warned)
+	}
+}
+
+func TestParseWarnings(t *testing.T) {
+	got, err := parseWarnings([]int{95, 50, 80, 50})
+	if err != nil || len(got) != 3 || got[0] != 50 || got[1] != 80 || got[2] != 95 {
+		t.Errorf("parseWarnings = %v, %v, want [50 80 95]", got, err)
+	}
+	for _, bad := range []int{0, 100, -5} {
+		if _, err := parseWarnings([]int{50, bad}); err == nil {
+			t.Errorf("threshold %d accepted", bad)
+		}
+	}
+}
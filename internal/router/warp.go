@@ -1,6 +1,7 @@
 package router
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"time"
@@ -9,12 +10,13 @@ import (
 // WarpDialer uses default routing which goes through tunnel (via policy routing)
 // It does NOT bind to tunnel interface IP - that doesn't work with TUN devices
 type WarpDialer struct {
+	name          string
 	interfaceName string
 	dialer        net.Dialer
 }
 
 // NewWarpDialer creates a dialer that routes through the tunnel interface
-func NewWarpDialer(interfaceName string) (*WarpDialer, error) {
+func NewWarpDialer(name, interfaceName string) (*WarpDialer, error) {
 	// Verify the interface exists (tunnel is installed)
 	_, err := net.InterfaceByName(interfaceName)
 	if err != nil {
@@ -23,6 +25,7 @@ func NewWarpDialer(interfaceName string) (*WarpDialer, error) {
 
 	// Use default dialer WITHOUT LocalAddr - traffic will go through tunnel via policy routing
 	return &WarpDialer{
+		name:          name,
 		interfaceName: interfaceName,
 		dialer: net.Dialer{
 			Timeout:   10 * time.Second,
@@ -31,14 +34,14 @@ func NewWarpDialer(interfaceName string) (*WarpDialer, error) {
 	}, nil
 }
 
-// Dial connects to the address through the tunnel
-func (d *WarpDialer) Dial(network, address string) (net.Conn, error) {
-	return d.dialer.Dial(network, address)
+// DialContext connects to the address through the tunnel
+func (d *WarpDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, network, address)
 }
 
 // Name returns the dialer name
 func (d *WarpDialer) Name() string {
-	return "warp"
+	return d.name
 }
 
 // InterfaceName returns the tunnel interface name
@@ -0,0 +1,98 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type doc struct {
+	Name  string            `json:"name"`
+	Bytes map[string]uint64 `json:"bytes"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Dir() != dir {
+		t.Errorf("Dir = %s, want %s", s.Dir(), dir)
+	}
+
+	var got doc
+	if ok, err := s.Load("traffic", &got); ok || err != nil {
+		t.Fatalf("Load of a missing document = %v, %v, want false, nil", ok, err)
+	}
+
+	for _, want := range []doc{
+		{Name: "first", Bytes: map[string]uint64{"home": 1}},
+		{Name: "second", Bytes: map[string]uint64{"home": 2, "warp": 1 << 40}},
+	} {
+		if err := s.Save("traffic", want); err != nil {
+			t.Fatal(err)
+		}
+		got = doc{}
+		if ok, err := s.Load("traffic", &got); !ok || err != nil {
+			t.Fatalf("Load = %v, %v", ok, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Load = %+v, want %+v", got, want)
+		}
+	}
+
+	// Temporary files are renamed or removed
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "traffic.json" {
+		t.Errorf("state directory holds %v, want traffic.json only", entries)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"truncated", `{"name": "tra`},
+		{"garbage", "\x00\x01 not json"},
+		{"wrong type", `{"name": 42}`},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(filepath.Join(s.Dir(), "quotas.json"), []byte(tt.data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		var v doc
+		if ok, err := s.Load("quotas", &v); ok || err == nil {
+			t.Errorf("%s: Load = %v, %v, want an error", tt.name, ok, err)
+		}
+	}
+}
+
+func TestSaveError(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save("traffic", doc{Name: "kept"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value that cannot be encoded leaves the old document
+	if err := s.Save("traffic", map[string]any{"bad": make(chan int)}); err == nil {
+		t.Fatal("Save of an unencodable value succeeded")
+	}
+	var got doc
+	if _, err := s.Load("traffic", &got); err != nil || got.Name != "kept" {
+		t.Errorf("Load after a failed Save = %+v, %v, want the old document", got, err)
+	}
+}